@@ -15,14 +15,24 @@ import (
 )
 
 func makeServer(listenAddr string, nodes ...string) *server.FileServer {
+	identity, err := crypto.LoadOrCreateIdentity(listenAddr + "_identity.pem")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	tcpTransportOpts := tcp.TCPTransportOpts{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
+		ListenAddr: listenAddr,
+		HandshakeFunc: p2p.NewAuthHandshakeFunc(p2p.HandshakeOpts{
+			Identity:   identity,
+			Protocol:   server.Protocol(),
+			ListenAddr: listenAddr,
+		}),
+		Decoder: p2p.DefaultDecoder{},
 	}
 	tcpTransport := tcp.NewTCPTransport(tcpTransportOpts)
 
 	fileServerOpts := server.FileServerOpts{
+		Identity:          identity,
 		EncKey:            crypto.NewEncryptionKey(),
 		StorageRoot:       listenAddr + "_network",
 		PathTransformFunc: storage.CASPathTransformFunc,
@@ -30,11 +40,7 @@ func makeServer(listenAddr string, nodes ...string) *server.FileServer {
 		BootstrapNodes:    nodes,
 	}
 
-	fs := server.NewFileServer(fileServerOpts)
-
-	tcpTransport.OnPeer = fs.OnPeer
-
-	return fs
+	return server.NewFileServer(fileServerOpts)
 }
 
 func main() {
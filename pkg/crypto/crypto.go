@@ -56,7 +56,7 @@ func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	// Read the IV from io.Reader
 	// Should be the block.BlockSize()
 	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 
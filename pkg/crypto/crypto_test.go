@@ -33,3 +33,33 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Errorf("decrypt failed")
 	}
 }
+
+func TestIdentity(t *testing.T) {
+	file := t.TempDir() + "/node/identity.pem"
+
+	identity, err := LoadOrCreateIdentity(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadOrCreateIdentity(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.ID() != loaded.ID() {
+		t.Errorf("identity not persisted, want %s, have %s", identity.ID(), loaded.ID())
+	}
+
+	msg := []byte("prove it")
+	sig := identity.Sign(msg)
+
+	if !Verify(identity.ID(), msg, sig) {
+		t.Errorf("valid signature rejected")
+	}
+
+	other, _ := NewIdentity()
+	if Verify(other.ID(), msg, sig) {
+		t.Errorf("signature accepted for the wrong node ID")
+	}
+}
@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Identity is the long lived keypair of a node,
+// the hex encoded public key is the node ID
+type Identity struct {
+	privateKey ed25519.PrivateKey
+}
+
+func NewIdentity() (*Identity, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{privateKey: privateKey}, nil
+}
+
+// LoadOrCreateIdentity reads the identity stored in file,
+// generating and saving a new one if the file doesn't exist yet
+func LoadOrCreateIdentity(file string) (*Identity, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return createIdentity(file)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in identity file %s", file)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity file %s doesn't hold an ed25519 key", file)
+	}
+
+	return &Identity{privateKey: privateKey}, nil
+}
+
+func createIdentity(file string) (*Identity, error) {
+	identity, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(identity.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// ID is the node ID, the hex encoded public key
+func (i *Identity) ID() string {
+	return hex.EncodeToString(i.privateKey.Public().(ed25519.PublicKey))
+}
+
+func (i *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(i.privateKey, msg)
+}
+
+// Verify checks that sig over msg was made by the node with the given ID
+func Verify(id string, msg, sig []byte) bool {
+	publicKey, err := hex.DecodeString(id)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+
+	return ed25519.Verify(publicKey, msg, sig)
+}
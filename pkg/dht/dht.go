@@ -0,0 +1,240 @@
+package dht
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultK                 = 20
+	defaultAlpha             = 3
+	defaultRefreshInterval   = 10 * time.Minute
+	defaultProviderTTL       = 24 * time.Hour
+	defaultRepublishInterval = time.Hour
+)
+
+// Network is how the DHT talks to other nodes
+type Network interface {
+	// FindNode asks the node for the contacts it knows closest to target
+	FindNode(to Contact, target ID) ([]Contact, error)
+	// FindValue asks the node for the providers of the key it knows, if
+	// it knows none it answers with the contacts it knows closest to the key
+	FindValue(to Contact, key string) ([]Contact, []Contact, error)
+	// Store asks the node to record the local node as a provider of the key
+	Store(to Contact, key string) error
+	Ping(to Contact) error
+}
+
+type Opts struct {
+	// Self is the local node
+	Self    Contact
+	Network Network
+	// K is the bucket size and the number of nodes a lookup
+	// returns, Alpha how many nodes a lookup queries at once
+	K     int
+	Alpha int
+	// RefreshInterval is how often buckets without lookups are refreshed
+	RefreshInterval time.Duration
+	// ProviderTTL is how long a provider record is kept, RepublishInterval
+	// how often the keys this node provides are published again
+	ProviderTTL       time.Duration
+	RepublishInterval time.Duration
+}
+
+// DHT is a Kademlia distributed hash table. It routes keys to the nodes
+// closest to them by XOR distance, a lookup contacts O(log n) nodes
+type DHT struct {
+	Opts
+	table *RoutingTable
+
+	providers    providerStore
+	providedLock sync.Mutex
+	provided     map[string]struct{}
+
+	stopOnce sync.Once
+	quit     chan struct{}
+}
+
+func New(opts Opts) *DHT {
+	if opts.K == 0 {
+		opts.K = defaultK
+	}
+
+	if opts.Alpha == 0 {
+		opts.Alpha = defaultAlpha
+	}
+
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = defaultRefreshInterval
+	}
+
+	if opts.ProviderTTL == 0 {
+		opts.ProviderTTL = defaultProviderTTL
+	}
+
+	if opts.RepublishInterval == 0 {
+		opts.RepublishInterval = defaultRepublishInterval
+	}
+
+	return &DHT{
+		Opts:     opts,
+		table:    NewRoutingTable(opts.Self.ID, opts.K),
+		provided: make(map[string]struct{}),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start runs the bucket refresh and the republishing until Stop is called
+func (d *DHT) Start() {
+	go d.refreshLoop()
+	go d.republishLoop()
+}
+
+func (d *DHT) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.quit)
+	})
+}
+
+func (d *DHT) Table() *RoutingTable {
+	return d.table
+}
+
+// Update adds a contact the node heard from. If its bucket is full the
+// least recently seen contact is pinged and replaced if it is gone
+func (d *DHT) Update(c Contact) {
+	oldest, full := d.table.Update(c)
+	if !full {
+		return
+	}
+
+	go func() {
+		if err := d.Network.Ping(oldest); err != nil {
+			d.table.Replace(oldest, c)
+			return
+		}
+
+		// the oldest one is alive, it moves to the back of its bucket
+		d.table.Update(oldest)
+	}()
+}
+
+// Closest returns the contacts this node knows closest to target,
+// it is what the node answers FIND_NODE requests with
+func (d *DHT) Closest(target ID) []Contact {
+	return d.table.Closest(target, d.K)
+}
+
+// FindNode looks up the K nodes closest to target that answered
+func (d *DHT) FindNode(target ID) []Contact {
+	closest, _ := d.lookup(target, "")
+	return closest
+}
+
+// FindValue looks up the providers of key, stopping at the first round
+// that found any. If no node knows one, the closest nodes are returned
+func (d *DHT) FindValue(key string) ([]Contact, []Contact) {
+	closest, providers := d.lookup(NewID(key), key)
+	return providers, closest
+}
+
+// lookup queries the closest nodes it knows, learning ever closer ones
+// from their answers, until the K closest it found have all answered
+func (d *DHT) lookup(target ID, key string) ([]Contact, []Contact) {
+	d.table.touch(target)
+
+	s := newShortlist(target, d.Self.ID)
+	s.add(d.table.Closest(target, d.K))
+
+	providers := []Contact{}
+
+	for {
+		batch := s.next(d.K, d.Alpha)
+		if len(batch) == 0 {
+			break
+		}
+
+		var (
+			wg   sync.WaitGroup
+			lock sync.Mutex
+		)
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c Contact) {
+				defer wg.Done()
+
+				var (
+					found    []Contact
+					contacts []Contact
+					err      error
+				)
+				if len(key) == 0 {
+					contacts, err = d.Network.FindNode(c, target)
+				} else {
+					found, contacts, err = d.Network.FindValue(c, key)
+				}
+
+				lock.Lock()
+				defer lock.Unlock()
+
+				if err != nil {
+					s.fail(c)
+					return
+				}
+
+				s.answered(c)
+				s.add(contacts)
+				d.Update(c)
+
+				for _, p := range found {
+					if !slices.ContainsFunc(providers, func(other Contact) bool { return other.ID == p.ID }) {
+						providers = append(providers, p)
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+
+		if len(providers) > 0 {
+			break
+		}
+	}
+
+	return s.closest(d.K), providers
+}
+
+func (d *DHT) refreshLoop() {
+	ticker := time.NewTicker(d.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Refresh()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// Refresh looks up a random ID in every bucket no lookup went through
+// for a refresh interval, so the table keeps up with the cluster
+func (d *DHT) Refresh() {
+	stale := d.table.stale(time.Now().Add(-d.RefreshInterval))
+
+	for _, i := range stale {
+		select {
+		case <-d.quit:
+			return
+		default:
+		}
+
+		d.FindNode(randomIDInBucket(d.Self.ID, i))
+	}
+
+	if len(stale) > 0 {
+		log.Printf("[%s] refreshed %d buckets, %d contacts known\n", d.Self.Addr, len(stale), d.table.Size())
+	}
+}
@@ -0,0 +1,242 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memNetwork routes the requests between DHTs in memory
+type memNetwork struct {
+	lock  sync.Mutex
+	nodes map[ID]*DHT
+
+	requests atomic.Int64
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		nodes: make(map[ID]*DHT),
+	}
+}
+
+// endpoint is the network as a single node sees it,
+// the nodes it sends requests to learn about it
+type endpoint struct {
+	*memNetwork
+	self Contact
+}
+
+func (e endpoint) node(c Contact) (*DHT, error) {
+	e.requests.Add(1)
+
+	e.lock.Lock()
+	d, ok := e.nodes[c.ID]
+	e.lock.Unlock()
+
+	if !ok {
+		return nil, errors.New("node unreachable")
+	}
+
+	d.Update(e.self)
+
+	return d, nil
+}
+
+func (e endpoint) FindNode(to Contact, target ID) ([]Contact, error) {
+	d, err := e.node(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Closest(target), nil
+}
+
+func (e endpoint) FindValue(to Contact, key string) ([]Contact, []Contact, error) {
+	d, err := e.node(to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if providers := d.Providers(key); len(providers) > 0 {
+		return providers, nil, nil
+	}
+
+	return nil, d.Closest(NewID(key)), nil
+}
+
+func (e endpoint) Store(to Contact, key string) error {
+	d, err := e.node(to)
+	if err != nil {
+		return err
+	}
+
+	d.AddProvider(key, e.self)
+
+	return nil
+}
+
+func (e endpoint) Ping(to Contact) error {
+	_, err := e.node(to)
+	return err
+}
+
+func newTestDHT(t *testing.T, size int) (*memNetwork, []*DHT) {
+	network := newMemNetwork()
+	nodes := []*DHT{}
+
+	for i := 0; i < size; i++ {
+		self := NewContact(fmt.Sprintf("node-%d", i), fmt.Sprintf("addr-%d", i))
+		d := New(Opts{
+			Self:    self,
+			Network: endpoint{memNetwork: network, self: self},
+		})
+
+		network.nodes[d.Self.ID] = d
+		nodes = append(nodes, d)
+	}
+
+	// every node joins through a random earlier node
+	// and looks itself up to fill its table
+	r := rand.New(rand.NewSource(1))
+	for i, d := range nodes[1:] {
+		d.Update(nodes[r.Intn(i+1)].Self)
+		d.FindNode(d.Self.ID)
+	}
+
+	return network, nodes
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	self := NewID("self")
+	table := NewRoutingTable(self, 20)
+
+	contacts := []Contact{}
+	for i := 0; i < 100; i++ {
+		c := NewContact(fmt.Sprintf("node-%d", i), "")
+		contacts = append(contacts, c)
+		table.Update(c)
+	}
+
+	if table.Size() == 0 || table.Size() > 100 {
+		t.Fatalf("unexpected table size %d", table.Size())
+	}
+
+	target := NewID("target")
+	closest := table.Closest(target, 5)
+
+	for i := 1; i < len(closest); i++ {
+		if closer(target, closest[i].ID, closest[i-1].ID) {
+			t.Errorf("contacts are not ordered by distance")
+		}
+	}
+
+	table.Remove(closest[0].ID)
+	if table.Closest(target, 1)[0].ID == closest[0].ID {
+		t.Errorf("removed contact is still in the table")
+	}
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	self := NewID("self")
+
+	for _, prefixLen := range []int{0, 1, 7, 8, 100, 255} {
+		id := randomIDInBucket(self, prefixLen)
+		if got := self.CommonPrefixLen(id); got != prefixLen {
+			t.Errorf("expected prefix length %d, got %d", prefixLen, got)
+		}
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	network, nodes := newTestDHT(t, 200)
+
+	target := NewID("some key")
+
+	all := []Contact{}
+	for _, d := range nodes {
+		all = append(all, d.Self)
+	}
+	sortByDistance(target, all)
+
+	network.requests.Store(0)
+	closest := nodes[42].FindNode(target)
+
+	if len(closest) != defaultK {
+		t.Fatalf("expected %d contacts, got %d", defaultK, len(closest))
+	}
+
+	for i, c := range closest[:5] {
+		if c.ID != all[i].ID && c.ID != nodes[42].Self.ID {
+			t.Errorf("contact %d is not among the closest nodes", i)
+		}
+	}
+
+	if n := network.requests.Load(); n > int64(len(nodes)/2) {
+		t.Errorf("lookup took %d requests in a cluster of %d nodes", n, len(nodes))
+	}
+}
+
+func TestFindValue(t *testing.T) {
+	_, nodes := newTestDHT(t, 100)
+
+	key := "owner/key"
+
+	// the node holding the value is far from the key,
+	// it is found through the records at the closest nodes
+	all := []Contact{}
+	for _, d := range nodes {
+		all = append(all, d.Self)
+	}
+	sortByDistance(NewID(key), all)
+
+	var holder *DHT
+	for _, d := range nodes {
+		if d.Self.ID == all[len(all)-1].ID {
+			holder = d
+		}
+	}
+	holder.Provide(key)
+
+	found, _ := nodes[99].FindValue(key)
+	if len(found) != 1 || found[0].ID != holder.Self.ID {
+		t.Fatalf("expected the holder of the key, got %v", found)
+	}
+
+	holder.Unprovide(key)
+	holder.Republish()
+
+	for _, d := range nodes {
+		d.providers.expire(time.Now().Add(d.ProviderTTL + time.Second))
+	}
+
+	if found, _ := nodes[99].FindValue(key); len(found) != 0 {
+		t.Errorf("expired provider record still found")
+	}
+
+	found, closest := nodes[99].FindValue("missing")
+	if len(found) != 0 || len(closest) == 0 {
+		t.Errorf("expected closest nodes only, got %d holders and %d contacts", len(found), len(closest))
+	}
+}
+
+func TestFindNodeSkipsUnreachable(t *testing.T) {
+	network, nodes := newTestDHT(t, 50)
+
+	target := NewID("some key")
+	gone := nodes[0].FindNode(target)[0]
+
+	network.lock.Lock()
+	delete(network.nodes, gone.ID)
+	network.lock.Unlock()
+
+	for _, c := range nodes[0].FindNode(target) {
+		if c.ID == gone.ID {
+			t.Errorf("unreachable node returned by the lookup")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+)
+
+const (
+	// IDBits is the size of the key space
+	IDBits = 256
+	idSize = IDBits / 8
+)
+
+// ID is a point in the key space, node IDs and keys are hashed into it
+type ID [idSize]byte
+
+// NewID hashes a node ID or a key into the key space
+func NewID(s string) ID {
+	return ID(sha256.Sum256([]byte(s)))
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Xor is the distance between two IDs
+func (id ID) Xor(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+
+	return d
+}
+
+// CommonPrefixLen is the number of leading bits both IDs share
+func (id ID) CommonPrefixLen(other ID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return IDBits
+}
+
+// Compare orders IDs as big endian numbers
+func (id ID) Compare(other ID) int {
+	for i := range id {
+		switch {
+		case id[i] < other[i]:
+			return -1
+		case id[i] > other[i]:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// closer tells whether a is closer to target than b
+func closer(target, a, b ID) bool {
+	return a.Xor(target).Compare(b.Xor(target)) < 0
+}
+
+// randomIDInBucket returns an ID sharing exactly prefixLen leading bits
+// with id, it is what a bucket is refreshed with
+func randomIDInBucket(id ID, prefixLen int) ID {
+	var random ID
+	rand.Read(random[:])
+
+	result := id
+	byteIdx, bitIdx := prefixLen/8, uint(prefixLen%8)
+
+	// the bit after the prefix is flipped, the rest is random
+	mask := byte(0x80 >> bitIdx)
+	result[byteIdx] = (id[byteIdx] & ^(mask - 1)) ^ mask | random[byteIdx]&(mask-1)
+	for i := byteIdx + 1; i < idSize; i++ {
+		result[i] = random[i]
+	}
+
+	return result
+}
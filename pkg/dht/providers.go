@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// providerStore keeps the nodes other nodes said hold a key, a record
+// expires unless the provider publishes it again
+type providerStore struct {
+	lock    sync.Mutex
+	records map[string]map[ID]provider
+}
+
+type provider struct {
+	Contact
+	expires time.Time
+}
+
+func (s *providerStore) add(key string, c Contact, expires time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.records == nil {
+		s.records = make(map[string]map[ID]provider)
+	}
+
+	if s.records[key] == nil {
+		s.records[key] = make(map[ID]provider)
+	}
+
+	s.records[key][c.ID] = provider{Contact: c, expires: expires}
+}
+
+func (s *providerStore) get(key string, now time.Time) []Contact {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	contacts := []Contact{}
+	for id, p := range s.records[key] {
+		if now.After(p.expires) {
+			delete(s.records[key], id)
+			continue
+		}
+
+		contacts = append(contacts, p.Contact)
+	}
+
+	if len(s.records[key]) == 0 {
+		delete(s.records, key)
+	}
+
+	return contacts
+}
+
+// expire drops the records past their expiry
+func (s *providerStore) expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, providers := range s.records {
+		for id, p := range providers {
+			if now.After(p.expires) {
+				delete(providers, id)
+			}
+		}
+
+		if len(providers) == 0 {
+			delete(s.records, key)
+		}
+	}
+}
+
+// AddProvider records that the contact holds the key, it is what the
+// node does with the STORE requests it gets
+func (d *DHT) AddProvider(key string, c Contact) {
+	d.providers.add(key, c, time.Now().Add(d.ProviderTTL))
+}
+
+// Providers returns the nodes this node knows hold the key, it is what
+// the node answers FIND_VALUE requests with
+func (d *DHT) Providers(key string) []Contact {
+	return d.providers.get(key, time.Now())
+}
+
+// Provide publishes that this node holds the key at the K nodes closest
+// to it, and again every republish interval until Unprovide is called.
+// A key provided already is left to the republishing
+func (d *DHT) Provide(key string) {
+	d.providedLock.Lock()
+	_, ok := d.provided[key]
+	d.provided[key] = struct{}{}
+	d.providedLock.Unlock()
+
+	if !ok {
+		d.publish(key)
+	}
+}
+
+// Unprovide stops publishing the key, the records left on other
+// nodes expire on their own
+func (d *DHT) Unprovide(key string) {
+	d.providedLock.Lock()
+	defer d.providedLock.Unlock()
+
+	delete(d.provided, key)
+}
+
+// publish stores this node as a provider of the key at the K closest
+// nodes, this node keeps the record too when it is one of them
+func (d *DHT) publish(key string) {
+	target := NewID(key)
+	closest := d.FindNode(target)
+
+	stored := 0
+	for _, c := range closest {
+		if err := d.Network.Store(c, key); err != nil {
+			continue
+		}
+
+		stored++
+	}
+
+	if len(closest) < d.K || closer(target, d.Self.ID, closest[len(closest)-1].ID) {
+		d.AddProvider(key, d.Self)
+	}
+
+	if stored == 0 && len(closest) > 0 {
+		log.Printf("[%s] no node stored the provider record of %s\n", d.Self.Addr, key)
+	}
+}
+
+func (d *DHT) republishLoop() {
+	ticker := time.NewTicker(d.RepublishInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Republish()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// Republish publishes the keys this node provides again before their
+// records expire, and drops the expired records of other nodes
+func (d *DHT) Republish() {
+	d.providers.expire(time.Now())
+
+	d.providedLock.Lock()
+	keys := make([]string, 0, len(d.provided))
+	for key := range d.provided {
+		keys = append(keys, key)
+	}
+	d.providedLock.Unlock()
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		select {
+		case <-d.quit:
+			return
+		default:
+		}
+
+		d.publish(key)
+	}
+}
@@ -0,0 +1,89 @@
+package dht
+
+type lookupState int
+
+const (
+	pending lookupState = iota
+	queried
+	answered
+	failed
+)
+
+// shortlist tracks the candidates of a lookup ordered by distance
+type shortlist struct {
+	target ID
+	self   ID
+
+	contacts []Contact
+	state    map[ID]lookupState
+}
+
+func newShortlist(target, self ID) *shortlist {
+	return &shortlist{
+		target: target,
+		self:   self,
+		state:  make(map[ID]lookupState),
+	}
+}
+
+func (s *shortlist) add(contacts []Contact) {
+	for _, c := range contacts {
+		if _, ok := s.state[c.ID]; ok || c.ID == s.self {
+			continue
+		}
+
+		s.state[c.ID] = pending
+		s.contacts = append(s.contacts, c)
+	}
+
+	sortByDistance(s.target, s.contacts)
+}
+
+// next picks up to alpha contacts among the k closest live
+// ones that were not queried yet and marks them queried
+func (s *shortlist) next(k, alpha int) []Contact {
+	batch := []Contact{}
+
+	live := 0
+	for _, c := range s.contacts {
+		if live == k || len(batch) == alpha {
+			break
+		}
+
+		switch s.state[c.ID] {
+		case failed:
+			continue
+		case pending:
+			s.state[c.ID] = queried
+			batch = append(batch, c)
+		}
+
+		live++
+	}
+
+	return batch
+}
+
+func (s *shortlist) answered(c Contact) {
+	s.state[c.ID] = answered
+}
+
+func (s *shortlist) fail(c Contact) {
+	s.state[c.ID] = failed
+}
+
+// closest returns up to k of the closest contacts that answered
+func (s *shortlist) closest(k int) []Contact {
+	result := []Contact{}
+	for _, c := range s.contacts {
+		if len(result) == k {
+			break
+		}
+
+		if s.state[c.ID] == answered {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
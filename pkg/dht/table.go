@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Contact is how to reach a node of the DHT
+type Contact struct {
+	ID ID
+	// NodeID is the ID the node goes by in the cluster, ID is its hash
+	NodeID string
+	Addr   string
+}
+
+func NewContact(nodeID, addr string) Contact {
+	return Contact{ID: NewID(nodeID), NodeID: nodeID, Addr: addr}
+}
+
+// bucket holds up to k contacts sharing the same prefix length
+// with the local node, least recently seen first
+type bucket struct {
+	contacts []Contact
+	// lastLookup is when a lookup last went through the bucket
+	lastLookup time.Time
+}
+
+// RoutingTable keeps a bucket for every prefix length the contacts share
+// with the local node, so it knows many close nodes and few far ones
+type RoutingTable struct {
+	self ID
+	k    int
+
+	lock    sync.Mutex
+	buckets [IDBits]*bucket
+}
+
+func NewRoutingTable(self ID, k int) *RoutingTable {
+	t := &RoutingTable{self: self, k: k}
+
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i] = &bucket{lastLookup: now}
+	}
+
+	return t
+}
+
+func (t *RoutingTable) bucketIndex(id ID) int {
+	// the local node itself would be past the last bucket
+	return min(t.self.CommonPrefixLen(id), IDBits-1)
+}
+
+// Update marks the contact as just seen. When its bucket is full the
+// contact is not added and the least recently seen one is returned,
+// it should be pinged and replaced if it doesn't answer
+func (t *RoutingTable) Update(c Contact) (Contact, bool) {
+	if c.ID == t.self {
+		return Contact{}, false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	b := t.buckets[t.bucketIndex(c.ID)]
+
+	if i := slices.IndexFunc(b.contacts, func(other Contact) bool { return other.ID == c.ID }); i >= 0 {
+		b.contacts = append(slices.Delete(b.contacts, i, i+1), c)
+		return Contact{}, false
+	}
+
+	if len(b.contacts) < t.k {
+		b.contacts = append(b.contacts, c)
+		return Contact{}, false
+	}
+
+	return b.contacts[0], true
+}
+
+// Replace swaps a contact that stopped answering for a new one
+func (t *RoutingTable) Replace(old, c Contact) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	b := t.buckets[t.bucketIndex(old.ID)]
+
+	i := slices.IndexFunc(b.contacts, func(other Contact) bool { return other.ID == old.ID })
+	if i < 0 {
+		return
+	}
+
+	b.contacts = slices.Delete(b.contacts, i, i+1)
+	if t.bucketIndex(c.ID) == t.bucketIndex(old.ID) && len(b.contacts) < t.k {
+		b.contacts = append(b.contacts, c)
+	}
+}
+
+func (t *RoutingTable) Remove(id ID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	b := t.buckets[t.bucketIndex(id)]
+	b.contacts = slices.DeleteFunc(b.contacts, func(c Contact) bool { return c.ID == id })
+}
+
+// Closest returns up to n contacts closest to target, closest first
+func (t *RoutingTable) Closest(target ID, n int) []Contact {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	contacts := []Contact{}
+	for _, b := range t.buckets {
+		contacts = append(contacts, b.contacts...)
+	}
+
+	sortByDistance(target, contacts)
+
+	return contacts[:min(n, len(contacts))]
+}
+
+func (t *RoutingTable) Size() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b.contacts)
+	}
+
+	return n
+}
+
+// touch records a lookup through the bucket of target
+func (t *RoutingTable) touch(target ID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.buckets[t.bucketIndex(target)].lastLookup = time.Now()
+}
+
+// stale returns the buckets no lookup went through since the given time
+func (t *RoutingTable) stale(since time.Time) []int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// buckets past the closest contact are left to the lookups of
+	// the local node itself, refreshing them one by one is a waste
+	last := -1
+	for i, b := range t.buckets {
+		if len(b.contacts) > 0 {
+			last = i
+		}
+	}
+
+	stale := []int{}
+	for i := 0; i <= last; i++ {
+		if t.buckets[i].lastLookup.Before(since) {
+			stale = append(stale, i)
+		}
+	}
+
+	return stale
+}
+
+func sortByDistance(target ID, contacts []Contact) {
+	slices.SortFunc(contacts, func(a, b Contact) int {
+		return a.ID.Xor(target).Compare(b.ID.Xor(target))
+	})
+}
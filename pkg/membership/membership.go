@@ -0,0 +1,398 @@
+package membership
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeInterval  = time.Second
+	defaultIndirectProbes = 3
+	defaultRetransmitMult = 4
+	defaultMaxPiggyback   = 16
+
+	// eventBufferSize is how many events a subscriber may fall behind
+	// before it starts missing them
+	eventBufferSize = 64
+)
+
+var ErrMalformedMessage = errors.New("malformed membership message")
+
+type State int
+
+const (
+	StateAlive State = iota + 1
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+// Member is a node of the cluster as this node sees it
+type Member struct {
+	ID   string
+	Addr string
+	// State is what this node believes about the member
+	State State
+	// Incarnation is raised by the member itself to refute a suspicion,
+	// newer incarnations override whatever was said about older ones
+	Incarnation uint64
+}
+
+// Event tells about a member changing its state
+type Event struct {
+	Member Member
+	// Previous is the state the member had, zero for a new member
+	Previous State
+}
+
+type Opts struct {
+	// ID and Addr are how the other members know this node
+	ID   string
+	Addr string
+	// Send delivers a membership message to the member with the given ID
+	Send func(to string, payload []byte) error
+	// ProbeInterval is the protocol period, one member is probed in each.
+	// A probe not answered within ProbeTimeout is retried indirectly
+	// through IndirectProbes other members
+	ProbeInterval  time.Duration
+	ProbeTimeout   time.Duration
+	IndirectProbes int
+	// SuspicionTimeout is how long a suspected member has to refute
+	// the suspicion before it is declared dead
+	SuspicionTimeout time.Duration
+	// RetransmitMult scales how many times each update is piggybacked,
+	// MaxPiggyback caps the updates carried by a single message
+	RetransmitMult int
+	MaxPiggyback   int
+}
+
+// Membership is a SWIM failure detector. Every protocol period one member
+// is pinged, directly and then through other members, and a member that
+// can't be reached by anybody is suspected and finally declared dead.
+// Changes spread piggybacked on the probe messages
+type Membership struct {
+	Opts
+
+	lock       sync.Mutex
+	members    map[string]*Member
+	suspicions map[string]*time.Timer
+	broadcasts *broadcastQueue
+	rand       *rand.Rand
+
+	// probeOrder is a shuffled round of the members to probe
+	probeOrder []string
+
+	ackLock sync.Mutex
+	acks    map[uint64]chan struct{}
+	seq     uint64
+
+	subscribersLock sync.Mutex
+	subscribers     map[chan Event]struct{}
+
+	stopOnce sync.Once
+	quit     chan struct{}
+}
+
+func New(opts Opts) *Membership {
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = defaultProbeInterval
+	}
+
+	if opts.ProbeTimeout == 0 {
+		opts.ProbeTimeout = opts.ProbeInterval / 3
+	}
+
+	if opts.IndirectProbes == 0 {
+		opts.IndirectProbes = defaultIndirectProbes
+	}
+
+	if opts.SuspicionTimeout == 0 {
+		opts.SuspicionTimeout = 5 * opts.ProbeInterval
+	}
+
+	if opts.RetransmitMult == 0 {
+		opts.RetransmitMult = defaultRetransmitMult
+	}
+
+	if opts.MaxPiggyback == 0 {
+		opts.MaxPiggyback = defaultMaxPiggyback
+	}
+
+	m := &Membership{
+		Opts:        opts,
+		members:     make(map[string]*Member),
+		suspicions:  make(map[string]*time.Timer),
+		broadcasts:  newBroadcastQueue(),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		acks:        make(map[uint64]chan struct{}),
+		subscribers: make(map[chan Event]struct{}),
+		quit:        make(chan struct{}),
+	}
+
+	m.members[opts.ID] = &Member{ID: opts.ID, Addr: opts.Addr, State: StateAlive}
+
+	return m
+}
+
+// Start runs the probe loop until Stop is called
+func (m *Membership) Start() {
+	go m.probeLoop()
+}
+
+func (m *Membership) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.quit)
+
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		for _, timer := range m.suspicions {
+			timer.Stop()
+		}
+	})
+}
+
+// Join adds a node this node got connected to and exchanges the
+// full membership state with it, so the two views converge right away
+func (m *Membership) Join(id, addr string) {
+	m.lock.Lock()
+	if _, ok := m.members[id]; !ok {
+		m.apply(update{ID: id, Addr: addr, State: StateAlive})
+	}
+	state := m.stateLocked()
+	m.lock.Unlock()
+
+	m.send(id, message{Type: messageSync, Members: state})
+}
+
+// Members returns the membership view, dead members included,
+// ordered by member ID
+func (m *Membership) Members() []Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+
+	slices.SortFunc(members, func(a, b Member) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return members
+}
+
+// Member returns what this node knows about the member
+func (m *Membership) Member(id string) (Member, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	member, ok := m.members[id]
+	if !ok {
+		return Member{}, false
+	}
+
+	return *member, true
+}
+
+// Subscribe returns a channel receiving the membership changes and the
+// function to stop receiving them. Events are never waited for,
+// a subscriber too slow to keep up misses them
+func (m *Membership) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	m.subscribersLock.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.subscribersLock.Unlock()
+
+	unsubscribe := func() {
+		m.subscribersLock.Lock()
+		defer m.subscribersLock.Unlock()
+
+		if _, ok := m.subscribers[ch]; ok {
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+func (m *Membership) publish(event Event) {
+	m.subscribersLock.Lock()
+	defer m.subscribersLock.Unlock()
+
+	for ch := range m.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("[%s] subscriber missed %s event of member (%s)\n", m.Addr, event.Member.State, event.Member.ID)
+		}
+	}
+}
+
+// HandleMessage processes a membership message the member with the given ID sent
+func (m *Membership) HandleMessage(from string, payload []byte) error {
+	var msg message
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&msg); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+
+	m.lock.Lock()
+	for _, u := range msg.Updates {
+		m.apply(u)
+	}
+	for _, u := range msg.Members {
+		m.apply(u)
+	}
+	m.lock.Unlock()
+
+	switch msg.Type {
+	case messagePing:
+		m.send(from, message{Type: messageAck, SeqNo: msg.SeqNo})
+	case messagePingReq:
+		go m.probeFor(from, msg.SeqNo, msg.Target)
+	case messageAck:
+		m.ack(msg.SeqNo)
+	case messageSync:
+		m.lock.Lock()
+		state := m.stateLocked()
+		m.lock.Unlock()
+
+		m.send(from, message{Type: messageSyncReply, Members: state})
+	case messageSyncReply:
+	default:
+		return fmt.Errorf("%w: unknown type %d", ErrMalformedMessage, msg.Type)
+	}
+
+	return nil
+}
+
+// apply merges an update into the view, it has to be called under lock
+func (m *Membership) apply(u update) {
+	if u.ID == m.ID {
+		m.refute(u)
+		return
+	}
+
+	member, ok := m.members[u.ID]
+	if ok && !u.overrides(member) {
+		return
+	}
+
+	previous := State(0)
+	if ok {
+		previous = member.State
+	} else {
+		member = &Member{ID: u.ID}
+		m.members[u.ID] = member
+	}
+
+	member.State = u.State
+	member.Incarnation = u.Incarnation
+	if len(u.Addr) > 0 {
+		member.Addr = u.Addr
+	}
+
+	m.broadcasts.push(update{ID: member.ID, Addr: member.Addr, State: member.State, Incarnation: member.Incarnation})
+
+	if timer, ok := m.suspicions[u.ID]; ok {
+		timer.Stop()
+		delete(m.suspicions, u.ID)
+	}
+
+	if u.State == StateSuspect {
+		m.suspicions[u.ID] = time.AfterFunc(m.SuspicionTimeout, func() {
+			m.confirm(u.ID, u.Incarnation)
+		})
+	}
+
+	if previous != member.State {
+		m.publish(Event{Member: *member, Previous: previous})
+	}
+}
+
+// refute answers a suspicion about this node itself by raising
+// the incarnation above it and announcing the node is alive
+func (m *Membership) refute(u update) {
+	self := m.members[m.ID]
+
+	if u.State == StateAlive || u.Incarnation < self.Incarnation {
+		return
+	}
+
+	self.Incarnation = u.Incarnation + 1
+	m.broadcasts.push(update{ID: self.ID, Addr: self.Addr, State: StateAlive, Incarnation: self.Incarnation})
+}
+
+// confirm declares a member dead if it is still suspected
+// in the incarnation the suspicion was raised for
+func (m *Membership) confirm(id string, incarnation uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	member, ok := m.members[id]
+	if !ok || member.State != StateSuspect || member.Incarnation != incarnation {
+		return
+	}
+
+	m.apply(update{ID: id, State: StateDead, Incarnation: incarnation})
+}
+
+// stateLocked is the whole view as updates, for syncing a new member
+func (m *Membership) stateLocked() []update {
+	state := make([]update, 0, len(m.members))
+	for _, member := range m.members {
+		state = append(state, update{ID: member.ID, Addr: member.Addr, State: member.State, Incarnation: member.Incarnation})
+	}
+
+	return state
+}
+
+// send piggybacks the pending updates on msg and sends it,
+// failures are left for the probes to notice
+func (m *Membership) send(to string, msg message) {
+	m.lock.Lock()
+	msg.Updates = m.broadcasts.take(m.MaxPiggyback, m.retransmits())
+	m.lock.Unlock()
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		log.Printf("[%s] encoding membership message failed: %s\n", m.Addr, err)
+		return
+	}
+
+	m.Send(to, buf.Bytes())
+}
+
+// retransmits is how many times an update is piggybacked,
+// it grows with the logarithm of the cluster size
+func (m *Membership) retransmits() int {
+	n := 1
+	for size := len(m.members); size >= 10; size /= 10 {
+		n++
+	}
+
+	return m.RetransmitMult * n
+}
@@ -0,0 +1,169 @@
+package membership
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cluster wires memberships together in memory, links can be cut
+type cluster struct {
+	lock    sync.Mutex
+	members map[string]*Membership
+	cut     map[[2]string]bool
+}
+
+func newCluster(t *testing.T, n int) (*cluster, []*Membership) {
+	c := &cluster{
+		members: make(map[string]*Membership),
+		cut:     make(map[[2]string]bool),
+	}
+
+	nodes := []*Membership{}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("node-%d", i)
+
+		m := New(Opts{
+			ID:   id,
+			Addr: id,
+			Send: func(to string, payload []byte) error {
+				return c.deliver(id, to, payload)
+			},
+			ProbeInterval:    30 * time.Millisecond,
+			ProbeTimeout:     10 * time.Millisecond,
+			SuspicionTimeout: 100 * time.Millisecond,
+		})
+
+		c.members[id] = m
+		nodes = append(nodes, m)
+	}
+
+	for _, m := range nodes {
+		for _, other := range nodes {
+			if m != other {
+				m.Join(other.ID, other.Addr)
+			}
+		}
+	}
+
+	for _, m := range nodes {
+		m.Start()
+		t.Cleanup(m.Stop)
+	}
+
+	return c, nodes
+}
+
+func (c *cluster) deliver(from, to string, payload []byte) error {
+	c.lock.Lock()
+	m, ok := c.members[to]
+	cut := c.cut[[2]string{from, to}] || c.cut[[2]string{to, from}]
+	c.lock.Unlock()
+
+	if !ok || cut {
+		return fmt.Errorf("no link from %s to %s", from, to)
+	}
+
+	go m.HandleMessage(from, payload)
+
+	return nil
+}
+
+func (c *cluster) setCut(a, b string, cut bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cut[[2]string{a, b}] = cut
+}
+
+// isolate cuts or restores all links of the node
+func (c *cluster) isolate(id string, cut bool) {
+	for other := range c.members {
+		if other != id {
+			c.setCut(id, other, cut)
+		}
+	}
+}
+
+func waitForState(t *testing.T, m *Membership, id string, state State) Member {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if member, ok := m.Member(id); ok && member.State == state {
+			return member
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	member, _ := m.Member(id)
+	t.Fatalf("%s sees %s as %s, expected %s", m.ID, id, member.State, state)
+	return Member{}
+}
+
+func TestMembershipFailureDetection(t *testing.T) {
+	c, nodes := newCluster(t, 5)
+
+	events, unsubscribe := nodes[0].Subscribe()
+	defer unsubscribe()
+
+	c.isolate("node-4", true)
+
+	for _, m := range nodes[:4] {
+		waitForState(t, m, "node-4", StateDead)
+	}
+
+	seen := map[State]bool{}
+	for len(events) > 0 {
+		event := <-events
+		if event.Member.ID == "node-4" {
+			seen[event.Member.State] = true
+		}
+	}
+
+	if !seen[StateSuspect] || !seen[StateDead] {
+		t.Errorf("expected suspect and dead events, saw %v", seen)
+	}
+
+	for _, member := range nodes[0].Members() {
+		if member.ID != "node-4" && member.State != StateAlive {
+			t.Errorf("member %s is %s", member.ID, member.State)
+		}
+	}
+}
+
+func TestMembershipIndirectProbe(t *testing.T) {
+	c, nodes := newCluster(t, 5)
+
+	// node-0 can't reach node-1 directly, the others vouch for it
+	c.setCut("node-0", "node-1", true)
+
+	time.Sleep(20 * nodes[0].ProbeInterval)
+
+	for _, m := range nodes {
+		for _, member := range m.Members() {
+			if member.State != StateAlive {
+				t.Errorf("%s sees %s as %s", m.ID, member.ID, member.State)
+			}
+		}
+	}
+}
+
+func TestMembershipRefute(t *testing.T) {
+	c, nodes := newCluster(t, 3)
+
+	c.isolate("node-2", true)
+	dead := waitForState(t, nodes[0], "node-2", StateDead)
+
+	// the node comes back, learns it was declared dead and refutes it
+	c.isolate("node-2", false)
+	nodes[2].Join("node-0", "node-0")
+
+	alive := waitForState(t, nodes[0], "node-2", StateAlive)
+	if alive.Incarnation <= dead.Incarnation {
+		t.Errorf("expected incarnation above %d, got %d", dead.Incarnation, alive.Incarnation)
+	}
+
+	waitForState(t, nodes[1], "node-2", StateAlive)
+}
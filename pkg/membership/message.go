@@ -0,0 +1,87 @@
+package membership
+
+import "slices"
+
+type messageType int
+
+const (
+	messagePing messageType = iota + 1
+	messagePingReq
+	messageAck
+	// messageSync carries the whole view, it is sent to new members
+	// which answer with their own view in a messageSyncReply
+	messageSync
+	messageSyncReply
+)
+
+type message struct {
+	Type  messageType
+	SeqNo uint64
+	// Target is the member to probe on behalf of the sender of a ping request
+	Target  string
+	Updates []update
+	Members []update
+}
+
+// update is a piece of gossip about a single member
+type update struct {
+	ID          string
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// overrides tells whether the update is newer than what is known about
+// the member. A newer incarnation always wins, within one incarnation
+// a suspicion overrides alive and dead overrides both
+func (u update) overrides(member *Member) bool {
+	if u.Incarnation != member.Incarnation {
+		return u.Incarnation > member.Incarnation
+	}
+
+	return u.State > member.State
+}
+
+type broadcast struct {
+	update    update
+	transmits int
+}
+
+// broadcastQueue holds the updates still to be piggybacked,
+// only the newest update of every member is kept
+type broadcastQueue struct {
+	broadcasts map[string]*broadcast
+}
+
+func newBroadcastQueue() *broadcastQueue {
+	return &broadcastQueue{broadcasts: make(map[string]*broadcast)}
+}
+
+func (q *broadcastQueue) push(u update) {
+	q.broadcasts[u.ID] = &broadcast{update: u}
+}
+
+// take returns up to limit updates, the least sent ones first, and
+// forgets the updates that were sent maxTransmits times
+func (q *broadcastQueue) take(limit, maxTransmits int) []update {
+	pending := make([]*broadcast, 0, len(q.broadcasts))
+	for _, b := range q.broadcasts {
+		pending = append(pending, b)
+	}
+
+	slices.SortFunc(pending, func(a, b *broadcast) int {
+		return a.transmits - b.transmits
+	})
+
+	updates := []update{}
+	for _, b := range pending[:min(limit, len(pending))] {
+		updates = append(updates, b.update)
+
+		b.transmits++
+		if b.transmits >= maxTransmits {
+			delete(q.broadcasts, b.update.ID)
+		}
+	}
+
+	return updates
+}
@@ -0,0 +1,164 @@
+package membership
+
+import (
+	"log"
+	"time"
+)
+
+func (m *Membership) probeLoop() {
+	ticker := time.NewTicker(m.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.probe()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// probe pings the next member, asks others to ping it if it
+// doesn't answer in time and suspects it if nobody got an answer
+// by the end of the protocol period
+func (m *Membership) probe() {
+	target, ok := m.nextTarget()
+	if !ok {
+		return
+	}
+
+	seq, acked := m.newAck()
+	defer m.dropAck(seq)
+
+	m.send(target.ID, message{Type: messagePing, SeqNo: seq})
+
+	if m.wait(acked, m.ProbeTimeout) {
+		return
+	}
+
+	for _, helper := range m.randomMembers(m.IndirectProbes, target.ID) {
+		m.send(helper, message{Type: messagePingReq, SeqNo: seq, Target: target.ID})
+	}
+
+	if m.wait(acked, m.ProbeInterval-m.ProbeTimeout) {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	member, ok := m.members[target.ID]
+	if !ok || member.State != StateAlive || member.Incarnation != target.Incarnation {
+		return
+	}
+
+	log.Printf("[%s] suspecting member (%s), it didn't answer the probe\n", m.Addr, target.ID)
+	m.apply(update{ID: target.ID, State: StateSuspect, Incarnation: target.Incarnation})
+}
+
+// probeFor pings the target on behalf of a member that couldn't reach it
+func (m *Membership) probeFor(from string, seqNo uint64, target string) {
+	seq, acked := m.newAck()
+	defer m.dropAck(seq)
+
+	m.send(target, message{Type: messagePing, SeqNo: seq})
+
+	if m.wait(acked, m.ProbeTimeout) {
+		m.send(from, message{Type: messageAck, SeqNo: seqNo})
+	}
+}
+
+// nextTarget walks the members in a random order, every member
+// is probed once per round. Dead members are not probed anymore
+func (m *Membership) nextTarget() (Member, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for {
+		if len(m.probeOrder) == 0 {
+			for id, member := range m.members {
+				if id != m.ID && member.State != StateDead {
+					m.probeOrder = append(m.probeOrder, id)
+				}
+			}
+
+			if len(m.probeOrder) == 0 {
+				return Member{}, false
+			}
+
+			m.rand.Shuffle(len(m.probeOrder), func(i, j int) {
+				m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+			})
+		}
+
+		id := m.probeOrder[0]
+		m.probeOrder = m.probeOrder[1:]
+
+		if member, ok := m.members[id]; ok && member.State != StateDead {
+			return *member, true
+		}
+	}
+}
+
+// randomMembers picks up to n live members other than this node and exclude
+func (m *Membership) randomMembers(n int, exclude string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	candidates := []string{}
+	for id, member := range m.members {
+		if id != m.ID && id != exclude && member.State == StateAlive {
+			candidates = append(candidates, id)
+		}
+	}
+
+	m.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	return candidates[:min(n, len(candidates))]
+}
+
+func (m *Membership) newAck() (uint64, chan struct{}) {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+
+	m.seq++
+	acked := make(chan struct{})
+	m.acks[m.seq] = acked
+
+	return m.seq, acked
+}
+
+func (m *Membership) dropAck(seq uint64) {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+
+	delete(m.acks, seq)
+}
+
+func (m *Membership) ack(seq uint64) {
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+
+	// direct and indirect acks may both arrive, only the first counts
+	if acked, ok := m.acks[seq]; ok {
+		close(acked)
+		delete(m.acks, seq)
+	}
+}
+
+func (m *Membership) wait(acked chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-acked:
+		return true
+	case <-timer.C:
+		return false
+	case <-m.quit:
+		return false
+	}
+}
@@ -0,0 +1,189 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// DefaultDepth is the depth of the trees nodes compare
+	DefaultDepth = 8
+	// MaxDepth bounds the trees rebuilt from the leaves of other nodes,
+	// a tree has 2^depth leaves
+	MaxDepth = 16
+)
+
+var (
+	ErrDepthMismatch = errors.New("trees of different depth")
+	ErrInvalidDepth  = errors.New("invalid tree depth")
+)
+
+// Hash is the digest of a node of the tree
+type Hash [sha256.Size]byte
+
+type entry struct {
+	key   string
+	value []byte
+}
+
+// Tree is a Merkle tree over a set of keys and their values. The key
+// space is split into 2^depth ranges by the hash of the keys, every
+// range is a leaf and every inner node hashes its two children. Two
+// trees holding the same entries have the same root, and comparing
+// them top down finds the ranges that differ without listing the keys
+type Tree struct {
+	depth   int
+	buckets [][]entry
+
+	// levels are the node hashes from the root down to the leaves,
+	// computed when first needed after an insert
+	levels [][]Hash
+}
+
+// New creates an empty tree with 2^depth leaves, zero means the default
+func New(depth int) *Tree {
+	if depth <= 0 {
+		depth = DefaultDepth
+	}
+
+	return newTree(depth)
+}
+
+func newTree(depth int) *Tree {
+	return &Tree{
+		depth:   depth,
+		buckets: make([][]entry, 1<<depth),
+	}
+}
+
+// FromLeaves rebuilds a tree from the leaves of another one, it can be
+// compared but holds no entries. The depth comes from another node, it
+// has to be between 1 and MaxDepth
+func FromLeaves(depth int, leaves []Hash) (*Tree, error) {
+	if depth < 1 || depth > MaxDepth {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidDepth, depth)
+	}
+
+	if len(leaves) != 1<<depth {
+		return nil, fmt.Errorf("%d leaves for a tree of depth %d", len(leaves), depth)
+	}
+
+	t := newTree(depth)
+	t.build(slices.Clone(leaves))
+
+	return t, nil
+}
+
+func (t *Tree) Depth() int {
+	return t.depth
+}
+
+// Bucket is the leaf the key belongs to
+func (t *Tree) Bucket(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint32(sum[:4]) >> (32 - t.depth))
+}
+
+// Insert adds the key with its value, the value is what tells two
+// versions of the key apart, like its version number and checksum
+func (t *Tree) Insert(key string, value []byte) {
+	i := t.Bucket(key)
+	t.buckets[i] = append(t.buckets[i], entry{key: key, value: value})
+	t.levels = nil
+}
+
+func (t *Tree) Root() Hash {
+	return t.tree()[0][0]
+}
+
+func (t *Tree) Leaves() []Hash {
+	return slices.Clone(t.tree()[t.depth])
+}
+
+// Diff returns the leaves that differ between the trees, in order.
+// Subtrees with the same hash are skipped as a whole
+func (t *Tree) Diff(other *Tree) ([]int, error) {
+	if t.depth != other.depth {
+		return nil, fmt.Errorf("%w: %d and %d", ErrDepthMismatch, t.depth, other.depth)
+	}
+
+	a, b := t.tree(), other.tree()
+
+	diff := []int{}
+	var walk func(level, i int)
+	walk = func(level, i int) {
+		if a[level][i] == b[level][i] {
+			return
+		}
+
+		if level == t.depth {
+			diff = append(diff, i)
+			return
+		}
+
+		walk(level+1, 2*i)
+		walk(level+1, 2*i+1)
+	}
+	walk(0, 0)
+
+	return diff, nil
+}
+
+func (t *Tree) tree() [][]Hash {
+	if t.levels != nil {
+		return t.levels
+	}
+
+	leaves := make([]Hash, len(t.buckets))
+	for i, bucket := range t.buckets {
+		leaves[i] = hashBucket(bucket)
+	}
+	t.build(leaves)
+
+	return t.levels
+}
+
+func (t *Tree) build(leaves []Hash) {
+	t.levels = make([][]Hash, t.depth+1)
+	t.levels[t.depth] = leaves
+
+	for level := t.depth - 1; level >= 0; level-- {
+		below := t.levels[level+1]
+		nodes := make([]Hash, len(below)/2)
+		for i := range nodes {
+			nodes[i] = sha256.Sum256(append(below[2*i][:], below[2*i+1][:]...))
+		}
+		t.levels[level] = nodes
+	}
+}
+
+// hashBucket hashes the entries of a leaf in key order,
+// so the order they were inserted in doesn't matter
+func hashBucket(bucket []entry) Hash {
+	if len(bucket) == 0 {
+		return Hash{}
+	}
+
+	sorted := slices.Clone(bucket)
+	slices.SortFunc(sorted, func(a, b entry) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	h := sha256.New()
+	for _, e := range sorted {
+		// lengths first, so entries can't run into each other
+		binary.Write(h, binary.BigEndian, uint32(len(e.key)))
+		h.Write([]byte(e.key))
+		binary.Write(h, binary.BigEndian, uint32(len(e.value)))
+		h.Write(e.value)
+	}
+
+	var sum Hash
+	copy(sum[:], h.Sum(nil))
+
+	return sum
+}
@@ -0,0 +1,91 @@
+package merkle
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func newTestTree(n int) *Tree {
+	t := New(0)
+	for i := 0; i < n; i++ {
+		t.Insert(fmt.Sprintf("key-%d", i), []byte("v1"))
+	}
+
+	return t
+}
+
+func TestTreeSameEntries(t *testing.T) {
+	a := newTestTree(1000)
+
+	// the insertion order doesn't matter
+	b := New(0)
+	for i := 999; i >= 0; i-- {
+		b.Insert(fmt.Sprintf("key-%d", i), []byte("v1"))
+	}
+
+	if a.Root() != b.Root() {
+		t.Fatalf("trees with the same entries have different roots")
+	}
+
+	diff, err := a.Diff(b)
+	if err != nil || len(diff) != 0 {
+		t.Errorf("expected no difference, got %v, %v", diff, err)
+	}
+}
+
+func TestTreeDiff(t *testing.T) {
+	a := newTestTree(1000)
+
+	// a newer version of one key and a key only one side has
+	b := New(0)
+	for i := 0; i < 1000; i++ {
+		value := []byte("v1")
+		if i == 1 {
+			value = []byte("v2")
+		}
+		b.Insert(fmt.Sprintf("key-%d", i), value)
+	}
+	b.Insert("extra", []byte("v1"))
+
+	diff, err := a.Diff(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{a.Bucket("key-1"), a.Bucket("extra")}
+	slices.Sort(want)
+	want = slices.Compact(want)
+
+	if !slices.Equal(diff, want) {
+		t.Errorf("expected buckets %v to differ, got %v", want, diff)
+	}
+}
+
+func TestTreeFromLeaves(t *testing.T) {
+	a := newTestTree(100)
+
+	b, err := FromLeaves(a.Depth(), a.Leaves())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Root() != b.Root() {
+		t.Errorf("rebuilt tree has a different root")
+	}
+
+	if _, err := FromLeaves(a.Depth()+1, a.Leaves()); err == nil {
+		t.Errorf("leaves of the wrong depth were accepted")
+	}
+
+	for _, depth := range []int{0, -1, MaxDepth + 1} {
+		if _, err := FromLeaves(depth, []Hash{{}}); !errors.Is(err, ErrInvalidDepth) {
+			t.Errorf("depth %d: expected ErrInvalidDepth, got %v", depth, err)
+		}
+	}
+
+	if _, err := New(4).Diff(a); err == nil {
+		t.Errorf("trees of different depth were compared")
+	}
+}
@@ -1,41 +1,82 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
-type Decoder interface {
-	Decode(io.Reader, *RPC) error
-}
+const (
+	// frameHeaderSize is the type byte followed by the uint32 payload length
+	frameHeaderSize = 5
 
-type GOBDecoder struct{}
+	// MaxFrameSize is the biggest payload a single frame is allowed to carry
+	MaxFrameSize = 16 << 20
+)
+
+var ErrFrameTooLarge = errors.New("frame exceeds max frame size")
 
-func (dec GOBDecoder) Decode(r io.Reader, rpc *RPC) error {
-	return gob.NewDecoder(r).Decode(rpc)
+// WriteFrame writes a frame in wire format: type (1 byte),
+// payload length (uint32, big endian) and the payload itself
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	// header and payload go out in a single write, so concurrent
+	// writers can't interleave parts of different frames
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:frameHeaderSize], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
 }
 
-type DefaultDecoder struct{}
+// ReadFrame reads a whole frame written by WriteFrame, no matter
+// how it was split by the underlying connection
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
 
-func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxFrameSize {
+		return 0, nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
 	}
 
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		msg.Stream = true
-		return nil
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
 	}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
+	return header[0], payload, nil
+}
+
+type Decoder interface {
+	Decode(io.Reader, *Frame) error
+}
+
+type GOBDecoder struct{}
+
+func (dec GOBDecoder) Decode(r io.Reader, frame *Frame) error {
+	return gob.NewDecoder(r).Decode(frame)
+}
+
+type DefaultDecoder struct{}
+
+func (dec DefaultDecoder) Decode(r io.Reader, frame *Frame) error {
+	typ, payload, err := ReadFrame(r)
 	if err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	frame.Type = typ
+	frame.Payload = payload
 
 	return nil
 }
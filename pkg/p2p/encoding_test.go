@@ -0,0 +1,66 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("difis"), 10_000)
+	buf := new(bytes.Buffer)
+
+	if err := WriteFrame(buf, IncomingMessage, payload); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+
+	// frames must survive being delivered one byte at a time
+	typ, got, err := ReadFrame(iotest.OneByteReader(buf))
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %v", err)
+	}
+
+	if typ != IncomingMessage {
+		t.Errorf("want type %d, have %d", IncomingMessage, typ)
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Errorf("payload corrupted, want %d bytes, have %d", len(payload), len(got))
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	if err := WriteFrame(new(bytes.Buffer), IncomingMessage, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("want ErrFrameTooLarge, have %v", err)
+	}
+
+	header := []byte{IncomingMessage, 0xff, 0xff, 0xff, 0xff}
+	if _, _, err := ReadFrame(bytes.NewReader(header)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("want ErrFrameTooLarge, have %v", err)
+	}
+}
+
+func TestDefaultDecoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	WriteFrame(buf, IncomingMessage, []byte("hello"))
+	WriteFrame(buf, StreamClose, nil)
+
+	dec := DefaultDecoder{}
+
+	var msg Frame
+	if err := dec.Decode(buf, &msg); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if msg.Type != IncomingMessage || string(msg.Payload) != "hello" {
+		t.Errorf("unexpected frame: %+v", msg)
+	}
+
+	var closeFrame Frame
+	if err := dec.Decode(buf, &closeFrame); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if closeFrame.Type != StreamClose || len(closeFrame.Payload) != 0 {
+		t.Errorf("unexpected frame: %+v", closeFrame)
+	}
+}
@@ -1,6 +1,181 @@
 package p2p
 
-// Handshake function is used to perform a handshake between two peers
-type HandshakeFunc func(Peer) error
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"time"
 
-func NOPHandshakeFunc(Peer) error { return nil }
+	"github.com/Yaroslaw07/difis/pkg/crypto"
+)
+
+const (
+	// HandshakeFrame carries the handshake messages, it is
+	// only valid before the session starts
+	HandshakeFrame = 0x10
+
+	handshakeTimeout = 10 * time.Second
+	nonceSize        = 32
+)
+
+var ErrHandshake = errors.New("handshake failed")
+
+// PeerInfo is what the handshake learned about the remote
+type PeerInfo struct {
+	// ID is the verified node ID, empty if the remote was not authenticated
+	ID string
+	// Version is the protocol version both sides agreed on
+	Version uint16
+	// MessageTypes are the messages the remote is able to handle
+	MessageTypes []int
+	// Features are the optional features both sides have
+	Features []string
+	// ListenAddr is the address the remote accepts connections on,
+	// as the remote announced it
+	ListenAddr string
+}
+
+// Handshake function is used to perform a handshake between two peers,
+// it runs over the raw connection before any other frame is exchanged
+type HandshakeFunc func(conn net.Conn, outbound bool) (PeerInfo, error)
+
+func NOPHandshakeFunc(net.Conn, bool) (PeerInfo, error) { return PeerInfo{}, nil }
+
+// PeerID is how the node knows the peer: its verified node ID,
+// or its remote address when the handshake didn't authenticate it
+func PeerID(p Peer) string {
+	if id := p.Info().ID; len(id) > 0 {
+		return id
+	}
+
+	return p.RemoteAddr().String()
+}
+
+type handshakeHello struct {
+	ID         string
+	Nonce      []byte
+	Protocol   Protocol
+	ListenAddr string
+}
+
+type handshakeProof struct {
+	Signature []byte
+}
+
+type HandshakeOpts struct {
+	Identity *crypto.Identity
+	Protocol Protocol
+	// ListenAddr is announced to the remote, so it can share
+	// with other nodes where this node can be dialed
+	ListenAddr string
+}
+
+// NewAuthHandshakeFunc returns a handshake in which both nodes
+// prove they hold the private key of the node ID they claim,
+// by signing a fresh challenge of the other side. The nodes also
+// agree on the protocol version and features, refusing the
+// connection if they have no version in common
+func NewAuthHandshakeFunc(opts HandshakeOpts) HandshakeFunc {
+	identity := opts.Identity
+
+	return func(conn net.Conn, outbound bool) (PeerInfo, error) {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+
+		nonce := make([]byte, nonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return PeerInfo{}, err
+		}
+
+		local := handshakeHello{
+			ID:         identity.ID(),
+			Nonce:      nonce,
+			Protocol:   opts.Protocol,
+			ListenAddr: opts.ListenAddr,
+		}
+		if err := writeHandshake(conn, local); err != nil {
+			return PeerInfo{}, err
+		}
+
+		var remote handshakeHello
+		if err := readHandshake(conn, &remote); err != nil {
+			return PeerInfo{}, err
+		}
+
+		if len(remote.Nonce) != nonceSize {
+			return PeerInfo{}, fmt.Errorf("%w: malformed challenge from (%s)", ErrHandshake, conn.RemoteAddr())
+		}
+
+		if remote.ID == local.ID {
+			return PeerInfo{}, fmt.Errorf("%w: connected to itself", ErrHandshake)
+		}
+
+		version, features, err := negotiate(local.Protocol, remote.Protocol)
+		if err != nil {
+			return PeerInfo{}, fmt.Errorf("%w with (%s): %w", ErrHandshake, conn.RemoteAddr(), err)
+		}
+
+		proof := handshakeProof{Signature: identity.Sign(challenge(remote, local.ID))}
+		if err := writeHandshake(conn, proof); err != nil {
+			return PeerInfo{}, err
+		}
+
+		var remoteProof handshakeProof
+		if err := readHandshake(conn, &remoteProof); err != nil {
+			return PeerInfo{}, err
+		}
+
+		if !crypto.Verify(remote.ID, challenge(local, remote.ID), remoteProof.Signature) {
+			return PeerInfo{}, fmt.Errorf("%w: (%s) could not prove it is node (%s)", ErrHandshake, conn.RemoteAddr(), remote.ID)
+		}
+
+		return PeerInfo{
+			ID:           remote.ID,
+			Version:      version,
+			MessageTypes: remote.Protocol.MessageTypes,
+			Features:     features,
+			ListenAddr:   remote.ListenAddr,
+		}, nil
+	}
+}
+
+// challenge is what the signer signs to answer the hello: the nonce
+// of the hello bound to the IDs of both nodes, so the signature
+// can't be replayed in another handshake. The protocol and address
+// of the hello are covered too, so nobody in between can change them
+func challenge(hello handshakeHello, signerID string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("difis handshake\n")
+	buf.Write(hello.Nonce)
+	buf.WriteString(hello.ID)
+	buf.WriteString(signerID)
+	buf.Write(hello.Protocol.appendTo(nil))
+	buf.WriteString(hello.ListenAddr)
+
+	return buf.Bytes()
+}
+
+func writeHandshake(conn net.Conn, msg any) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return WriteFrame(conn, HandshakeFrame, buf.Bytes())
+}
+
+func readHandshake(conn net.Conn, msg any) error {
+	typ, payload, err := ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+
+	if typ != HandshakeFrame {
+		return fmt.Errorf("%w: unexpected frame (%d) from (%s)", ErrHandshake, typ, conn.RemoteAddr())
+	}
+
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(msg)
+}
@@ -0,0 +1,146 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Yaroslaw07/difis/pkg/crypto"
+)
+
+type handshakeResult struct {
+	info PeerInfo
+	err  error
+}
+
+// runHandshake connects two nodes over loopback TCP and runs
+// the handshakes of both sides
+func runHandshake(t *testing.T, dialer, listener HandshakeFunc) (handshakeResult, handshakeResult) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- handshakeResult{err: err}
+			return
+		}
+		defer conn.Close()
+
+		info, err := listener(conn, false)
+		accepted <- handshakeResult{info, err}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	info, err := dialer(conn, true)
+
+	return handshakeResult{info, err}, <-accepted
+}
+
+func TestAuthHandshake(t *testing.T) {
+	a, _ := crypto.NewIdentity()
+	b, _ := crypto.NewIdentity()
+
+	dialed, accepted := runHandshake(t,
+		NewAuthHandshakeFunc(HandshakeOpts{Identity: a, ListenAddr: ":3000"}),
+		NewAuthHandshakeFunc(HandshakeOpts{Identity: b, ListenAddr: ":7000"}))
+	if dialed.err != nil || accepted.err != nil {
+		t.Fatalf("handshake failed: %v, %v", dialed.err, accepted.err)
+	}
+
+	if dialed.info.ID != b.ID() || accepted.info.ID != a.ID() {
+		t.Errorf("wrong peer IDs, have %s and %s", dialed.info.ID, accepted.info.ID)
+	}
+
+	if dialed.info.ListenAddr != ":7000" || accepted.info.ListenAddr != ":3000" {
+		t.Errorf("wrong listen addresses, have %s and %s", dialed.info.ListenAddr, accepted.info.ListenAddr)
+	}
+}
+
+func TestAuthHandshakeImpersonation(t *testing.T) {
+	victim, _ := crypto.NewIdentity()
+	attacker, _ := crypto.NewIdentity()
+	b, _ := crypto.NewIdentity()
+
+	// the attacker claims the victim's ID but can only sign with its own key
+	impersonate := func(conn net.Conn, outbound bool) (PeerInfo, error) {
+		hello := handshakeHello{ID: victim.ID(), Nonce: make([]byte, nonceSize)}
+		writeHandshake(conn, hello)
+
+		var remote handshakeHello
+		if err := readHandshake(conn, &remote); err != nil {
+			return PeerInfo{}, err
+		}
+
+		writeHandshake(conn, handshakeProof{Signature: attacker.Sign(challenge(remote, victim.ID()))})
+
+		var proof handshakeProof
+		return PeerInfo{}, readHandshake(conn, &proof)
+	}
+
+	_, accepted := runHandshake(t, impersonate, NewAuthHandshakeFunc(HandshakeOpts{Identity: b}))
+	if !errors.Is(accepted.err, ErrHandshake) {
+		t.Errorf("want ErrHandshake, have %v", accepted.err)
+	}
+}
+
+func TestAuthHandshakeSelf(t *testing.T) {
+	a, _ := crypto.NewIdentity()
+
+	_, accepted := runHandshake(t, NewAuthHandshakeFunc(HandshakeOpts{Identity: a}), NewAuthHandshakeFunc(HandshakeOpts{Identity: a}))
+	if !errors.Is(accepted.err, ErrHandshake) {
+		t.Errorf("want ErrHandshake, have %v", accepted.err)
+	}
+}
+
+func TestHandshakeProtocolNegotiation(t *testing.T) {
+	a, _ := crypto.NewIdentity()
+	b, _ := crypto.NewIdentity()
+
+	older := HandshakeOpts{Identity: a, Protocol: Protocol{
+		Version:      2,
+		MinVersion:   1,
+		MessageTypes: []int{1, 2},
+		Features:     []string{"compression"},
+	}}
+	newer := HandshakeOpts{Identity: b, Protocol: Protocol{
+		Version:      3,
+		MinVersion:   2,
+		MessageTypes: []int{1, 2, 3},
+		Features:     []string{"compression", "encryption/aes-ctr"},
+	}}
+
+	dialed, accepted := runHandshake(t, NewAuthHandshakeFunc(older), NewAuthHandshakeFunc(newer))
+	if dialed.err != nil || accepted.err != nil {
+		t.Fatalf("handshake failed: %v, %v", dialed.err, accepted.err)
+	}
+
+	if dialed.info.Version != 2 || accepted.info.Version != 2 {
+		t.Errorf("want version 2 on both sides, have %d and %d", dialed.info.Version, accepted.info.Version)
+	}
+
+	if !dialed.info.HasFeature("compression") || dialed.info.HasFeature("encryption/aes-ctr") {
+		t.Errorf("wrong features: %v", dialed.info.Features)
+	}
+
+	if accepted.info.Supports(3) || !dialed.info.Supports(3) {
+		t.Errorf("message types not exchanged: %v, %v", dialed.info.MessageTypes, accepted.info.MessageTypes)
+	}
+
+	// a node that moved past version 2 can't talk to the old one anymore
+	newest := HandshakeOpts{Identity: b, Protocol: Protocol{Version: 4, MinVersion: 3}}
+
+	dialed, accepted = runHandshake(t, NewAuthHandshakeFunc(older), NewAuthHandshakeFunc(newest))
+	if !errors.Is(dialed.err, ErrIncompatible) || !errors.Is(accepted.err, ErrIncompatible) {
+		t.Errorf("want ErrIncompatible on both sides, have %v and %v", dialed.err, accepted.err)
+	}
+}
@@ -1,14 +1,29 @@
 package p2p
 
 const (
-	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+	IncomingMessage    = 0x1
+	IncomingStream     = 0x2
+	StreamData         = 0x3
+	StreamClose        = 0x4
+	StreamReset        = 0x5
+	StreamWindowUpdate = 0x6
+	PingFrame          = 0x7
+	PongFrame          = 0x8
 )
 
+// Frame is a single unit on the wire, see WriteFrame
+type Frame struct {
+	Type    byte
+	Payload []byte
+}
+
 // RPC holds data that send
 // between two nodes in the network
 type RPC struct {
 	From    string
 	Payload []byte
-	Stream  bool
+
+	// Stream is set when the remote opened a new logical stream,
+	// Payload is then the message the stream was opened with
+	Stream Stream
 }
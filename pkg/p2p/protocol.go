@@ -0,0 +1,81 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrIncompatible = errors.New("incompatible protocol")
+
+// Protocol describes what a node speaks, both sides
+// exchange it during the handshake
+type Protocol struct {
+	// Version is the newest protocol version the node speaks and
+	// MinVersion the oldest one it still understands, nodes talk
+	// in the newest version both of them know
+	Version    uint16
+	MinVersion uint16
+	// MessageTypes are the messages the node is able to handle
+	MessageTypes []int
+	// Features are optional capabilities, only the ones
+	// both sides have are used on the connection
+	Features []string
+}
+
+// negotiate agrees on the version and features two nodes use,
+// it fails if their version ranges don't overlap
+func negotiate(local, remote Protocol) (uint16, []string, error) {
+	version := min(local.Version, remote.Version)
+
+	if version < max(local.MinVersion, remote.MinVersion) {
+		return 0, nil, fmt.Errorf("%w: remote speaks versions %d-%d, this node %d-%d",
+			ErrIncompatible, remote.MinVersion, remote.Version, local.MinVersion, local.Version)
+	}
+
+	features := []string{}
+	for _, feature := range local.Features {
+		if slices.Contains(remote.Features, feature) {
+			features = append(features, feature)
+		}
+	}
+	slices.Sort(features)
+
+	return version, features, nil
+}
+
+// appendTo writes the protocol to buf in a stable encoding,
+// so it can be covered by the handshake signatures
+func (p Protocol) appendTo(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, p.Version)
+	buf = binary.BigEndian.AppendUint16(buf, p.MinVersion)
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.MessageTypes)))
+	for _, typ := range p.MessageTypes {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(typ))
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.Features)))
+	for _, feature := range p.Features {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(feature)))
+		buf = append(buf, feature...)
+	}
+
+	return buf
+}
+
+// Supports tells whether the peer handles the message type, peers
+// that didn't announce their message types are assumed to handle all
+func (info PeerInfo) Supports(messageType int) bool {
+	if info.MessageTypes == nil {
+		return true
+	}
+
+	return slices.Contains(info.MessageTypes, messageType)
+}
+
+// HasFeature tells whether both sides of the connection have the feature
+func (info PeerInfo) HasFeature(feature string) bool {
+	return slices.Contains(info.Features, feature)
+}
@@ -0,0 +1,345 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrStreamReset   = errors.New("stream reset")
+	ErrPingTimeout   = errors.New("ping timed out")
+	ErrProtocol      = errors.New("protocol error")
+)
+
+// Session multiplexes a control channel and any number of logical
+// streams over a single connection. It implements Peer, so transports
+// only have to wrap it with whatever is specific to them
+type Session struct {
+	conn    net.Conn
+	decoder Decoder
+
+	// writeLock keeps frames of concurrent writers from interleaving
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	streams map[uint32]*stream
+	// dialing side uses odd stream IDs, accepting side even ones,
+	// so both ends can open streams without coordination
+	nextID   uint32
+	outbound bool
+
+	pingLock sync.Mutex
+	pings    map[uint64]chan struct{}
+	nextPing uint64
+	// pongs are written by a single writer, the read loop
+	// must not wait on a busy writer to answer a ping
+	pongs chan []byte
+
+	// lastSeen is the unix nano time the last frame arrived
+	lastSeen atomic.Int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// maxPendingPongs is how many pongs wait for the writer, the pings
+// past that are left unanswered and time out on the other end
+const maxPendingPongs = 16
+
+func NewSession(conn net.Conn, outbound bool, decoder Decoder) *Session {
+	nextID := uint32(2)
+	if outbound {
+		nextID = 1
+	}
+
+	if decoder == nil {
+		decoder = DefaultDecoder{}
+	}
+
+	s := &Session{
+		conn:     conn,
+		decoder:  decoder,
+		streams:  make(map[uint32]*stream),
+		nextID:   nextID,
+		outbound: outbound,
+		pings:    make(map[uint64]chan struct{}),
+		pongs:    make(chan []byte, maxPendingPongs),
+		closed:   make(chan struct{}),
+	}
+	s.lastSeen.Store(time.Now().UnixNano())
+
+	return s
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close tears down the connection and aborts every open stream
+func (s *Session) Close() error {
+	err := ErrSessionClosed
+
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+
+		s.lock.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*stream)
+		s.lock.Unlock()
+
+		for _, st := range streams {
+			st.abort(ErrSessionClosed)
+		}
+	})
+
+	return err
+}
+
+// Send writes a control message to the peer
+func (s *Session) Send(payload []byte) error {
+	return s.writeFrame(IncomingMessage, payload)
+}
+
+func (s *Session) OpenStream(payload []byte) (Stream, error) {
+	s.lock.Lock()
+	select {
+	case <-s.closed:
+		s.lock.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+
+	id := s.nextID
+	s.nextID += 2
+
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	if err := s.writeFrame(IncomingStream, streamFramePayload(id, payload)); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Ping sends a ping frame and waits for the pong to come back
+func (s *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	pong := make(chan struct{})
+
+	s.pingLock.Lock()
+	s.nextPing++
+	id := s.nextPing
+	s.pings[id] = pong
+	s.pingLock.Unlock()
+
+	defer func() {
+		s.pingLock.Lock()
+		delete(s.pings, id)
+		s.pingLock.Unlock()
+	}()
+
+	payload := binary.BigEndian.AppendUint64(nil, id)
+
+	start := time.Now()
+	if err := s.writeFrame(PingFrame, payload); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, fmt.Errorf("%w after %s", ErrPingTimeout, timeout)
+	case <-s.closed:
+		return 0, ErrSessionClosed
+	}
+}
+
+func (s *Session) LastSeen() time.Time {
+	return time.Unix(0, s.lastSeen.Load())
+}
+
+// Serve is the read loop of the session, it hands control messages and
+// newly opened streams to rpcch and feeds stream data to the streams.
+// It blocks until the connection fails and closes the session on exit
+func (s *Session) Serve(from string, rpcch chan<- RPC) error {
+	defer s.Close()
+
+	go s.writePongs()
+
+	for {
+		frame := Frame{}
+		if err := s.decoder.Decode(s.conn, &frame); err != nil {
+			return err
+		}
+		s.lastSeen.Store(time.Now().UnixNano())
+
+		if err := s.handleFrame(from, frame, rpcch); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Session) handleFrame(from string, frame Frame, rpcch chan<- RPC) error {
+	if frame.Type == IncomingMessage {
+		return s.deliver(rpcch, RPC{From: from, Payload: frame.Payload})
+	}
+
+	if frame.Type == PingFrame || frame.Type == PongFrame {
+		return s.handlePing(frame)
+	}
+
+	if len(frame.Payload) < 4 {
+		return fmt.Errorf("stream frame (%d) without stream id", frame.Type)
+	}
+
+	id := binary.BigEndian.Uint32(frame.Payload)
+	body := frame.Payload[4:]
+
+	if frame.Type == IncomingStream {
+		// the remote end opens the streams of the other parity
+		if (id%2 == 1) == s.outbound {
+			return fmt.Errorf("%w: stream (%d) opened with an id of the other side", ErrProtocol, id)
+		}
+
+		st := newStream(s, id)
+
+		s.lock.Lock()
+		if _, ok := s.streams[id]; ok {
+			s.lock.Unlock()
+			return fmt.Errorf("stream (%d) opened twice", id)
+		}
+		s.streams[id] = st
+		s.lock.Unlock()
+
+		return s.deliver(rpcch, RPC{From: from, Payload: body, Stream: st})
+	}
+
+	st := s.stream(id)
+	if st == nil {
+		// late frames of a stream that is already gone
+		return nil
+	}
+
+	switch frame.Type {
+	case StreamData:
+		if err := st.push(body); err != nil {
+			st.Reset()
+		}
+	case StreamClose:
+		st.remoteClose()
+	case StreamReset:
+		st.abort(ErrStreamReset)
+		s.removeStream(id)
+	case StreamWindowUpdate:
+		if len(body) < 4 {
+			return fmt.Errorf("malformed window update for stream (%d)", id)
+		}
+		st.grow(binary.BigEndian.Uint32(body))
+	default:
+		return fmt.Errorf("unknown frame type: %d", frame.Type)
+	}
+
+	return nil
+}
+
+func (s *Session) handlePing(frame Frame) error {
+	if len(frame.Payload) != 8 {
+		return fmt.Errorf("malformed ping frame (%d)", frame.Type)
+	}
+
+	if frame.Type == PingFrame {
+		select {
+		case s.pongs <- frame.Payload:
+		default:
+		}
+		return nil
+	}
+
+	id := binary.BigEndian.Uint64(frame.Payload)
+
+	s.pingLock.Lock()
+	pong, ok := s.pings[id]
+	delete(s.pings, id)
+	s.pingLock.Unlock()
+
+	// a pong arriving after the ping gave up is ignored
+	if ok {
+		close(pong)
+	}
+
+	return nil
+}
+
+// writePongs answers the pings until the session is closed
+func (s *Session) writePongs() {
+	for {
+		select {
+		case payload := <-s.pongs:
+			s.writeFrame(PongFrame, payload)
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Session) deliver(rpcch chan<- RPC, rpc RPC) error {
+	select {
+	case rpcch <- rpc:
+		return nil
+	case <-s.closed:
+		return ErrSessionClosed
+	}
+}
+
+func (s *Session) writeFrame(typ byte, payload []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+
+	return WriteFrame(s.conn, typ, payload)
+}
+
+func (s *Session) stream(id uint32) *stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.streams, id)
+}
+
+func streamFramePayload(id uint32, body []byte) []byte {
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, id)
+	copy(buf[4:], body)
+
+	return buf
+}
@@ -0,0 +1,183 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T) (*Session, *Session, chan RPC, chan RPC) {
+	c1, c2 := net.Pipe()
+
+	dialer := NewSession(c1, true, DefaultDecoder{})
+	listener := NewSession(c2, false, DefaultDecoder{})
+
+	dialerch, listenerch := make(chan RPC), make(chan RPC)
+	go dialer.Serve("listener", dialerch)
+	go listener.Serve("dialer", listenerch)
+
+	t.Cleanup(func() {
+		dialer.Close()
+		listener.Close()
+	})
+
+	return dialer, listener, dialerch, listenerch
+}
+
+func TestSessionConcurrentStreams(t *testing.T) {
+	dialer, _, _, listenerch := newSessionPair(t)
+
+	// several times the stream window, so flow control kicks in
+	data := bytes.Repeat([]byte("0123456789abcdef"), StreamWindow/4)
+
+	// the listener echoes every stream back to the dialer
+	go func() {
+		for rpc := range listenerch {
+			go func(rpc RPC) {
+				io.Copy(rpc.Stream, rpc.Stream)
+				rpc.Stream.Close()
+			}(rpc)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			stream, err := dialer.OpenStream([]byte(fmt.Sprintf("stream-%d", i)))
+			if err != nil {
+				t.Errorf("OpenStream failed: %v", err)
+				return
+			}
+
+			go func() {
+				stream.Write(data)
+				stream.Close()
+			}()
+
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				t.Errorf("ReadAll failed: %v", err)
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Errorf("stream %d corrupted, want %d bytes, have %d", i, len(data), len(got))
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestSessionMessagesWhileStreamBlocked(t *testing.T) {
+	dialer, _, _, listenerch := newSessionPair(t)
+
+	stream, err := dialer.OpenStream([]byte("open"))
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	rpc := <-listenerch
+	if string(rpc.Payload) != "open" || rpc.Stream == nil {
+		t.Fatalf("unexpected rpc: %+v", rpc)
+	}
+
+	// nobody reads the stream, the writer stalls once the window is used up
+	go stream.Write(make([]byte, 2*StreamWindow))
+
+	if err := dialer.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	select {
+	case msg := <-listenerch:
+		if string(msg.Payload) != "ping" || msg.Stream != nil {
+			t.Errorf("unexpected rpc: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("control message stuck behind a blocked stream")
+	}
+}
+
+func TestSessionStreamReset(t *testing.T) {
+	dialer, _, _, listenerch := newSessionPair(t)
+
+	stream, err := dialer.OpenStream(nil)
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	rpc := <-listenerch
+	rpc.Stream.Reset()
+
+	if _, err := io.ReadAll(stream); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("want ErrStreamReset, have %v", err)
+	}
+
+	if _, err := stream.Write([]byte("late")); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("want ErrStreamReset, have %v", err)
+	}
+}
+
+func TestSessionStreamIDParity(t *testing.T) {
+	for _, outbound := range []bool{true, false} {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+
+		s := NewSession(c1, outbound, DefaultDecoder{})
+
+		served := make(chan error, 1)
+		go func() { served <- s.Serve("remote", make(chan RPC)) }()
+
+		// the id this end opens its own streams with
+		id := uint32(2)
+		if outbound {
+			id = 1
+		}
+
+		if err := WriteFrame(c2, IncomingStream, streamFramePayload(id, nil)); err != nil {
+			t.Fatalf("WriteFrame failed: %v", err)
+		}
+
+		select {
+		case err := <-served:
+			if !errors.Is(err, ErrProtocol) {
+				t.Errorf("want ErrProtocol, have %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream (%d) accepted by the session that opens it, outbound %t", id, outbound)
+		}
+	}
+}
+
+func TestSessionPing(t *testing.T) {
+	dialer, listener, _, _ := newSessionPair(t)
+
+	before := listener.LastSeen()
+
+	rtt, err := dialer.Ping(time.Second)
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	if rtt <= 0 {
+		t.Errorf("expected a positive round trip time, got %s", rtt)
+	}
+
+	if !listener.LastSeen().After(before) {
+		t.Errorf("ping didn't update the last seen time of the listener")
+	}
+
+	listener.Close()
+
+	if _, err := dialer.Ping(time.Second); err == nil {
+		t.Errorf("expected ping over a closed connection to fail")
+	}
+}
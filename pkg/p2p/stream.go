@@ -0,0 +1,210 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// StreamWindow is how many unread bytes a stream buffers
+	// before the sender has to wait for a window update
+	StreamWindow = 256 * 1024
+
+	// maxDataFrameSize keeps a single stream from hogging the connection
+	maxDataFrameSize = 32 * 1024
+)
+
+type stream struct {
+	id      uint32
+	session *Session
+
+	lock sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+
+	// recvWindow is how many bytes the remote may still send,
+	// consumed is what was read since the last window update
+	recvWindow uint32
+	consumed   uint32
+	sendWindow uint32
+
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newStream(s *Session, id uint32) *stream {
+	st := &stream{
+		id:         id,
+		session:    s,
+		recvWindow: StreamWindow,
+		sendWindow: StreamWindow,
+	}
+	st.cond = sync.NewCond(&st.lock)
+
+	return st
+}
+
+func (st *stream) ID() uint32 {
+	return st.id
+}
+
+func (st *stream) Read(b []byte) (int, error) {
+	st.lock.Lock()
+
+	for st.buf.Len() == 0 && !st.remoteClosed && st.err == nil {
+		st.cond.Wait()
+	}
+
+	if st.buf.Len() == 0 {
+		defer st.lock.Unlock()
+
+		if st.err != nil {
+			return 0, st.err
+		}
+		return 0, io.EOF
+	}
+
+	n, _ := st.buf.Read(b)
+
+	// give the window back once half of it was consumed,
+	// so the sender doesn't stall on every single frame
+	var update uint32
+	st.consumed += uint32(n)
+	if st.consumed >= StreamWindow/2 {
+		update = st.consumed
+		st.recvWindow += update
+		st.consumed = 0
+	}
+	st.lock.Unlock()
+
+	if update > 0 {
+		inc := make([]byte, 4)
+		binary.BigEndian.PutUint32(inc, update)
+		st.session.writeFrame(StreamWindowUpdate, streamFramePayload(st.id, inc))
+	}
+
+	return n, nil
+}
+
+func (st *stream) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		st.lock.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.localClosed {
+			st.cond.Wait()
+		}
+
+		if st.err != nil {
+			st.lock.Unlock()
+			return written, st.err
+		}
+
+		if st.localClosed {
+			st.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := min(len(b), int(st.sendWindow), maxDataFrameSize)
+		st.sendWindow -= uint32(n)
+		st.lock.Unlock()
+
+		if err := st.session.writeFrame(StreamData, streamFramePayload(st.id, b[:n])); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// Close closes the sending side of the stream
+func (st *stream) Close() error {
+	st.lock.Lock()
+	if st.localClosed || st.err != nil {
+		st.lock.Unlock()
+		return nil
+	}
+
+	st.localClosed = true
+	done := st.remoteClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+
+	return st.session.writeFrame(StreamClose, streamFramePayload(st.id, nil))
+}
+
+func (st *stream) Reset() error {
+	st.lock.Lock()
+	if st.err != nil {
+		st.lock.Unlock()
+		return nil
+	}
+
+	st.err = ErrStreamReset
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	st.session.removeStream(st.id)
+
+	return st.session.writeFrame(StreamReset, streamFramePayload(st.id, nil))
+}
+
+func (st *stream) push(data []byte) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.err != nil || st.remoteClosed {
+		return nil
+	}
+
+	if uint32(len(data)) > st.recvWindow {
+		return fmt.Errorf("stream (%d) overflowed its receive window", st.id)
+	}
+
+	st.recvWindow -= uint32(len(data))
+	st.buf.Write(data)
+	st.cond.Broadcast()
+
+	return nil
+}
+
+func (st *stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+func (st *stream) grow(n uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+func (st *stream) abort(err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+}
@@ -1,12 +1,43 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Stream is a logical, flow controlled byte stream multiplexed
+// over the peer connection. Close only closes the sending side,
+// the remote will read io.EOF once it drained the data
+type Stream interface {
+	io.ReadWriteCloser
+	ID() uint32
+	// Reset aborts the stream in both directions
+	Reset() error
+}
 
 // Peer is an interface that represents node
 type Peer interface {
-	net.Conn
+	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
+	// Identity is the authenticated name of the remote,
+	// empty when the transport doesn't verify peers
+	Identity() string
+	// Info is what the handshake learned about the remote
+	Info() PeerInfo
+	// Outbound is true if this node dialed the connection
+	Outbound() bool
+	Close() error
+	// Send delivers a single control message to the peer
 	Send([]byte) error
-	CloseStream()
+	// OpenStream opens a new stream, the payload is delivered
+	// to the remote together with the stream
+	OpenStream([]byte) (Stream, error)
+	// Ping measures the round trip time to the peer, giving
+	// up with ErrPingTimeout after the given timeout
+	Ping(timeout time.Duration) (time.Duration, error)
+	// LastSeen is when anything was last received from the peer
+	LastSeen() time.Time
 }
 
 // Transport is anything that handles the communication between nodes
@@ -17,4 +48,10 @@ type Transport interface {
 	ListenAndAccept() error
 	Consume() <-chan RPC
 	Close() error
+	// SetOnPeer registers the callback run for every new connection,
+	// returning an error from it drops the connection
+	SetOnPeer(func(Peer) error)
+	// SetOnPeerDisconnect registers the callback run once a connection
+	// accepted by the OnPeer callback is gone
+	SetOnPeerDisconnect(func(Peer))
 }
@@ -0,0 +1,188 @@
+package fault
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LinkFaults describes how a directed link between two nodes misbehaves
+type LinkFaults struct {
+	// Latency delays every message and every newly opened stream
+	Latency time.Duration
+	// Jitter adds a random extra delay of up to Jitter
+	Jitter time.Duration
+	// Loss is the probability (0..1) a control message is dropped
+	Loss float64
+	// Bandwidth caps the bytes per second sent over the link, 0 means no cap
+	Bandwidth int
+}
+
+type link struct {
+	from, to string
+}
+
+// Controller holds the faults of a whole test cluster, every
+// FaultTransport created with it obeys it. It is safe to change
+// the faults at runtime, they apply to the next message sent
+type Controller struct {
+	lock       sync.Mutex
+	rand       *rand.Rand
+	defaults   LinkFaults
+	links      map[link]LinkFaults
+	partitions map[string][][]string
+	transports map[string]*FaultTransport
+}
+
+func NewController(seed int64) *Controller {
+	return &Controller{
+		rand:       rand.New(rand.NewSource(seed)),
+		links:      make(map[link]LinkFaults),
+		partitions: make(map[string][][]string),
+		transports: make(map[string]*FaultTransport),
+	}
+}
+
+// SetDefault sets the faults of every link without faults of its own
+func (c *Controller) SetDefault(faults LinkFaults) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.defaults = faults
+}
+
+// SetLink sets the faults of messages sent from one node to another
+func (c *Controller) SetLink(from, to string, faults LinkFaults) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.links[link{from, to}] = faults
+}
+
+func (c *Controller) ClearLink(from, to string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.links, link{from, to})
+}
+
+// Partition splits the nodes into groups that can't reach each other,
+// nodes left out of every group are not affected
+func (c *Controller) Partition(name string, groups ...[]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.partitions[name] = groups
+}
+
+// Heal removes the named partition
+func (c *Controller) Heal(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.partitions, name)
+}
+
+// Reset drops every connection between the two nodes
+func (c *Controller) Reset(a, b string) {
+	c.lock.Lock()
+	ta, tb := c.transports[a], c.transports[b]
+	c.lock.Unlock()
+
+	if ta != nil {
+		ta.resetPeers(b)
+	}
+
+	if tb != nil {
+		tb.resetPeers(a)
+	}
+}
+
+func (c *Controller) register(t *FaultTransport) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.transports[t.Addr()] = t
+}
+
+func (c *Controller) unregister(t *FaultTransport) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.transports[t.Addr()] == t {
+		delete(c.transports, t.Addr())
+	}
+}
+
+func (c *Controller) partitioned(a, b string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, groups := range c.partitions {
+		ga, gb := groupOf(groups, a), groupOf(groups, b)
+		if ga >= 0 && gb >= 0 && ga != gb {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Controller) faults(from, to string) LinkFaults {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if faults, ok := c.links[link{from, to}]; ok {
+		return faults
+	}
+
+	return c.defaults
+}
+
+// drop rolls the dice for a lost message on the link
+func (c *Controller) drop(from, to string) bool {
+	faults := c.faults(from, to)
+	if faults.Loss <= 0 {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.rand.Float64() < faults.Loss
+}
+
+// delay is the latency of the link including jitter
+func (c *Controller) delay(from, to string) time.Duration {
+	faults := c.faults(from, to)
+	if faults.Jitter <= 0 {
+		return faults.Latency
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return faults.Latency + time.Duration(c.rand.Int63n(int64(faults.Jitter)))
+}
+
+// transmission is how long sending n bytes over the link takes
+func (c *Controller) transmission(from, to string, n int) time.Duration {
+	faults := c.faults(from, to)
+	if faults.Bandwidth <= 0 {
+		return 0
+	}
+
+	return time.Duration(n) * time.Second / time.Duration(faults.Bandwidth)
+}
+
+func groupOf(groups [][]string, node string) int {
+	for i, group := range groups {
+		for _, member := range group {
+			if member == node {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
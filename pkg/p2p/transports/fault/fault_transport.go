@@ -0,0 +1,339 @@
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+var ErrPartitioned = errors.New("link is partitioned")
+
+// sendQueueSize is how many delayed messages a link holds before dropping
+const sendQueueSize = 1024
+
+type FaultTransportOpts struct {
+	// Transport is the decorated transport doing the real work
+	Transport  p2p.Transport
+	Controller *Controller
+}
+
+// FaultTransport decorates a p2p.Transport and makes its links misbehave
+// as the Controller says. Faults are applied when the node sends, only
+// partitions are enforced for received messages as well
+type FaultTransport struct {
+	FaultTransportOpts
+	rpcch            chan p2p.RPC
+	onPeer           func(p2p.Peer) error
+	onPeerDisconnect func(p2p.Peer)
+
+	lock  sync.Mutex
+	peers map[p2p.Peer]*faultPeer
+	// remotes maps the peer IDs messages arrive from to the
+	// addresses links are configured with
+	remotes map[string]string
+	closed  chan struct{}
+}
+
+func NewFaultTransport(opts FaultTransportOpts) *FaultTransport {
+	t := &FaultTransport{
+		FaultTransportOpts: opts,
+		rpcch:              make(chan p2p.RPC),
+		peers:              make(map[p2p.Peer]*faultPeer),
+		remotes:            make(map[string]string),
+		closed:             make(chan struct{}),
+	}
+
+	opts.Transport.SetOnPeer(t.handlePeer)
+	opts.Transport.SetOnPeerDisconnect(t.handlePeerDisconnect)
+
+	return t
+}
+
+func (t *FaultTransport) Addr() string {
+	return t.Transport.Addr()
+}
+
+func (t *FaultTransport) SetOnPeer(onPeer func(p2p.Peer) error) {
+	t.onPeer = onPeer
+}
+
+func (t *FaultTransport) SetOnPeerDisconnect(onPeerDisconnect func(p2p.Peer)) {
+	t.onPeerDisconnect = onPeerDisconnect
+}
+
+func (t *FaultTransport) Consume() <-chan p2p.RPC {
+	return t.rpcch
+}
+
+func (t *FaultTransport) Dial(addr string) error {
+	if t.Controller.partitioned(t.Addr(), addr) {
+		return fmt.Errorf("fault dial %s: %w", addr, ErrPartitioned)
+	}
+
+	return t.Transport.Dial(addr)
+}
+
+func (t *FaultTransport) ListenAndAccept() error {
+	if err := t.Transport.ListenAndAccept(); err != nil {
+		return err
+	}
+
+	t.Controller.register(t)
+	go t.forward()
+
+	return nil
+}
+
+func (t *FaultTransport) Close() error {
+	t.Controller.unregister(t)
+
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+	}
+
+	return t.Transport.Close()
+}
+
+// forward passes received messages on, unless they crossed a partition
+func (t *FaultTransport) forward() {
+	for {
+		select {
+		case rpc := <-t.Transport.Consume():
+			remote := t.remoteAddr(rpc.From)
+
+			if t.Controller.partitioned(remote, t.Addr()) {
+				if rpc.Stream != nil {
+					rpc.Stream.Reset()
+				}
+				continue
+			}
+
+			// replies written to the stream travel back over the link
+			if rpc.Stream != nil {
+				rpc.Stream = &faultStream{Stream: rpc.Stream, controller: t.Controller, from: t.Addr(), to: remote}
+			}
+
+			select {
+			case t.rpcch <- rpc:
+			case <-t.closed:
+				return
+			}
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *FaultTransport) handlePeer(p p2p.Peer) error {
+	peer := newFaultPeer(t, p)
+
+	if t.Controller.partitioned(t.Addr(), peer.remote) {
+		return fmt.Errorf("fault peer %s: %w", peer.remote, ErrPartitioned)
+	}
+
+	if t.onPeer != nil {
+		if err := t.onPeer(peer); err != nil {
+			return err
+		}
+	}
+
+	t.lock.Lock()
+	t.peers[p] = peer
+	t.remotes[p2p.PeerID(p)] = peer.remote
+	t.lock.Unlock()
+
+	go peer.sendLoop()
+
+	return nil
+}
+
+func (t *FaultTransport) handlePeerDisconnect(p p2p.Peer) {
+	t.lock.Lock()
+	peer, ok := t.peers[p]
+	delete(t.peers, p)
+	t.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	peer.Close()
+
+	if t.onPeerDisconnect != nil {
+		t.onPeerDisconnect(peer)
+	}
+}
+
+func (t *FaultTransport) remoteAddr(peerID string) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if addr, ok := t.remotes[peerID]; ok {
+		return addr
+	}
+
+	return peerID
+}
+
+func (t *FaultTransport) resetPeers(remote string) {
+	t.lock.Lock()
+	peers := []*faultPeer{}
+	for _, peer := range t.peers {
+		if peer.remote == remote {
+			peers = append(peers, peer)
+		}
+	}
+	t.lock.Unlock()
+
+	for _, peer := range peers {
+		peer.Close()
+	}
+}
+
+type delayedMessage struct {
+	payload   []byte
+	deliverAt time.Time
+}
+
+// faultPeer delays control messages in an ordered queue,
+// so latency does not block the sender nor reorder messages
+type faultPeer struct {
+	p2p.Peer
+
+	transport *FaultTransport
+	local     string
+	remote    string
+	sendq     chan delayedMessage
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newFaultPeer(t *FaultTransport, p p2p.Peer) *faultPeer {
+	return &faultPeer{
+		Peer:      p,
+		transport: t,
+		local:     t.Addr(),
+		remote:    p.RemoteAddr().String(),
+		sendq:     make(chan delayedMessage, sendQueueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+func (p *faultPeer) Send(payload []byte) error {
+	c := p.transport.Controller
+
+	// lost or partitioned messages vanish without the sender noticing
+	if c.partitioned(p.local, p.remote) || c.drop(p.local, p.remote) {
+		return nil
+	}
+
+	msg := delayedMessage{
+		payload:   payload,
+		deliverAt: time.Now().Add(c.delay(p.local, p.remote) + c.transmission(p.local, p.remote, len(payload))),
+	}
+
+	select {
+	case p.sendq <- msg:
+	case <-p.done:
+		return p2p.ErrSessionClosed
+	default:
+		// a full queue behaves like an overflowing socket buffer
+	}
+
+	return nil
+}
+
+func (p *faultPeer) sendLoop() {
+	for {
+		select {
+		case msg := <-p.sendq:
+			time.Sleep(time.Until(msg.deliverAt))
+
+			if err := p.Peer.Send(msg.payload); err != nil {
+				p.Close()
+				return
+			}
+		case <-p.done:
+			return
+		case <-p.transport.closed:
+			return
+		}
+	}
+}
+
+func (p *faultPeer) OpenStream(payload []byte) (p2p.Stream, error) {
+	c := p.transport.Controller
+
+	if c.partitioned(p.local, p.remote) {
+		return nil, fmt.Errorf("fault stream to %s: %w", p.remote, ErrPartitioned)
+	}
+
+	time.Sleep(c.delay(p.local, p.remote))
+
+	stream, err := p.Peer.OpenStream(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultStream{Stream: stream, controller: c, from: p.local, to: p.remote}, nil
+}
+
+// Ping pays the latency of the link both ways, a ping
+// into a partition or a lost one is never answered
+func (p *faultPeer) Ping(timeout time.Duration) (time.Duration, error) {
+	c := p.transport.Controller
+
+	if c.partitioned(p.local, p.remote) || c.drop(p.local, p.remote) {
+		select {
+		case <-time.After(timeout):
+			return 0, fmt.Errorf("fault ping to %s: %w", p.remote, p2p.ErrPingTimeout)
+		case <-p.done:
+			return 0, p2p.ErrSessionClosed
+		}
+	}
+
+	delay := c.delay(p.local, p.remote) + c.delay(p.remote, p.local)
+	if delay >= timeout {
+		time.Sleep(timeout)
+		return 0, fmt.Errorf("fault ping to %s: %w", p.remote, p2p.ErrPingTimeout)
+	}
+
+	time.Sleep(delay)
+
+	rtt, err := p.Peer.Ping(timeout - delay)
+	return rtt + delay, err
+}
+
+func (p *faultPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+
+	return p.Peer.Close()
+}
+
+// faultStream throttles writes to the bandwidth of its link
+// and resets the stream once the link gets partitioned
+type faultStream struct {
+	p2p.Stream
+
+	controller *Controller
+	from, to   string
+}
+
+func (s *faultStream) Write(b []byte) (int, error) {
+	if s.controller.partitioned(s.from, s.to) {
+		s.Stream.Reset()
+		return 0, fmt.Errorf("fault stream to %s: %w", s.to, ErrPartitioned)
+	}
+
+	time.Sleep(s.controller.transmission(s.from, s.to, len(b)))
+
+	return s.Stream.Write(b)
+}
@@ -0,0 +1,102 @@
+package fault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/Yaroslaw07/difis/pkg/p2p/transports/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLink connects node a to node b and returns the peer a sees
+func newLink(t *testing.T, controller *Controller) (p2p.Peer, *FaultTransport) {
+	network := mem.NewNetwork()
+
+	newTransport := func(addr string) *FaultTransport {
+		tr := NewFaultTransport(FaultTransportOpts{
+			Transport:  mem.NewMemTransport(mem.MemTransportOpts{ListenAddr: addr, Network: network}),
+			Controller: controller,
+		})
+		require.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+
+		return tr
+	}
+
+	a, b := newTransport("a"), newTransport("b")
+
+	peers, accepted := make(chan p2p.Peer, 1), make(chan p2p.Peer, 1)
+	a.SetOnPeer(func(p p2p.Peer) error {
+		peers <- p
+		return nil
+	})
+	b.SetOnPeer(func(p p2p.Peer) error {
+		accepted <- p
+		return nil
+	})
+	require.Nil(t, a.Dial("b"))
+
+	// both ends have to be connected before faults are set up
+	<-accepted
+	return <-peers, b
+}
+
+func receive(tr p2p.Transport, timeout time.Duration) (p2p.RPC, bool) {
+	select {
+	case rpc := <-tr.Consume():
+		return rpc, true
+	case <-time.After(timeout):
+		return p2p.RPC{}, false
+	}
+}
+
+func TestFaultTransportPartition(t *testing.T) {
+	controller := NewController(1)
+	peer, b := newLink(t, controller)
+
+	controller.Partition("split", []string{"a"}, []string{"b"})
+
+	require.Nil(t, peer.Send([]byte("lost")))
+	_, ok := receive(b, 50*time.Millisecond)
+	assert.False(t, ok, "message crossed the partition")
+
+	_, err := peer.OpenStream(nil)
+	assert.ErrorIs(t, err, ErrPartitioned)
+
+	controller.Heal("split")
+
+	require.Nil(t, peer.Send([]byte("delivered")))
+	rpc, ok := receive(b, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "delivered", string(rpc.Payload))
+}
+
+func TestFaultTransportLatencyAndLoss(t *testing.T) {
+	controller := NewController(1)
+	peer, b := newLink(t, controller)
+
+	controller.SetLink("a", "b", LinkFaults{Latency: 100 * time.Millisecond})
+
+	start := time.Now()
+	require.Nil(t, peer.Send([]byte("slow")))
+	_, ok := receive(b, time.Second)
+	require.True(t, ok)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	controller.SetLink("a", "b", LinkFaults{Loss: 1})
+	require.Nil(t, peer.Send([]byte("dropped")))
+	_, ok = receive(b, 50*time.Millisecond)
+	assert.False(t, ok, "message should have been lost")
+}
+
+func TestFaultTransportReset(t *testing.T) {
+	controller := NewController(1)
+	peer, _ := newLink(t, controller)
+
+	controller.Reset("a", "b")
+
+	_, err := peer.OpenStream(nil)
+	assert.ErrorIs(t, err, p2p.ErrSessionClosed)
+}
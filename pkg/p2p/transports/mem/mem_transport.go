@@ -0,0 +1,228 @@
+package mem
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+// Network is the registry in-memory transports listen on,
+// transports can only dial each other within the same network
+type Network struct {
+	lock       sync.Mutex
+	transports map[string]*MemTransport
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		transports: make(map[string]*MemTransport),
+	}
+}
+
+// Addrs returns the addresses currently accepting connections
+func (n *Network) Addrs() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	addrs := make([]string, 0, len(n.transports))
+	for addr := range n.transports {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+func (n *Network) listen(t *MemTransport) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.transports[t.ListenAddr]; ok {
+		return fmt.Errorf("mem listen %s: address already in use", t.ListenAddr)
+	}
+
+	n.transports[t.ListenAddr] = t
+
+	return nil
+}
+
+func (n *Network) unlisten(t *MemTransport) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.transports[t.ListenAddr] == t {
+		delete(n.transports, t.ListenAddr)
+	}
+}
+
+func (n *Network) lookup(addr string) (*MemTransport, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	t, ok := n.transports[addr]
+	return t, ok
+}
+
+// MemPeer is a struct that represents a node connected over an in-memory pipe
+type MemPeer struct {
+	*p2p.Session
+
+	outbound bool
+
+	// info is what the handshake verified about the remote
+	info p2p.PeerInfo
+}
+
+func NewMemPeer(conn net.Conn, outbound bool, info p2p.PeerInfo, decoder p2p.Decoder) *MemPeer {
+	return &MemPeer{
+		Session:  p2p.NewSession(conn, outbound, decoder),
+		outbound: outbound,
+		info:     info,
+	}
+}
+
+// Identity implements the Peer interface, in-memory peers are not authenticated
+func (p *MemPeer) Identity() string {
+	return ""
+}
+
+// Info implements the Peer interface
+func (p *MemPeer) Info() p2p.PeerInfo {
+	return p.info
+}
+
+// Outbound implements the Peer interface
+func (p *MemPeer) Outbound() bool {
+	return p.outbound
+}
+
+type MemTransportOpts struct {
+	ListenAddr    string
+	Network       *Network
+	HandshakeFunc p2p.HandshakeFunc
+	Decoder       p2p.Decoder
+	OnPeer        func(p2p.Peer) error
+	// OnPeerDisconnect runs when a peer accepted by OnPeer goes away
+	OnPeerDisconnect func(p2p.Peer)
+}
+
+// MemTransport implements p2p.Transport over in-process pipes,
+// it lets tests run many nodes without touching real ports
+type MemTransport struct {
+	MemTransportOpts
+	rpcch chan p2p.RPC
+
+	lock  sync.Mutex
+	peers map[*MemPeer]struct{}
+}
+
+func NewMemTransport(opts MemTransportOpts) *MemTransport {
+	if opts.HandshakeFunc == nil {
+		opts.HandshakeFunc = p2p.NOPHandshakeFunc
+	}
+
+	return &MemTransport{
+		MemTransportOpts: opts,
+		rpcch:            make(chan p2p.RPC),
+		peers:            make(map[*MemPeer]struct{}),
+	}
+}
+
+// Addr implements Transport interface return the address
+// of the transport is accepting connection
+func (t *MemTransport) Addr() string {
+	return t.ListenAddr
+}
+
+// SetOnPeer is implementing Transport interface, which will set
+// the callback run for every new connection
+func (t *MemTransport) SetOnPeer(onPeer func(p2p.Peer) error) {
+	t.OnPeer = onPeer
+}
+
+// SetOnPeerDisconnect is implementing Transport interface, which will set
+// the callback run when a connection is gone
+func (t *MemTransport) SetOnPeerDisconnect(onPeerDisconnect func(p2p.Peer)) {
+	t.OnPeerDisconnect = onPeerDisconnect
+}
+
+// Consume is implementing Transport interface, which will return read-only
+// channel for reading messages from another peer
+func (t *MemTransport) Consume() <-chan p2p.RPC {
+	return t.rpcch
+}
+
+// ListenAndAccept registers the transport in its network
+func (t *MemTransport) ListenAndAccept() error {
+	return t.Network.listen(t)
+}
+
+// Close leaves the network and drops every connection,
+// as if the process of the node went away
+func (t *MemTransport) Close() error {
+	t.Network.unlisten(t)
+
+	t.lock.Lock()
+	peers := t.peers
+	t.peers = make(map[*MemPeer]struct{})
+	t.lock.Unlock()
+
+	for peer := range peers {
+		peer.Close()
+	}
+
+	return nil
+}
+
+// Dial is implementing Transport interface, which will connect
+// to the transport listening on addr in the same network
+func (t *MemTransport) Dial(addr string) error {
+	remote, ok := t.Network.lookup(addr)
+	if !ok {
+		return fmt.Errorf("mem dial %s: connection refused", addr)
+	}
+
+	local, accepted := newPipe(t.ListenAddr, addr)
+
+	go remote.handleConn(accepted, false)
+	go t.handleConn(local, true)
+
+	return nil
+}
+
+func (t *MemTransport) handleConn(conn net.Conn, outbound bool) {
+	info, err := t.HandshakeFunc(conn, outbound)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	peer := NewMemPeer(conn, outbound, info, t.Decoder)
+
+	t.lock.Lock()
+	t.peers[peer] = struct{}{}
+	t.lock.Unlock()
+
+	defer func() {
+		t.lock.Lock()
+		delete(t.peers, peer)
+		t.lock.Unlock()
+
+		peer.Close()
+	}()
+
+	if t.OnPeer != nil {
+		if err := t.OnPeer(peer); err != nil {
+			return
+		}
+	}
+
+	peer.Serve(p2p.PeerID(peer), t.rpcch)
+
+	if t.OnPeerDisconnect != nil {
+		t.OnPeerDisconnect(peer)
+	}
+}
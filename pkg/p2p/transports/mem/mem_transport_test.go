@@ -0,0 +1,49 @@
+package mem
+
+import (
+	"io"
+	"testing"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemTransport(t *testing.T) {
+	network := NewNetwork()
+
+	a := NewMemTransport(MemTransportOpts{ListenAddr: "a", Network: network})
+	b := NewMemTransport(MemTransportOpts{ListenAddr: "b", Network: network})
+
+	peers := make(chan p2p.Peer, 1)
+	b.OnPeer = func(p p2p.Peer) error {
+		peers <- p
+		return nil
+	}
+
+	require.Nil(t, a.ListenAndAccept())
+	require.Nil(t, b.ListenAndAccept())
+	assert.Equal(t, []string{"a", "b"}, network.Addrs())
+
+	assert.NotNil(t, a.Dial("nowhere"))
+	require.Nil(t, a.Dial("b"))
+
+	peer := <-peers
+	assert.Equal(t, "a", peer.RemoteAddr().String())
+
+	stream, err := peer.OpenStream([]byte("hello"))
+	require.Nil(t, err)
+	stream.Write([]byte("over the pipe"))
+	stream.Close()
+
+	rpc := <-a.Consume()
+	assert.Equal(t, "b", rpc.From)
+	assert.Equal(t, "hello", string(rpc.Payload))
+
+	data, err := io.ReadAll(rpc.Stream)
+	require.Nil(t, err)
+	assert.Equal(t, "over the pipe", string(data))
+
+	a.Close()
+	assert.Equal(t, []string{"b"}, network.Addrs())
+}
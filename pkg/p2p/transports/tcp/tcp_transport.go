@@ -1,55 +1,84 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/Yaroslaw07/difis/pkg/p2p"
 )
 
 // TCPPeer is a struct that represents a node in the TCP connection
 type TCPPeer struct {
-	// conn is the underlying connection to the peer
-	net.Conn
+	// Session multiplexes messages and streams over the underlying connection
+	*p2p.Session
 
 	// outbound if dial and retrieve a conn == true
 	// inbound if accept and retrieve a conn == false
 	outbound bool
 
-	wg *sync.WaitGroup
+	// info is what the handshake verified about the remote
+	info p2p.PeerInfo
+
+	// identity is the name from the verified certificate
+	// of the remote, empty when TLS is off
+	identity string
 }
 
-func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
-	return &TCPPeer{
-		Conn:     conn,
+func NewTCPPeer(conn net.Conn, outbound bool, info p2p.PeerInfo, decoder p2p.Decoder) *TCPPeer {
+	peer := &TCPPeer{
+		Session:  p2p.NewSession(conn, outbound, decoder),
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		info:     info,
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		peer.identity = peerIdentity(tlsConn.ConnectionState())
 	}
+
+	return peer
 }
 
-func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+// Identity implements the Peer interface
+func (p *TCPPeer) Identity() string {
+	return p.identity
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// Info implements the Peer interface
+func (p *TCPPeer) Info() p2p.PeerInfo {
+	return p.info
 }
 
+// Outbound implements the Peer interface
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// tlsHandshakeTimeout bounds how long a connection may take to authenticate
+const tlsHandshakeTimeout = 10 * time.Second
+
 type TCPTransportOpts struct {
 	ListenAddr    string
 	HandshakeFunc p2p.HandshakeFunc
 	Decoder       p2p.Decoder
 	OnPeer        func(p2p.Peer) error
+	// OnPeerDisconnect runs when a peer accepted by OnPeer goes away
+	OnPeerDisconnect func(p2p.Peer)
+	// TLS turns on mutually authenticated TLS for every connection
+	TLS *TLSConfig
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan p2p.RPC
+
+	certsLock sync.Mutex
+	certs     *certReloader
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
@@ -65,6 +94,18 @@ func (t *TCPTransport) Addr() string {
 	return t.ListenAddr
 }
 
+// SetOnPeer is implementing Transport interface, which will set
+// the callback run for every new connection
+func (t *TCPTransport) SetOnPeer(onPeer func(p2p.Peer) error) {
+	t.OnPeer = onPeer
+}
+
+// SetOnPeerDisconnect is implementing Transport interface, which will set
+// the callback run when a connection is gone
+func (t *TCPTransport) SetOnPeerDisconnect(onPeerDisconnect func(p2p.Peer)) {
+	t.OnPeerDisconnect = onPeerDisconnect
+}
+
 // Consume is implementing Transport interface, which will return read-only
 // channel for reading messages from another peer
 func (t *TCPTransport) Consume() <-chan p2p.RPC {
@@ -78,6 +119,10 @@ func (t *TCPTransport) Close() error {
 
 // Dial is implementing Transport interface, which will dial to the address
 func (t *TCPTransport) Dial(addr string) error {
+	if _, err := t.tlsCerts(); err != nil {
+		return err
+	}
+
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return err
@@ -88,7 +133,41 @@ func (t *TCPTransport) Dial(addr string) error {
 	return nil
 }
 
+// ReloadCertificates reads the TLS files again, new connections
+// use them right away. Changed files are also picked up on their own
+func (t *TCPTransport) ReloadCertificates() error {
+	certs, err := t.tlsCerts()
+	if err != nil || certs == nil {
+		return err
+	}
+
+	return certs.Reload()
+}
+
+// tlsCerts loads the certificates on first use, nil means TLS is off
+func (t *TCPTransport) tlsCerts() (*certReloader, error) {
+	if t.TLS == nil {
+		return nil, nil
+	}
+
+	t.certsLock.Lock()
+	defer t.certsLock.Unlock()
+
+	if t.certs == nil {
+		certs, err := newCertReloader(*t.TLS)
+		if err != nil {
+			return nil, err
+		}
+		t.certs = certs
+	}
+
+	return t.certs, nil
+}
+
 func (t *TCPTransport) ListenAndAccept() error {
+	if _, err := t.tlsCerts(); err != nil {
+		return err
+	}
 
 	var err error
 
@@ -114,6 +193,7 @@ func (t *TCPTransport) startAcceptLoop() {
 
 		if err != nil {
 			fmt.Printf("TCP accept error: %s\n", err)
+			continue
 		}
 
 		go t.handleConn(conn, false)
@@ -123,41 +203,60 @@ func (t *TCPTransport) startAcceptLoop() {
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
 
-	defer func() {
-		fmt.Printf("dropping peer connection: %s", err)
+	if conn, err = t.secure(conn, outbound); err != nil {
+		fmt.Printf("dropping peer connection, TLS handshake failed: %s\n", err)
 		conn.Close()
-	}()
-
-	peer := NewTCPPeer(conn, outbound)
+		return
+	}
 
-	if err = t.HandshakeFunc(peer); err != nil {
+	var info p2p.PeerInfo
+	if info, err = t.HandshakeFunc(conn, outbound); err != nil {
+		fmt.Printf("dropping peer connection: %s\n", err)
+		conn.Close()
 		return
 	}
 
+	peer := NewTCPPeer(conn, outbound, info, t.Decoder)
+
+	defer func() {
+		fmt.Printf("dropping peer connection: %s\n", err)
+		peer.Close()
+	}()
+
 	if t.OnPeer != nil {
 		if err = t.OnPeer(peer); err != nil {
 			return
 		}
 	}
 
-	// Read loop
-	for {
-		rpc := p2p.RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
-		if err != nil {
-			return
-		}
+	// Read loop, runs until the connection breaks
+	err = peer.Serve(p2p.PeerID(peer), t.rpcch)
 
-		rpc.From = conn.RemoteAddr().String()
+	if t.OnPeerDisconnect != nil {
+		t.OnPeerDisconnect(peer)
+	}
+}
 
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
-			continue
-		}
+// secure runs the TLS handshake on the connection when TLS is on,
+// both sides have to present a certificate signed by the cluster CA
+func (t *TCPTransport) secure(conn net.Conn, outbound bool) (net.Conn, error) {
+	certs, err := t.tlsCerts()
+	if err != nil || certs == nil {
+		return conn, err
+	}
 
-		t.rpcch <- rpc
+	var tlsConn *tls.Conn
+	if outbound {
+		tlsConn = tls.Client(conn, certs.clientConfig())
+	} else {
+		tlsConn = tls.Server(conn, certs.serverConfig())
 	}
+
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return conn, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
 }
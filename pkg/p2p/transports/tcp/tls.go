@@ -0,0 +1,180 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig holds the PEM files a node needs for mutually
+// authenticated TLS. Every peer has to present a certificate
+// signed by the cluster CA, no matter which side dialed
+type TLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// certReloader serves the node certificate and the cluster CA,
+// picking up new files on disk with the next handshake
+type certReloader struct {
+	TLSConfig
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+func newCertReloader(cfg TLSConfig) (*certReloader, error) {
+	r := &certReloader{TLSConfig: cfg}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the certificate, key and CA files again
+func (r *certReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading node certificate: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(r.CAFile)
+	if err != nil {
+		return fmt.Errorf("loading cluster CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in cluster CA file %s", r.CAFile)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.cert = &cert
+	r.pool = pool
+	r.modTime = modTime
+
+	return nil
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range []string{r.CAFile, r.CertFile, r.KeyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// current returns the certificate and CA to use, reloading them
+// if the files changed. A broken update keeps the previous ones
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.lock.Lock()
+	loaded := r.modTime
+	r.lock.Unlock()
+
+	if modTime, err := r.lastModified(); err == nil && modTime.After(loaded) {
+		if err := r.Reload(); err != nil {
+			log.Printf("TLS certificate reload failed, keeping the previous one: %s\n", err)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.cert, r.pool
+}
+
+func (r *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			}, nil
+		},
+	}
+}
+
+func (r *certReloader) clientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		// nodes are dialed by address, not by host name, so the
+		// chain is verified against the cluster CA by hand instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, pool := r.current()
+			return verifyChain(cs.PeerCertificates, pool, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+func verifyChain(certs []*x509.Certificate, pool *x509.CertPool, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+
+	return err
+}
+
+// peerIdentity is the name of the verified remote certificate
+func peerIdentity(cs tls.ConnectionState) string {
+	if len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+
+	leaf := cs.PeerCertificates[0]
+	if len(leaf.Subject.CommonName) > 0 {
+		return leaf.Subject.CommonName
+	}
+
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0]
+	}
+
+	return ""
+}
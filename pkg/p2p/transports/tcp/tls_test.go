@@ -0,0 +1,162 @@
+package tcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "difis cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	file := filepath.Join(dir, "ca.pem")
+	writePEM(t, file, "CERTIFICATE", der)
+
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue writes a node certificate for name signed by the CA
+func (ca *testCA) issue(t *testing.T, dir, name string) *TLSConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	cfg := &TLSConfig{
+		CAFile:   ca.file,
+		CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	writePEM(t, cfg.CertFile, "CERTIFICATE", der)
+	writePEM(t, cfg.KeyFile, "EC PRIVATE KEY", keyDER)
+
+	return cfg
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	require.Nil(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+}
+
+func newTLSTransport(t *testing.T, cfg *TLSConfig) (*TCPTransport, chan p2p.Peer) {
+	peers := make(chan p2p.Peer, 1)
+
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		TLS:           cfg,
+		OnPeer: func(p p2p.Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	require.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+
+	return tr, peers
+}
+
+func waitPeer(peers chan p2p.Peer) p2p.Peer {
+	select {
+	case p := <-peers:
+		return p
+	case <-time.After(2 * time.Second):
+		return nil
+	}
+}
+
+func TestTLSTransportMutualAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+
+	server, serverPeers := newTLSTransport(t, ca.issue(t, dir, "node-a"))
+	client, clientPeers := newTLSTransport(t, ca.issue(t, dir, "node-b"))
+
+	require.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	inbound, outbound := waitPeer(serverPeers), waitPeer(clientPeers)
+	require.NotNil(t, inbound)
+	require.NotNil(t, outbound)
+
+	assert.Equal(t, "node-b", inbound.Identity())
+	assert.Equal(t, "node-a", outbound.Identity())
+
+	// a node with a certificate of another CA is turned away
+	otherDir := t.TempDir()
+	intruder, intruderPeers := newTLSTransport(t, newTestCA(t, otherDir).issue(t, otherDir, "intruder"))
+
+	require.Nil(t, intruder.Dial(server.listener.Addr().String()))
+	assert.Nil(t, waitPeer(serverPeers))
+	assert.Nil(t, waitPeer(intruderPeers))
+}
+
+func TestTLSTransportReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+
+	server, serverPeers := newTLSTransport(t, ca.issue(t, dir, "node-a"))
+	client, _ := newTLSTransport(t, ca.issue(t, dir, "node-b"))
+
+	// the client certificate gets renewed under a new name
+	renewed := ca.issue(t, t.TempDir(), "node-b-renewed")
+	for _, f := range [][2]string{{renewed.CertFile, client.TLS.CertFile}, {renewed.KeyFile, client.TLS.KeyFile}} {
+		data, err := os.ReadFile(f[0])
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(f[1], data, 0600))
+	}
+	require.Nil(t, client.ReloadCertificates())
+
+	require.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	inbound := waitPeer(serverPeers)
+	require.NotNil(t, inbound)
+	assert.Equal(t, "node-b-renewed", inbound.Identity())
+}
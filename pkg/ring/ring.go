@@ -0,0 +1,156 @@
+package ring
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultVirtualNodes = 128
+
+// Node is a member of the ring
+type Node struct {
+	ID   string
+	Addr string
+}
+
+// Ring is a consistent hashing ring. Every node is hashed onto it at
+// VirtualNodes points, a key belongs to the nodes met walking clockwise
+// from its hash. A node joining or leaving only moves the keys next to
+// its points, about 1/n of them
+type Ring struct {
+	virtualNodes int
+
+	lock   sync.RWMutex
+	nodes  map[string]Node
+	points []point
+}
+
+// point is one virtual node, a position on the ring owned by a node
+type point struct {
+	hash uint64
+	id   string
+}
+
+// New creates an empty ring, zero virtual nodes means the default
+func New(virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+
+	return &Ring{
+		virtualNodes: virtualNodes,
+		nodes:        make(map[string]Node),
+	}
+}
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Add puts the node on the ring, adding a node that is there already
+// only updates its address, if a new one is known
+func (r *Ring) Add(node Node) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if existing, ok := r.nodes[node.ID]; ok {
+		if len(node.Addr) > 0 {
+			existing.Addr = node.Addr
+			r.nodes[node.ID] = existing
+		}
+		return
+	}
+
+	r.nodes[node.ID] = node
+
+	for i := 0; i < r.virtualNodes; i++ {
+		r.points = append(r.points, point{hash: hash(node.ID + "#" + strconv.Itoa(i)), id: node.ID})
+	}
+
+	slices.SortFunc(r.points, func(a, b point) int {
+		// the same hash for two nodes is unlikely but has to
+		// order the same way on every node
+		return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(a.id, b.id))
+	})
+}
+
+func (r *Ring) Remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.nodes[id]; !ok {
+		return
+	}
+
+	delete(r.nodes, id)
+	r.points = slices.DeleteFunc(r.points, func(p point) bool { return p.id == id })
+}
+
+// Owners returns the first n distinct nodes clockwise from the key,
+// the first one is its primary owner
+func (r *Ring) Owners(key string, n int) []Node {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+
+	h := hash(key)
+	start, _ := slices.BinarySearchFunc(r.points, h, func(p point, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+
+	owners := make([]Node, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if seen[p.id] {
+			continue
+		}
+
+		seen[p.id] = true
+		owners = append(owners, r.nodes[p.id])
+	}
+
+	return owners
+}
+
+func (r *Ring) Has(id string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.nodes[id]
+	return ok
+}
+
+// Nodes returns the nodes on the ring ordered by ID
+func (r *Ring) Nodes() []Node {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	nodes := make([]Node, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+
+	slices.SortFunc(nodes, func(a, b Node) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return nodes
+}
+
+func (r *Ring) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.nodes)
+}
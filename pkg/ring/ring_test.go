@@ -0,0 +1,102 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newTestRing(n int) *Ring {
+	r := New(0)
+	for i := 0; i < n; i++ {
+		r.Add(Node{ID: fmt.Sprintf("node-%d", i), Addr: fmt.Sprintf("addr-%d", i)})
+	}
+
+	return r
+}
+
+func TestRingOwners(t *testing.T) {
+	r := newTestRing(5)
+
+	owners := r.Owners("some key", 3)
+	if len(owners) != 3 {
+		t.Fatalf("expected 3 owners, got %d", len(owners))
+	}
+
+	seen := map[string]bool{}
+	for _, node := range owners {
+		if seen[node.ID] {
+			t.Errorf("node %s owns the key twice", node.ID)
+		}
+		seen[node.ID] = true
+	}
+
+	if got := r.Owners("some key", 10); len(got) != 5 {
+		t.Errorf("expected every node to own the key, got %d owners", len(got))
+	}
+
+	// every ring with the same nodes agrees on the owners
+	other := newTestRing(5)
+	for i, node := range other.Owners("some key", 3) {
+		if node != owners[i] {
+			t.Errorf("owner %d differs between rings: %s and %s", i, node.ID, owners[i].ID)
+		}
+	}
+
+	if got := New(0).Owners("some key", 3); len(got) != 0 {
+		t.Errorf("empty ring returned %d owners", len(got))
+	}
+}
+
+func TestRingBalance(t *testing.T) {
+	r := newTestRing(10)
+
+	counts := map[string]int{}
+	keys := 10000
+	for i := 0; i < keys; i++ {
+		counts[r.Owners(fmt.Sprintf("key-%d", i), 1)[0].ID]++
+	}
+
+	// every node gets its share give or take a third
+	for id, count := range counts {
+		if count < keys/10*2/3 || count > keys/10*4/3 {
+			t.Errorf("node %s owns %d of %d keys", id, count, keys)
+		}
+	}
+}
+
+func TestRingMinimalMovement(t *testing.T) {
+	r := newTestRing(10)
+
+	keys := 10000
+	before := make([]string, keys)
+	for i := range before {
+		before[i] = r.Owners(fmt.Sprintf("key-%d", i), 1)[0].ID
+	}
+
+	r.Add(Node{ID: "node-new"})
+
+	moved := 0
+	for i := range before {
+		owner := r.Owners(fmt.Sprintf("key-%d", i), 1)[0].ID
+		if owner == before[i] {
+			continue
+		}
+
+		moved++
+		if owner != "node-new" {
+			t.Fatalf("key moved between old nodes, from %s to %s", before[i], owner)
+		}
+	}
+
+	// about 1/11 of the keys move to the new node
+	if moved < keys/11/2 || moved > keys/11*2 {
+		t.Errorf("%d of %d keys moved", moved, keys)
+	}
+
+	r.Remove("node-new")
+	for i := range before {
+		if owner := r.Owners(fmt.Sprintf("key-%d", i), 1)[0].ID; owner != before[i] {
+			t.Fatalf("key %d didn't move back after the node left", i)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/crypto"
+	"github.com/Yaroslaw07/difis/pkg/merkle"
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/Yaroslaw07/difis/pkg/ring"
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
+
+const (
+	defaultAntiEntropyInterval  = time.Minute
+	defaultTombstoneGracePeriod = 24 * time.Hour
+)
+
+// MessageSyncTree is the Merkle tree of the replicas of an owner's files
+// a node should hold, the node answers with its replicas in the ranges
+// of keys its own tree differs in
+type MessageSyncTree struct {
+	Owner  string
+	Depth  int
+	Leaves []merkle.Hash
+}
+
+// antiEntropy periodically compares the files of this node with their
+// replicas, so a replica owner that missed a write catches up, and
+// forgets the tombstones past their grace period
+func (fs *FileServer) antiEntropy() {
+	ticker := time.NewTicker(fs.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fs.collectTombstones()
+			fs.syncReplicas(nil)
+		case <-fs.quitChannel:
+			return
+		}
+	}
+}
+
+// syncReplicas sends every replica owner a tree of the files it should
+// hold and pushes only the files it misses or holds an older version of,
+// sent is told the size of every file pushed when it is not nil
+func (fs *FileServer) syncReplicas(sent func(size int64)) {
+	entries, err := fs.store.List(fs.ID)
+	if err != nil {
+		log.Printf("[%s] listing files for anti-entropy failed: %s\n", fs.Transport.Addr(), err)
+		return
+	}
+
+	var (
+		nodes    = make(map[string]ring.Node)
+		expected = make(map[string]map[string]storage.Entry)
+	)
+	for _, entry := range entries {
+		hash := crypto.HashKey(entry.Key)
+
+		for _, node := range fs.replicaOwners(fs.ID, hash) {
+			if _, ok := expected[node.ID]; !ok {
+				nodes[node.ID] = node
+				expected[node.ID] = make(map[string]storage.Entry)
+			}
+
+			expected[node.ID][hash] = entry
+		}
+	}
+
+	for nodeID, node := range nodes {
+		if err := fs.syncReplica(node, expected[nodeID], sent); err != nil {
+			log.Printf("[%s] anti-entropy with (%s) failed: %s\n", fs.Transport.Addr(), nodeID, err)
+		}
+	}
+}
+
+// syncReplica brings one replica owner up to date, expected are the
+// files it should hold by the hash of their key
+func (fs *FileServer) syncReplica(node ring.Node, expected map[string]storage.Entry, sent func(size int64)) error {
+	tree := merkle.New(merkle.DefaultDepth)
+	for hash, entry := range expected {
+		tree.Insert(hash, treeValue(entry.Metadata))
+	}
+
+	peer, err := fs.connect(node.ID, node.Addr)
+	if err != nil {
+		return err
+	}
+
+	msg := MessageWrapper{
+		Type: MessageTypeSyncTree,
+		Payload: MessageSyncTree{
+			Owner:  fs.ID,
+			Depth:  tree.Depth(),
+			Leaves: tree.Leaves(),
+		},
+	}
+
+	resp, err := fs.request(node.ID, peer, &msg)
+	if errors.Is(err, ErrUnsupported) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Buckets) == 0 {
+		return nil
+	}
+
+	held := make(map[string]storage.Metadata, len(resp.Entries))
+	for _, entry := range resp.Entries {
+		held[entry.Key] = entry.Metadata
+	}
+
+	divergent := make(map[int]bool, len(resp.Buckets))
+	for _, bucket := range resp.Buckets {
+		divergent[bucket] = true
+	}
+
+	// the replicas this node has no record of are left alone,
+	// their tombstone may have been collected already
+	pushed := 0
+	for hash, entry := range expected {
+		if !divergent[tree.Bucket(hash)] {
+			continue
+		}
+
+		if meta, ok := held[hash]; ok && !entry.Newer(meta) {
+			continue
+		}
+
+		if entry.Deleted {
+			err = fs.sendTombstone(node.ID, peer, fs.ID, hash, entry.Metadata)
+		} else {
+			err = fs.replicate(entry.Key, map[string]p2p.Peer{node.ID: peer}, nil, 1)
+		}
+
+		if err != nil {
+			log.Printf("[%s] anti-entropy of file (%s) with (%s) failed: %s\n", fs.Transport.Addr(), entry.Key, node.ID, err)
+			continue
+		}
+
+		pushed++
+		if sent != nil {
+			sent(entry.Size)
+		}
+	}
+
+	fmt.Printf("[%s] anti-entropy with (%s): (%d) ranges differed, (%d) files sent\n", fs.Transport.Addr(), node.ID, len(resp.Buckets), pushed)
+
+	return nil
+}
+
+func (fs *FileServer) handleMessageSyncTree(from string, requestID uint64, msg MessageSyncTree) error {
+	// the tree comes from a peer, nothing is built for one this node
+	// doesn't compare with
+	if msg.Depth != merkle.DefaultDepth {
+		return fs.replyError(from, requestID, fmt.Errorf("%w: (%d) and (%d)", merkle.ErrDepthMismatch, msg.Depth, merkle.DefaultDepth))
+	}
+
+	remote, err := merkle.FromLeaves(msg.Depth, msg.Leaves)
+	if err != nil {
+		return fs.replyError(from, requestID, err)
+	}
+
+	entries, err := fs.store.List(msg.Owner)
+	if err != nil {
+		return fs.replyError(from, requestID, err)
+	}
+
+	// only the replicas the ring puts here are compared, the keys of
+	// replicas are already hashed
+	tree := merkle.New(merkle.DefaultDepth)
+	placed := []storage.Entry{}
+	for _, entry := range entries {
+		if !fs.ownsReplica(msg.Owner, entry.Key) {
+			continue
+		}
+
+		tree.Insert(entry.Key, treeValue(entry.Metadata))
+		placed = append(placed, entry)
+	}
+
+	buckets, err := tree.Diff(remote)
+	if err != nil {
+		return fs.replyError(from, requestID, err)
+	}
+
+	divergent := make(map[int]bool, len(buckets))
+	for _, bucket := range buckets {
+		divergent[bucket] = true
+	}
+
+	held := []storage.Entry{}
+	for _, entry := range placed {
+		if divergent[tree.Bucket(entry.Key)] {
+			held = append(held, entry)
+		}
+	}
+
+	return fs.reply(from, requestID, MessageResponse{Status: StatusAck, Buckets: buckets, Entries: held})
+}
+
+// collectTombstones forgets the deletes older than TombstoneGracePeriod,
+// unless a hint still has to deliver them
+func (fs *FileServer) collectTombstones() {
+	ids, err := fs.store.IDs()
+	if err != nil {
+		log.Printf("[%s] listing tombstones failed: %s\n", fs.Transport.Addr(), err)
+		return
+	}
+
+	collected := 0
+	for _, id := range ids {
+		entries, err := fs.store.List(id)
+		if err != nil {
+			log.Printf("[%s] listing tombstones of (%s) failed: %s\n", fs.Transport.Addr(), id, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			// the version of a tombstone is when the file was deleted
+			deleted := time.Unix(0, int64(entry.Version))
+			if !entry.Deleted || time.Since(deleted) < fs.TombstoneGracePeriod || fs.hints.holds(id, entry.Key) {
+				continue
+			}
+
+			if err := fs.dropEntry(id, entry); err != nil {
+				log.Printf("[%s] collecting tombstone of file (%s) failed: %s\n", fs.Transport.Addr(), entry.Key, err)
+				continue
+			}
+
+			collected++
+		}
+	}
+
+	if collected > 0 {
+		fmt.Printf("[%s] collected (%d) tombstones\n", fs.Transport.Addr(), collected)
+	}
+}
+
+// dropEntry deletes the stored file unless a newer version of it was
+// written since it was listed
+func (fs *FileServer) dropEntry(id string, entry storage.Entry) error {
+	unlock := fs.writes.acquire(id, entry.Key)
+	defer unlock()
+
+	current, err := fs.store.ReadMetadata(id, entry.Key)
+	if err != nil {
+		return err
+	}
+
+	if !current.Equal(entry.Metadata) {
+		return fmt.Errorf("file (%s) version (%d) replaced by (%d): %w", entry.Key, entry.Version, current.Version, ErrStaleVersion)
+	}
+
+	fs.dht.Unprovide(replicaKey(id, entry.Key))
+
+	return fs.store.Delete(id, entry.Key)
+}
+
+// ownsReplica tells whether the ring puts the replica of the file here
+func (fs *FileServer) ownsReplica(owner, hash string) bool {
+	for _, node := range fs.replicaOwners(owner, hash) {
+		if node.ID == fs.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// treeValue is what tells two versions of a file apart in a tree
+func treeValue(meta storage.Metadata) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, meta.Version), meta.Checksum...)
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Yaroslaw07/difis/pkg/crypto"
+	"github.com/Yaroslaw07/difis/pkg/ring"
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
+
+// siblingsFolderName is where the siblings of files live in the
+// storage root, no node ID starts with a dot
+const siblingsFolderName = ".siblings"
+
+// ConflictResolver decides between the version of a file a replica holds
+// and a version written concurrently with it. It tells whether the
+// incoming version replaces the stored one, and whether the version that
+// loses is kept as a sibling of the file. Deletes always go by LastWriteWins.
+//
+// Versions are counted by the ID of the node that writes them. Every node
+// saves its files under its own ID, so two nodes saving the same key each
+// keep their own copy, and Siblings finds the version of the other one
+// when they were written concurrently. A node that lost its disk and saves
+// again concurrently with the versions its replicas hold is resolved here
+type ConflictResolver func(current, incoming storage.Metadata) (replace, keep bool)
+
+// LastWriteWins keeps the version written last, the other one is lost
+func LastWriteWins(current, incoming storage.Metadata) (bool, bool) {
+	return incoming.Newer(current), false
+}
+
+// KeepSiblings keeps the version written last as the file and the
+// other one as its sibling, until the owner saves the file again
+func KeepSiblings(current, incoming storage.Metadata) (bool, bool) {
+	return incoming.Newer(current), true
+}
+
+// MessageSiblings asks a replica owner for the siblings of a file it holds
+type MessageSiblings struct {
+	Message
+}
+
+// siblingKey is what the sibling of a file with the version is stored
+// under, replicas keep them by the hash of the key and the owner by the key
+func siblingKey(key string, version uint64) string {
+	return key + "@" + strconv.FormatUint(version, 10)
+}
+
+// listSiblings returns the siblings of the file the node keeps
+func (fs *FileServer) listSiblings(id, key string) ([]storage.Entry, error) {
+	entries, err := fs.siblings.List(id)
+	if err != nil {
+		return nil, err
+	}
+
+	siblings := []storage.Entry{}
+	for _, entry := range entries {
+		version, ok := strings.CutPrefix(entry.Key, key+"@")
+		if !ok {
+			continue
+		}
+
+		if _, err := strconv.ParseUint(version, 10, 64); err == nil {
+			siblings = append(siblings, entry)
+		}
+	}
+
+	return siblings, nil
+}
+
+// storeSibling keeps a version of a file that lost to the stored one
+func (fs *FileServer) storeSibling(msg MessageSaveFile, r io.Reader) (int64, error) {
+	key := siblingKey(msg.Key, msg.Meta.Version)
+
+	n, err := fs.siblings.Write(msg.ID, key, r)
+	if err != nil {
+		return n, err
+	}
+
+	if err := fs.siblings.WriteMetadata(msg.ID, key, msg.Meta); err != nil {
+		return n, err
+	}
+
+	fmt.Printf("[%s] kept version (%d) of file (%s) as a sibling\n", fs.Transport.Addr(), msg.Meta.Version, msg.Key)
+
+	return n, nil
+}
+
+// keepCurrentSibling keeps the stored version of a file as a sibling
+// before a version written concurrently with it replaces it
+func (fs *FileServer) keepCurrentSibling(id, key string, current storage.Metadata) error {
+	_, r, err := fs.store.Read(id, key)
+	if err != nil {
+		return err
+	}
+
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	sibling := siblingKey(key, current.Version)
+	if _, err := fs.siblings.Write(id, sibling, r); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] kept version (%d) of file (%s) as a sibling\n", fs.Transport.Addr(), current.Version, key)
+
+	return fs.siblings.WriteMetadata(id, sibling, current)
+}
+
+// dropSiblings deletes the siblings of a file the version was written
+// after, one with the same clock but other content is still concurrent
+func (fs *FileServer) dropSiblings(id, key string, meta storage.Metadata) {
+	siblings, err := fs.listSiblings(id, key)
+	if err != nil {
+		log.Printf("[%s] listing siblings of file (%s) failed: %s\n", fs.Transport.Addr(), key, err)
+		return
+	}
+
+	for _, sibling := range siblings {
+		if !meta.Clock.Descends(sibling.Clock) || meta.Concurrent(sibling.Metadata) {
+			continue
+		}
+
+		if err := fs.siblings.Delete(id, sibling.Key); err != nil {
+			log.Printf("[%s] deleting sibling (%s) failed: %s\n", fs.Transport.Addr(), sibling.Key, err)
+		}
+	}
+}
+
+// Siblings returns the versions of the file written concurrently with the
+// current one, those its replica owners keep next to it and those other
+// nodes saved under the same key. The node remembers them, so the next
+// Save or Delete of the file resolves them
+func (fs *FileServer) Siblings(key string) ([]storage.Metadata, error) {
+	hash := crypto.HashKey(key)
+	owners := fs.replicaOwners(fs.ID, hash)
+
+	var (
+		found    = make(map[uint64]storage.Metadata)
+		errs     = []error{}
+		answered = 0
+	)
+	for _, node := range owners {
+		peer, err := fs.connect(node.ID, node.Addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("peer (%s): %w", node.ID, err))
+			continue
+		}
+
+		msg := MessageWrapper{
+			Type:    MessageTypeSiblings,
+			Payload: MessageSiblings{Message: Message{ID: fs.ID, Key: hash}},
+		}
+
+		resp, err := fs.request(node.ID, peer, &msg)
+		if errors.Is(err, ErrUnsupported) {
+			answered++
+			continue
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("peer (%s): %w", node.ID, err))
+			continue
+		}
+
+		answered++
+		for _, entry := range resp.Entries {
+			found[entry.Version] = entry.Metadata
+		}
+	}
+
+	if answered == 0 && len(owners) > 0 {
+		return nil, fmt.Errorf("[%s] siblings of file (%s): %w", fs.Transport.Addr(), key, errors.Join(errs...))
+	}
+
+	for _, meta := range fs.concurrentSaves(key) {
+		found[meta.Version] = meta
+	}
+
+	siblings := []storage.Metadata{}
+	for version, meta := range found {
+		if err := fs.siblings.WriteMetadata(fs.ID, siblingKey(key, version), meta); err != nil {
+			return nil, err
+		}
+
+		siblings = append(siblings, meta)
+	}
+
+	slices.SortFunc(siblings, func(a, b storage.Metadata) int {
+		switch {
+		case a.Newer(b):
+			return 1
+		case b.Newer(a):
+			return -1
+		}
+		return 0
+	})
+
+	return siblings, nil
+}
+
+// concurrentSaves returns the versions of the file the other nodes saved
+// under the same key concurrently with the local copy, the ones the
+// conflict resolver keeps. Every node is asked for its own copy
+func (fs *FileServer) concurrentSaves(key string) []storage.Metadata {
+	current, err := fs.store.ReadMetadata(fs.ID, key)
+	if err != nil || current.Version == 0 {
+		return nil
+	}
+
+	saves := []storage.Metadata{}
+	for _, node := range fs.ring.Nodes() {
+		if node.ID == fs.ID {
+			continue
+		}
+
+		peer, err := fs.connect(node.ID, node.Addr)
+		if err != nil {
+			log.Printf("[%s] asking (%s) for its version of file (%s) failed: %s\n", fs.Transport.Addr(), node.ID, key, err)
+			continue
+		}
+
+		msg := MessageWrapper{
+			Type:    MessageTypeStat,
+			Payload: MessageStatFile{Message: Message{ID: node.ID, Key: key}},
+		}
+
+		resp, err := fs.request(node.ID, peer, &msg)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnsupported) {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("[%s] asking (%s) for its version of file (%s) failed: %s\n", fs.Transport.Addr(), node.ID, key, err)
+			continue
+		}
+
+		// a delete on another node leaves nothing to keep
+		if resp.Meta.Deleted || !current.Concurrent(resp.Meta) {
+			continue
+		}
+
+		if _, keep := fs.ConflictResolver(current, resp.Meta); keep {
+			saves = append(saves, resp.Meta)
+		}
+	}
+
+	return saves
+}
+
+// LoadSibling returns the sibling of the file with the version from the
+// first replica owner that keeps it, or from the node that saved it under
+// the same key, one of the nodes its clock counts. The node remembers it
+// like Siblings
+func (fs *FileServer) LoadSibling(key string, version uint64) (io.Reader, error) {
+	hash := crypto.HashKey(key)
+	sibling := siblingKey(key, version)
+
+	// what Siblings remembered, a failed load must not forget it
+	remembered, _ := fs.siblings.ReadMetadata(fs.ID, sibling)
+
+	loadMsg := newMessageLoadFile(fs.ID, hash)
+	loadMsg.Sibling = version
+
+	for _, node := range fs.replicaOwners(fs.ID, hash) {
+		loaded := fs.loadSibling(node, loadMsg, key, version, remembered, func(r io.Reader) (int64, error) {
+			return fs.siblings.WriteDecrypt(fs.EncKey, fs.ID, sibling, r)
+		})
+		if loaded {
+			_, r, err := fs.siblings.Read(fs.ID, sibling)
+			return r, err
+		}
+	}
+
+	// the copy another node saved is not encrypted with the key of this one
+	for _, node := range fs.ring.Nodes() {
+		if _, ok := remembered.Clock[node.ID]; !ok || node.ID == fs.ID {
+			continue
+		}
+
+		loaded := fs.loadSibling(node, newMessageLoadFile(node.ID, key), key, version, remembered, func(r io.Reader) (int64, error) {
+			return fs.siblings.Write(fs.ID, sibling, r)
+		})
+		if loaded {
+			_, r, err := fs.siblings.Read(fs.ID, sibling)
+			return r, err
+		}
+	}
+
+	return nil, fmt.Errorf("[%s] sibling (%d) of file (%s): %w", fs.Transport.Addr(), version, key, ErrNotFound)
+}
+
+// loadSibling fetches the sibling of the file with the version from the
+// node, it tells whether the node had it
+func (fs *FileServer) loadSibling(node ring.Node, loadMsg MessageLoadFile, key string, version uint64, remembered storage.Metadata, write func(r io.Reader) (int64, error)) bool {
+	sibling := siblingKey(key, version)
+
+	peer, err := fs.connect(node.ID, node.Addr)
+	if err != nil {
+		log.Printf("[%s] loading sibling of file (%s) from (%s) failed: %s\n", fs.Transport.Addr(), key, node.ID, err)
+		return false
+	}
+
+	_, meta, err := fs.fetch(node.ID, peer, loadMsg, write)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+
+	if err == nil {
+		err = verify(fs.siblings, fs.ID, sibling, meta)
+	}
+
+	// peers without siblings send the file instead, and
+	// the node that saved it may have saved it again since
+	if err == nil && meta.Version != version {
+		err = fmt.Errorf("peer (%s) sent version (%d): %w", node.ID, meta.Version, ErrNotFound)
+	}
+
+	if err == nil {
+		err = fs.siblings.WriteMetadata(fs.ID, sibling, meta)
+	}
+
+	if err != nil {
+		fs.siblings.Delete(fs.ID, sibling)
+		if remembered.Version > 0 {
+			fs.siblings.WriteMetadata(fs.ID, sibling, remembered)
+		}
+
+		log.Printf("[%s] loading sibling of file (%s) from (%s) failed: %s\n", fs.Transport.Addr(), key, node.ID, err)
+		return false
+	}
+
+	return true
+}
+
+func (fs *FileServer) handleMessageSiblings(from string, requestID uint64, msg MessageSiblings) error {
+	siblings, err := fs.listSiblings(msg.ID, msg.Key)
+	if err != nil {
+		return fs.replyError(from, requestID, err)
+	}
+
+	return fs.reply(from, requestID, MessageResponse{Status: StatusAck, Entries: siblings})
+}
+
+// keyLocks serializes the writes of a file, two Saves racing would write
+// the same file at once and number their versions the same, and a replica
+// written by two peers at once could end up older than the one it checked
+// against or with content of another version than its metadata
+type keyLocks struct {
+	lock  sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// acquire locks the file stored under the ID and key and returns the
+// function that unlocks it
+func (l *keyLocks) acquire(id, key string) func() {
+	key = id + "/" + key
+
+	l.lock.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.waiting++
+	l.lock.Unlock()
+
+	kl.Lock()
+
+	return func() {
+		kl.Unlock()
+
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		if kl.waiting--; kl.waiting == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
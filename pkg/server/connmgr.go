@@ -0,0 +1,292 @@
+package server
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+const (
+	defaultReconnectBackoff    = 500 * time.Millisecond
+	defaultMaxReconnectBackoff = 30 * time.Second
+)
+
+// dialTarget is an address the node keeps connected to
+type dialTarget struct {
+	addr     string
+	resolved *net.TCPAddr
+	// peerID is the node last reached at the address, nodeID the one
+	// the address was learned for from the other nodes
+	peerID string
+	nodeID string
+	// bootstrap addresses are kept for good, the others are dropped
+	// once their node is declared dead
+	bootstrap bool
+	attempts  int
+	next      time.Time
+}
+
+// connManager keeps the node connected to the bootstrap nodes and to the
+// nodes learned from peer exchange. Addresses that are not connected are
+// dialed again and again, waiting exponentially longer between tries.
+// The other nodes dialed, like the replica owners of a file, are not
+// dialed again once their connection is lost
+type connManager struct {
+	fs *FileServer
+
+	lock    sync.Mutex
+	targets map[string]*dialTarget
+	wake    chan struct{}
+}
+
+func newConnManager(fs *FileServer) *connManager {
+	return &connManager{
+		fs:      fs,
+		targets: make(map[string]*dialTarget),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// add starts keeping the node connected to the node at addr, dialing it
+// first after wait. It returns false if the address was known already
+func (m *connManager) add(nodeID, addr string, wait time.Duration) bool {
+	if len(addr) == 0 || addr == m.fs.Transport.Addr() {
+		return false
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.targets[addr]; ok {
+		return false
+	}
+
+	target := m.addLocked(addr)
+	target.nodeID = nodeID
+	target.next = time.Now().Add(wait)
+
+	return true
+}
+
+// addBootstrap keeps the node connected to the bootstrap address for good
+func (m *connManager) addBootstrap(addr string) {
+	if len(addr) == 0 || addr == m.fs.Transport.Addr() {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.addLocked(addr).bootstrap = true
+}
+
+// forget stops dialing the node declared dead, unless it is at
+// a bootstrap address. Peer exchange brings it back if it returns
+func (m *connManager) forget(nodeID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for addr, target := range m.targets {
+		if !target.bootstrap && (target.peerID == nodeID || target.nodeID == nodeID) {
+			delete(m.targets, addr)
+		}
+	}
+}
+
+// pending counts the addresses that are not connected yet
+func (m *connManager) pending() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	n := 0
+	for _, target := range m.targets {
+		if len(target.peerID) == 0 {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (m *connManager) addLocked(addr string) *dialTarget {
+	if target, ok := m.targets[addr]; ok {
+		return target
+	}
+
+	target := &dialTarget{addr: addr}
+	target.resolved, _ = net.ResolveTCPAddr("tcp", addr)
+	m.targets[addr] = target
+
+	m.notify()
+
+	return target
+}
+
+// observe learns which node an outbound connection to one of the
+// addresses kept connected reached
+func (m *connManager) observe(p p2p.Peer) {
+	if !p.Outbound() {
+		return
+	}
+
+	remote := p.RemoteAddr().String()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, target := range m.targets {
+		if sameAddr(target, remote) {
+			target.peerID = p2p.PeerID(p)
+			target.attempts = 0
+			return
+		}
+	}
+}
+
+func (m *connManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *connManager) run() {
+	events, unsubscribe := m.fs.Subscribe()
+	defer unsubscribe()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.Type == PeerDisconnected {
+				m.disconnected(event.PeerID)
+			}
+		case <-m.wake:
+		case <-timer.C:
+		case <-m.fs.quitChannel:
+			return
+		}
+
+		timer.Stop()
+		timer.Reset(m.dialDue())
+	}
+}
+
+// disconnected waits a first backoff before dialing the peer again,
+// so the nodes of a cluster don't all come back at the same moment
+func (m *connManager) disconnected(peerID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, target := range m.targets {
+		if target.peerID == peerID {
+			target.attempts = 0
+			target.next = time.Now().Add(m.backoff(0))
+		}
+	}
+}
+
+// dialDue dials the addresses whose backoff ran out
+// and returns how long until the next one does
+func (m *connManager) dialDue() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	wait := m.fs.MaxReconnectBackoff
+
+	for _, target := range m.targets {
+		if m.connected(target) {
+			continue
+		}
+
+		if now.Before(target.next) {
+			wait = min(wait, target.next.Sub(now))
+			continue
+		}
+
+		delay := m.backoff(target.attempts)
+		target.attempts++
+		target.next = now.Add(delay)
+		wait = min(wait, delay)
+
+		go func(addr string, attempts int) {
+			if attempts > 1 {
+				log.Printf("[%s] reconnecting to %s, attempt %d\n", m.fs.Transport.Addr(), addr, attempts)
+			}
+
+			if err := m.fs.Transport.Dial(addr); err != nil {
+				log.Println("dial error ", err)
+			}
+		}(target.addr, target.attempts)
+	}
+
+	return wait
+}
+
+func (m *connManager) connected(target *dialTarget) bool {
+	if len(target.peerID) == 0 {
+		m.identify(target)
+	}
+
+	if len(target.peerID) == 0 {
+		return false
+	}
+
+	_, ok := m.fs.peer(target.peerID)
+	return ok
+}
+
+// identify finds the node at the address of the target among the peers
+// that dialed in. Dialing it again would only make a second connection,
+// replacing the one in use if the node dialing wins the tie
+func (m *connManager) identify(target *dialTarget) {
+	for peerID, p := range m.fs.peerList() {
+		if addr := peerAddr(p); len(addr) > 0 && sameAddr(target, addr) {
+			target.peerID = peerID
+			return
+		}
+	}
+}
+
+// backoff doubles with every failed attempt up to the maximum, the
+// jitter spreads the retries of nodes that lost a peer at once
+func (m *connManager) backoff(attempts int) time.Duration {
+	d := m.fs.ReconnectBackoff
+	for i := 0; i < attempts && d < m.fs.MaxReconnectBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, m.fs.MaxReconnectBackoff)
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sameAddr tells whether a connection to remote was dialed on the
+// address of the target, ":3000" and "localhost:3000" both end up
+// as a connection to "127.0.0.1:3000"
+func sameAddr(target *dialTarget, remote string) bool {
+	if target.addr == remote {
+		return true
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", remote)
+	if err != nil || target.resolved == nil {
+		return false
+	}
+
+	if addr.Port != target.resolved.Port {
+		return false
+	}
+
+	local := func(ip net.IP) bool {
+		return ip == nil || ip.IsUnspecified() || ip.IsLoopback()
+	}
+
+	return addr.IP.Equal(target.resolved.IP) || local(addr.IP) && local(target.resolved.IP)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotEnoughReplicas is returned when fewer replicas than the
+// consistency level requires answered in time
+var ErrNotEnoughReplicas = errors.New("not enough replicas")
+
+// Consistency is how many of the replicas of a file have to take part
+// in a write before it succeeds
+type Consistency int
+
+const (
+	// ConsistencyQuorum needs a majority of the replicas, it is the default
+	ConsistencyQuorum Consistency = iota
+	ConsistencyOne
+	ConsistencyAll
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	default:
+		return fmt.Sprintf("consistency(%d)", int(c))
+	}
+}
+
+// required is how many of n replicas the level needs, n is the
+// replication factor or less when the cluster is smaller than that
+func (c Consistency) required(n int) int {
+	switch c {
+	case ConsistencyOne:
+		return min(1, n)
+	case ConsistencyAll:
+		return n
+	default:
+		return min(n, n/2+1)
+	}
+}
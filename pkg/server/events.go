@@ -0,0 +1,72 @@
+package server
+
+import (
+	"log"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind
+// before it starts missing them
+const eventBufferSize = 64
+
+type PeerEventType int
+
+const (
+	PeerConnected PeerEventType = iota + 1
+	PeerDisconnected
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerEvent tells about a peer joining or leaving the peer list
+type PeerEvent struct {
+	Type   PeerEventType
+	PeerID string
+	Peer   p2p.Peer
+}
+
+// Subscribe returns a channel receiving the peer events of the server
+// and the function to stop receiving them. Events are never waited
+// for, a subscriber too slow to keep up misses them
+func (fs *FileServer) Subscribe() (<-chan PeerEvent, func()) {
+	ch := make(chan PeerEvent, eventBufferSize)
+
+	fs.subscribersLock.Lock()
+	fs.subscribers[ch] = struct{}{}
+	fs.subscribersLock.Unlock()
+
+	unsubscribe := func() {
+		fs.subscribersLock.Lock()
+		defer fs.subscribersLock.Unlock()
+
+		if _, ok := fs.subscribers[ch]; ok {
+			delete(fs.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+func (fs *FileServer) publish(event PeerEvent) {
+	fs.subscribersLock.Lock()
+	defer fs.subscribersLock.Unlock()
+
+	for ch := range fs.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("[%s] subscriber missed %s event of peer (%s)\n", fs.Transport.Addr(), event.Type, event.PeerID)
+		}
+	}
+}
@@ -0,0 +1,526 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/crypto"
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/Yaroslaw07/difis/pkg/ring"
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
+
+const (
+	defaultHintTTL            = 3 * time.Hour
+	defaultMaxHints           = 1024
+	defaultHintReplayInterval = 10 * time.Second
+
+	// hintsFolderName is where the hints live in the storage root,
+	// no node ID starts with a dot
+	hintsFolderName = ".hints"
+)
+
+var (
+	ErrTooManyHints = errors.New("too many hints")
+	ErrInvalidHint  = errors.New("invalid hint")
+)
+
+type hintOp int
+
+const (
+	hintSave hintOp = iota + 1
+	hintDelete
+)
+
+func (op hintOp) String() string {
+	switch op {
+	case hintSave:
+		return "save"
+	case hintDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("hintOp(%d)", int(op))
+	}
+}
+
+// hint is a write a replica owner missed, a fallback node keeps it until
+// the owner is back. The file of a save is kept in the store like a replica
+type hint struct {
+	Target  PeerAddr
+	Owner   string
+	Key     string
+	Op      hintOp
+	Created time.Time
+}
+
+// hintStore keeps hints on disk, one file per target, owner and key,
+// so a newer write of a file replaces the hint of the older one
+type hintStore struct {
+	root string
+	lock sync.Mutex
+}
+
+func newHintStore(root string) *hintStore {
+	return &hintStore{root: root}
+}
+
+// path is where the hint is kept. The target, owner and key come from
+// peers, the key has to be a hashed key and the node IDs are hex encoded,
+// nodes without a handshake are known by their address. Nothing else makes
+// it into the path, so a hint can't be written outside of the hints folder
+func (s *hintStore) path(target, owner, key string) (string, error) {
+	if _, err := hex.DecodeString(key); err != nil || len(key) == 0 {
+		return "", fmt.Errorf("%w: (%q) is not a hashed key", ErrInvalidHint, key)
+	}
+
+	if len(target) == 0 || len(owner) == 0 {
+		return "", fmt.Errorf("%w: no target or owner", ErrInvalidHint)
+	}
+
+	return filepath.Join(s.root, hex.EncodeToString([]byte(target)), hex.EncodeToString([]byte(owner)), key+".json"), nil
+}
+
+// put stores the hint, failing when the target has limit hints already
+func (s *hintStore) put(h hint, limit int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path, err := s.path(h.Target.ID, h.Owner, h.Key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		hints, err := s.read(h.Target.ID)
+		if err != nil {
+			return err
+		}
+
+		if len(hints) >= limit {
+			return fmt.Errorf("%w: (%d) kept for (%s)", ErrTooManyHints, len(hints), h.Target.ID)
+		}
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (s *hintStore) list(target string) ([]hint, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.read(target)
+}
+
+func (s *hintStore) read(target string) ([]hint, error) {
+	hints := []hint{}
+
+	err := filepath.WalkDir(filepath.Join(s.root, hex.EncodeToString([]byte(target))), func(path string, d os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipAll
+		}
+
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var h hint
+		if err := json.Unmarshal(data, &h); err != nil {
+			return fmt.Errorf("reading hint %s: %w", path, err)
+		}
+
+		hints = append(hints, h)
+
+		return nil
+	})
+
+	return hints, err
+}
+
+// targets are the nodes hints are kept for
+func (s *hintStore) targets() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries, err := os.ReadDir(s.root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		target, err := hex.DecodeString(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		targets = append(targets, string(target))
+	}
+
+	return targets, nil
+}
+
+func (s *hintStore) remove(h hint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path, err := s.path(h.Target.ID, h.Owner, h.Key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// holds tells whether a hint still needs the file or the tombstone of the owner
+func (s *hintStore) holds(owner, key string) bool {
+	targets, err := s.targets()
+	if err != nil {
+		return true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, target := range targets {
+		path, err := s.path(target, owner, key)
+		if err != nil {
+			continue
+		}
+
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// missedNodes are the owners that didn't acknowledge a write
+func missedNodes(owners []ring.Node, acked []string) []ring.Node {
+	return slices.DeleteFunc(slices.Clone(owners), func(node ring.Node) bool {
+		return slices.Contains(acked, node.ID)
+	})
+}
+
+// fallbackPeers picks a node for every missed owner to keep its writes,
+// the reachable nodes following the owners of the file on the ring
+func (fs *FileServer) fallbackPeers(hash string, missed []ring.Node) (map[string]p2p.Peer, map[string]PeerAddr) {
+	var (
+		peers = make(map[string]p2p.Peer)
+		hints = make(map[string]PeerAddr)
+	)
+	if len(missed) == 0 {
+		return peers, hints
+	}
+
+	skip := map[string]bool{fs.ID: true}
+	for _, node := range fs.replicaOwners(fs.ID, hash) {
+		skip[node.ID] = true
+	}
+
+	candidates := fs.ring.Owners(replicaKey(fs.ID, hash), fs.ring.Len())
+	for _, target := range missed {
+		for len(candidates) > 0 {
+			node := candidates[0]
+			candidates = candidates[1:]
+
+			if skip[node.ID] {
+				continue
+			}
+
+			peer, err := fs.connect(node.ID, node.Addr)
+			if err != nil {
+				continue
+			}
+
+			peers[node.ID] = peer
+			hints[node.ID] = PeerAddr{ID: target.ID, Addr: target.Addr}
+			break
+		}
+	}
+
+	if len(peers) < len(missed) {
+		log.Printf("[%s] no fallback node for (%d) of (%d) replicas of file (%s)\n", fs.Transport.Addr(), len(missed)-len(peers), len(missed), hash)
+	}
+
+	return peers, hints
+}
+
+// handOff sends the file to fallback nodes for the owners that missed it
+func (fs *FileServer) handOff(key string, missed []ring.Node) {
+	peers, hints := fs.fallbackPeers(crypto.HashKey(key), missed)
+	if len(peers) == 0 {
+		return
+	}
+
+	meta, _, file, err := fs.snapshot(fs.ID, key)
+	if err != nil {
+		log.Printf("[%s] handing off file (%s) failed: %s\n", fs.Transport.Addr(), key, err)
+		return
+	}
+
+	if rc, ok := file.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	replicas, errs, err := fs.sendReplicas(key, meta, file, peers, nil, hints)
+	if err == nil {
+		err = fs.awaitReplicas(key, replicas, errs, len(peers), nil)
+	}
+
+	if err != nil {
+		log.Printf("[%s] handing off file (%s) failed: %s\n", fs.Transport.Addr(), key, err)
+		return
+	}
+
+	fmt.Printf("[%s] handed off file (%s) to (%d) fallback nodes\n", fs.Transport.Addr(), key, len(peers))
+}
+
+// handOffDelete sends the tombstone of the file to fallback nodes for the
+// owners that missed the delete
+func (fs *FileServer) handOffDelete(hash string, tombstone storage.Metadata, missed []ring.Node) {
+	peers, hints := fs.fallbackPeers(hash, missed)
+
+	for peerID, peer := range peers {
+		deleteMsg := newMessageDeleteFile(fs.ID, hash, tombstone)
+		deleteMsg.Hint = hints[peerID]
+
+		msg := MessageWrapper{
+			Type:    MessageTypeDelete,
+			Payload: deleteMsg,
+		}
+
+		if _, err := fs.request(peerID, peer, &msg); err != nil {
+			log.Printf("[%s] handing off delete of file (%s) to (%s) failed: %s\n", fs.Transport.Addr(), hash, peerID, err)
+		}
+	}
+}
+
+// keepHint stores a write for a replica owner that is down
+func (fs *FileServer) keepHint(target PeerAddr, owner, key string, op hintOp) error {
+	h := hint{
+		Target:  target,
+		Owner:   owner,
+		Key:     key,
+		Op:      op,
+		Created: time.Now(),
+	}
+
+	if err := fs.hints.put(h, fs.MaxHints); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] keeping %s of file (%s) for (%s)\n", fs.Transport.Addr(), op, key, target.ID)
+
+	return nil
+}
+
+// replayHints sends the kept writes to their owners when they connect,
+// and periodically for the owners reachable without connecting first
+func (fs *FileServer) replayHints(events <-chan PeerEvent, unsubscribe func()) {
+	defer unsubscribe()
+
+	ticker := time.NewTicker(fs.HintReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.Type == PeerConnected {
+				fs.replayHintsTo(event.PeerID)
+			}
+		case <-ticker.C:
+			targets, err := fs.hints.targets()
+			if err != nil {
+				log.Printf("[%s] listing hints failed: %s\n", fs.Transport.Addr(), err)
+			}
+
+			for _, target := range targets {
+				fs.replayHintsTo(target)
+			}
+		case <-fs.quitChannel:
+			return
+		}
+	}
+}
+
+// replayHintsTo sends the writes kept for the target, dropping those
+// older than HintTTL, anti-entropy has to repair them instead
+func (fs *FileServer) replayHintsTo(target string) {
+	hints, err := fs.hints.list(target)
+	if err != nil {
+		log.Printf("[%s] reading hints for (%s) failed: %s\n", fs.Transport.Addr(), target, err)
+		return
+	}
+
+	var peer p2p.Peer
+	for _, h := range hints {
+		if time.Since(h.Created) > fs.HintTTL {
+			log.Printf("[%s] %s of file (%s) for (%s) expired\n", fs.Transport.Addr(), h.Op, h.Key, target)
+			fs.dropHint(h)
+			continue
+		}
+
+		if peer == nil {
+			if peer, err = fs.connect(h.Target.ID, h.Target.Addr); err != nil {
+				return
+			}
+		}
+
+		resp, err := fs.replayHint(peer, h)
+		switch {
+		case err == nil:
+			fmt.Printf("[%s] replayed %s of file (%s) to (%s)\n", fs.Transport.Addr(), h.Op, h.Key, target)
+		case resp.Status == StatusError || resp.Status == StatusNotFound:
+			// asking again gets the same answer, like for a stale version
+			log.Printf("[%s] dropping %s of file (%s) for (%s): %s\n", fs.Transport.Addr(), h.Op, h.Key, target, err)
+		default:
+			log.Printf("[%s] replaying %s of file (%s) to (%s) failed: %s\n", fs.Transport.Addr(), h.Op, h.Key, target, err)
+			return
+		}
+
+		fs.dropHint(h)
+	}
+}
+
+func (fs *FileServer) replayHint(peer p2p.Peer, h hint) (MessageResponse, error) {
+	if h.Op == hintDelete {
+		// deletes kept for peers without tombstones have none
+		tombstone, err := fs.store.ReadMetadata(h.Owner, h.Key)
+		if err != nil {
+			return MessageResponse{}, err
+		}
+
+		if !tombstone.Deleted {
+			tombstone = storage.Metadata{}
+		}
+
+		msg := MessageWrapper{
+			Type:    MessageTypeDelete,
+			Payload: newMessageDeleteFile(h.Owner, h.Key, tombstone),
+		}
+
+		return fs.request(h.Target.ID, peer, &msg)
+	}
+
+	if !fs.store.Has(h.Owner, h.Key) {
+		return MessageResponse{Status: StatusNotFound}, fmt.Errorf("kept file (%s): %w", h.Key, ErrNotFound)
+	}
+
+	_, resp, err := fs.forward(h.Target.ID, peer, h.Owner, h.Key)
+
+	return resp, err
+}
+
+// forward sends a file this node holds for the owner to the peer, kept
+// encrypted the way the owner sent it, and returns how much was sent
+func (fs *FileServer) forward(peerID string, peer p2p.Peer, owner, key string) (int64, MessageResponse, error) {
+	meta, size, r, err := fs.snapshot(owner, key)
+	if err != nil {
+		return 0, MessageResponse{}, err
+	}
+
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	c := fs.newCall(peerID)
+	defer fs.finishCall(c)
+
+	msg := MessageWrapper{
+		Type:      MessageTypeSave,
+		RequestID: c.id,
+		Payload: MessageSaveFile{
+			Message: Message{ID: owner, Key: key},
+			Size:    size,
+			Meta:    meta,
+		},
+	}
+
+	payload, err := encodeFor(peer, &msg)
+	if err != nil {
+		return 0, MessageResponse{}, err
+	}
+
+	stream, err := peer.OpenStream(payload)
+	if err != nil {
+		return 0, MessageResponse{}, err
+	}
+
+	if _, err := io.Copy(stream, r); err != nil {
+		stream.Reset()
+		return 0, MessageResponse{}, err
+	}
+	stream.Close()
+
+	resp, err := fs.awaitTimeout(c, fs.WriteTimeout)
+
+	return size, resp, err
+}
+
+func (fs *FileServer) dropHint(h hint) {
+	if err := fs.hints.remove(h); err != nil {
+		log.Printf("[%s] removing hint for file (%s) failed: %s\n", fs.Transport.Addr(), h.Key, err)
+		return
+	}
+
+	fs.dropHintedFile(h.Owner, h.Key)
+}
+
+// dropHintedFile deletes a file or tombstone kept for other nodes once no
+// hint needs it anymore, unless the ring puts its replica here anyway
+func (fs *FileServer) dropHintedFile(owner, key string) {
+	if fs.ownsReplica(owner, key) || fs.hints.holds(owner, key) {
+		return
+	}
+
+	unlock := fs.writes.acquire(owner, key)
+	defer unlock()
+
+	meta, err := fs.store.ReadMetadata(owner, key)
+	if err != nil || (!meta.Deleted && !fs.store.Has(owner, key)) {
+		return
+	}
+
+	fs.dht.Unprovide(replicaKey(owner, key))
+
+	if err := fs.store.Delete(owner, key); err != nil {
+		log.Printf("[%s] deleting kept file (%s) failed: %s\n", fs.Transport.Addr(), key, err)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+const (
+	defaultHeartbeatInterval = 5 * time.Second
+	// rttSmoothing is the weight of a new sample in the smoothed RTT
+	rttSmoothing = 0.125
+)
+
+// PeerStats tells how a connected peer is doing
+type PeerStats struct {
+	PeerID   string
+	Addr     string
+	Outbound bool
+	// ConnectedAt is when the current connection was accepted
+	ConnectedAt time.Time
+	// LastSeen is when anything was last received from the peer
+	LastSeen time.Time
+	// RTT is the smoothed round trip time, LastRTT the latest sample
+	RTT     time.Duration
+	LastRTT time.Duration
+	// MissedPings counts the pings in a row the peer didn't answer
+	MissedPings int
+}
+
+// peerStats is kept under peerLock next to the peer it belongs to
+type peerStats struct {
+	connectedAt time.Time
+	rtt         time.Duration
+	lastRTT     time.Duration
+	missedPings int
+}
+
+// PeerStats returns the statistics of the connected peers ordered by peer ID
+func (fs *FileServer) PeerStats() []PeerStats {
+	fs.peerLock.Lock()
+	defer fs.peerLock.Unlock()
+
+	stats := make([]PeerStats, 0, len(fs.peers))
+	for peerID, peer := range fs.peers {
+		s := PeerStats{
+			PeerID:   peerID,
+			Addr:     peer.RemoteAddr().String(),
+			Outbound: peer.Outbound(),
+			LastSeen: peer.LastSeen(),
+		}
+
+		if st, ok := fs.stats[peerID]; ok {
+			s.ConnectedAt = st.connectedAt
+			s.RTT = st.rtt
+			s.LastRTT = st.lastRTT
+			s.MissedPings = st.missedPings
+		}
+
+		stats = append(stats, s)
+	}
+
+	slices.SortFunc(stats, func(a, b PeerStats) int {
+		return strings.Compare(a.PeerID, b.PeerID)
+	})
+
+	return stats
+}
+
+// heartbeat pings every peer each interval and evicts the ones
+// nothing was received from for longer than the peer timeout,
+// which catches connections the other side silently lost
+func (fs *FileServer) heartbeat() {
+	ticker := time.NewTicker(fs.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for peerID, peer := range fs.peerList() {
+				wg.Add(1)
+				go func(peerID string, peer p2p.Peer) {
+					defer wg.Done()
+					fs.ping(peerID, peer)
+				}(peerID, peer)
+			}
+			wg.Wait()
+		case <-fs.quitChannel:
+			return
+		}
+	}
+}
+
+func (fs *FileServer) ping(peerID string, peer p2p.Peer) {
+	rtt, err := peer.Ping(fs.HeartbeatInterval)
+
+	fs.peerLock.Lock()
+	st, ok := fs.stats[peerID]
+	if ok && fs.peers[peerID] == peer {
+		if err != nil {
+			st.missedPings++
+		} else {
+			st.missedPings = 0
+			st.lastRTT = rtt
+			if st.rtt == 0 {
+				st.rtt = rtt
+			} else {
+				st.rtt += time.Duration(rttSmoothing * float64(rtt-st.rtt))
+			}
+		}
+	}
+	fs.peerLock.Unlock()
+
+	if silence := time.Since(peer.LastSeen()); silence > fs.PeerTimeout {
+		fmt.Printf("[%s] evicting peer (%s), nothing received for %s\n", fs.Transport.Addr(), peerID, silence.Round(time.Millisecond))
+
+		// the transport reports the closed peer as disconnected
+		peer.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
+
+// Versions returns the versions of a file this node keeps, the current
+// one first and then the prior ones, newest first. Prior versions are
+// only kept with KeepVersions or VersionRetention set
+func (fs *FileServer) Versions(key string) ([]storage.Metadata, error) {
+	current, err := fs.store.ReadMetadata(fs.ID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	prior, err := fs.store.Versions(fs.ID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []storage.Metadata{}
+	if fs.store.Has(fs.ID, key) && current.Version > 0 {
+		versions = append(versions, current)
+	}
+
+	return append(versions, prior...), nil
+}
+
+// LoadVersion returns the version of a file, the current one or one of
+// the prior versions this node keeps
+func (fs *FileServer) LoadVersion(key string, version uint64) (io.Reader, error) {
+	current, err := fs.store.ReadMetadata(fs.ID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if current.Version == version && fs.store.Has(fs.ID, key) {
+		_, r, err := fs.store.Read(fs.ID, key)
+		return r, err
+	}
+
+	_, r, err := fs.store.ReadVersion(fs.ID, key, version)
+	if errors.Is(err, storage.ErrVersionNotFound) {
+		return nil, fmt.Errorf("[%s] file (%s) version (%d): %w", fs.Transport.Addr(), key, version, ErrNotFound)
+	}
+
+	return r, err
+}
+
+// Restore saves a prior version of a file as its next version with the
+// content type and tags it had, the current one is kept as a prior
+// version in turn
+func (fs *FileServer) Restore(key string, version uint64) error {
+	versions, err := fs.Versions(key)
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(versions, func(meta storage.Metadata) bool { return meta.Version == version })
+	if i < 0 {
+		return fmt.Errorf("[%s] file (%s) version (%d): %w", fs.Transport.Addr(), key, version, ErrNotFound)
+	}
+
+	r, err := fs.LoadVersion(key, version)
+	if err != nil {
+		return err
+	}
+
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	fmt.Printf("[%s] restoring version (%d) of file (%s)\n", fs.Transport.Addr(), version, key)
+
+	return fs.SaveWithOptions(key, r, SaveOptions{ContentType: versions[i].ContentType, Tags: versions[i].Tags})
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Yaroslaw07/difis/pkg/crypto"
+	"github.com/Yaroslaw07/difis/pkg/ring"
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
+
+// maxListLimit bounds how many files a node lists in one answer,
+// the answer has to fit in a frame
+const maxListLimit = 1000
+
+// MessageListFiles asks a node for a page of the replicas it holds for the
+// owner, named with the prefix and after the cursor, tombstones included
+type MessageListFiles struct {
+	Message
+	Prefix string
+	Cursor string
+	Limit  int
+}
+
+// listSource is the page of files one node answered with
+type listSource struct {
+	entries []storage.Entry
+	full    bool
+}
+
+// List returns a page of the files this node saved with the prefix,
+// ordered by key and starting after the cursor, and the cursor of the next
+// page, empty on the last one. The local copies are merged with the replicas
+// the other nodes of the ring hold, so the files this node lost are listed
+// too. Every node answers with a page of its own, they are merged up to the
+// first file one of them may not have answered with yet
+func (fs *FileServer) List(prefix, cursor string, limit int) ([]storage.Entry, string, error) {
+	batch := maxListLimit
+	if limit > 0 && limit < batch {
+		batch = limit
+	}
+
+	page := []storage.Entry{}
+	for {
+		sources, err := fs.listSources(prefix, cursor, batch)
+		if err != nil {
+			return nil, "", err
+		}
+
+		entries, bound := mergeSources(sources)
+		for _, entry := range entries {
+			if limit > 0 && len(page) == limit {
+				return page, page[len(page)-1].Key, nil
+			}
+
+			page = append(page, entry)
+		}
+
+		if bound == "" {
+			return page, "", nil
+		}
+
+		cursor = bound
+	}
+}
+
+// listSources asks this node and the other nodes of the ring for a page
+// of the files of this node
+func (fs *FileServer) listSources(prefix, cursor string, limit int) ([]listSource, error) {
+	local, _, err := fs.store.Scan(fs.ID, prefix, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []listSource{{entries: local, full: len(local) == limit}}
+
+	var (
+		errs  = []error{}
+		asked = 0
+	)
+	for _, node := range fs.ring.Nodes() {
+		if node.ID == fs.ID {
+			continue
+		}
+
+		asked++
+		entries, err := fs.listReplicas(node, prefix, cursor, limit)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("peer (%s): %w", node.ID, err))
+			continue
+		}
+
+		sources = append(sources, listSource{entries: entries, full: len(entries) == limit})
+	}
+
+	if len(sources) == 1 && asked > 0 {
+		return nil, fmt.Errorf("[%s] listing files: %w", fs.Transport.Addr(), errors.Join(errs...))
+	}
+
+	return sources, nil
+}
+
+// mergeSources merges the pages of the nodes into the newest version of
+// every file, ordered by key and with the deleted files left out. Only the
+// files up to the last one of the shortest full page are merged, a node
+// may hold a version of the ones after it it didn't answer with yet. The
+// bound returned is where the next pages start, empty if there are none
+func mergeSources(sources []listSource) ([]storage.Entry, string) {
+	bound := ""
+	for _, source := range sources {
+		if !source.full {
+			continue
+		}
+
+		last := source.entries[len(source.entries)-1].IndexName()
+		if bound == "" || last < bound {
+			bound = last
+		}
+	}
+
+	// the newest version of every file by the hash of its key, replicas
+	// written without the key can't be listed
+	newest := make(map[string]storage.Entry)
+	for i, source := range sources {
+		for _, entry := range source.entries {
+			name := entry.IndexName()
+			if bound != "" && name > bound {
+				break
+			}
+
+			if entry.Name == "" && i > 0 {
+				continue
+			}
+
+			hash := crypto.HashKey(name)
+			if current, ok := newest[hash]; ok && !entry.Newer(current.Metadata) {
+				continue
+			}
+
+			newest[hash] = storage.Entry{Key: name, Metadata: entry.Metadata}
+		}
+	}
+
+	entries := []storage.Entry{}
+	for _, entry := range newest {
+		if !entry.Deleted {
+			entries = append(entries, entry)
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b storage.Entry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return entries, bound
+}
+
+// listReplicas returns a page of the replicas the node holds for this
+// one, peers without listing hold none it can tell
+func (fs *FileServer) listReplicas(node ring.Node, prefix, cursor string, limit int) ([]storage.Entry, error) {
+	peer, err := fs.connect(node.ID, node.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := MessageWrapper{
+		Type: MessageTypeList,
+		Payload: MessageListFiles{
+			Message: Message{ID: fs.ID},
+			Prefix:  prefix,
+			Cursor:  cursor,
+			Limit:   limit,
+		},
+	}
+
+	resp, err := fs.request(node.ID, peer, &msg)
+	if errors.Is(err, ErrUnsupported) {
+		return nil, nil
+	}
+
+	return resp.Entries, err
+}
+
+func (fs *FileServer) handleMessageListFiles(from string, requestID uint64, msg MessageListFiles) error {
+	limit := msg.Limit
+	if limit <= 0 || limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	entries, _, err := fs.store.Scan(msg.ID, msg.Prefix, msg.Cursor, limit)
+	if err != nil {
+		return fs.replyError(from, requestID, err)
+	}
+
+	return fs.reply(from, requestID, MessageResponse{Status: StatusAck, Entries: entries})
+}
@@ -1,9 +1,17 @@
 package server
 
-import "io"
+import (
+	"io"
+
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
 
 func (fs *FileServer) SaveLocally(key string, r io.Reader) error {
-	_, err := fs.store.Write(fs.ID, key, r)
+	_, file, err := fs.writeLocal(key, r, SaveOptions{})
+	if rc, ok := file.(io.ReadCloser); ok {
+		rc.Close()
+	}
+
 	return err
 }
 
@@ -15,3 +23,7 @@ func (fs *FileServer) LoadLocally(key string) (int64, io.Reader, error) {
 func (fs *FileServer) DeleteLocally(key string) error {
 	return fs.store.Delete(fs.ID, key)
 }
+
+func (fs *FileServer) ListLocally(prefix, cursor string, limit int) ([]storage.Entry, string, error) {
+	return fs.store.Keys(fs.ID, prefix, cursor, limit)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/Yaroslaw07/difis/pkg/membership"
+)
+
+// MessageMembership carries a message of the failure detector
+type MessageMembership struct {
+	Data []byte
+}
+
+// Members returns the membership view of the cluster, this node included
+func (fs *FileServer) Members() []membership.Member {
+	return fs.members.Members()
+}
+
+// SubscribeMembers returns a channel receiving the membership changes
+// and the function to stop receiving them
+func (fs *FileServer) SubscribeMembers() (<-chan membership.Event, func()) {
+	return fs.members.Subscribe()
+}
+
+func (fs *FileServer) sendMembership(to string, data []byte) error {
+	peer, ok := fs.peer(to)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", to)
+	}
+
+	msg := MessageWrapper{
+		Type:    MessageTypeMembership,
+		Payload: MessageMembership{Data: data},
+	}
+
+	payload, err := encodeFor(peer, &msg)
+	if err != nil {
+		return err
+	}
+
+	return peer.Send(payload)
+}
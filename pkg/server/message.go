@@ -1,11 +1,13 @@
 package server
 
 import (
-	"encoding/binary"
+	"compress/flate"
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/Yaroslaw07/difis/pkg/storage"
 )
 
 type MessageType int
@@ -15,11 +17,42 @@ const (
 	MessageTypeSave
 	MessageTypeLoad
 	MessageTypeDelete
+	MessageTypeResponse
+	MessageTypePeerExchange
+	MessageTypeMembership
+	MessageTypeFindNode
+	MessageTypeFindValue
+	MessageTypeStat
+	MessageTypeSyncTree
+	MessageTypeSiblings
+	MessageTypeList
+	MessageTypeProvide
 )
 
+// messageTypes are all the messages this node is able to handle
+var messageTypes = []MessageType{
+	MessageTypeSave,
+	MessageTypeLoad,
+	MessageTypeDelete,
+	MessageTypeResponse,
+	MessageTypePeerExchange,
+	MessageTypeMembership,
+	MessageTypeFindNode,
+	MessageTypeFindValue,
+	MessageTypeStat,
+	MessageTypeSyncTree,
+	MessageTypeSiblings,
+	MessageTypeList,
+	MessageTypeProvide,
+}
+
 type MessageWrapper struct {
 	Payload any
 	Type    MessageType
+	// RequestID correlates a response with the request it answers
+	RequestID uint64
+	// Version is the protocol version the message was written in
+	Version uint16
 }
 
 type Message struct {
@@ -29,6 +62,11 @@ type Message struct {
 
 type MessageLoadFile struct {
 	Message
+	// Compressed asks for the file to be sent compressed
+	Compressed bool
+	// Sibling asks for the sibling of the file with that version
+	// instead of the file, peers without siblings send the file
+	Sibling uint64
 }
 
 func newMessageLoadFile(id, key string) MessageLoadFile {
@@ -43,6 +81,13 @@ func newMessageLoadFile(id, key string) MessageLoadFile {
 type MessageSaveFile struct {
 	Message
 	Size int64
+	// Compressed is set when the file data on the stream is compressed
+	Compressed bool
+	// Meta is the version of the file being saved
+	Meta storage.Metadata
+	// Hint is the replica owner the file is kept for, when the
+	// node is only a fallback for an owner that is down
+	Hint PeerAddr
 }
 
 const AESBlockSize = 16
@@ -57,91 +102,288 @@ func newMessageSaveFile(id, key string, size int64) MessageSaveFile {
 	}
 }
 
+// MessageStatFile asks for the version of a file a node holds
+type MessageStatFile struct {
+	Message
+}
+
 type MessageDeleteFile struct {
 	Message
+	// Meta is the tombstone that replaces the file, peers
+	// without tombstones send none and delete it outright
+	Meta storage.Metadata
+	// Hint is the replica owner the delete is kept for, like in MessageSaveFile
+	Hint PeerAddr
 }
 
-func newMessageDeleteFile(id, key string) MessageDeleteFile {
+func newMessageDeleteFile(id, key string, tombstone storage.Metadata) MessageDeleteFile {
 	return MessageDeleteFile{
 		Message: Message{
 			ID:  id,
 			Key: key,
 		},
+		Meta: tombstone,
 	}
 }
 
-func (fs *FileServer) handleMessage(from string, msg *MessageWrapper) error {
+type ResponseStatus int
+
+const (
+	StatusAck ResponseStatus = iota + 1
+	StatusFound
+	StatusNotFound
+	StatusError
+)
+
+type MessageResponse struct {
+	Status ResponseStatus
+	// Size of the stored or served file, if any
+	Size  int64
+	Error string
+	// Peers are the contacts a DHT lookup is answered with
+	Peers []PeerAddr
+	// Meta is the version of the file, if any
+	Meta storage.Metadata
+	// Buckets are the ranges of keys two Merkle trees differ in,
+	// Entries the files a node holds in them
+	Buckets []int
+	Entries []storage.Entry
+}
+
+// Err turns a failed response into an error
+func (r MessageResponse) Err() error {
+	switch r.Status {
+	case StatusAck, StatusFound:
+		return nil
+	case StatusNotFound:
+		return ErrNotFound
+	case StatusError:
+		return errors.New(r.Error)
+	default:
+		return fmt.Errorf("unknown response status: %d", r.Status)
+	}
+}
+
+func (fs *FileServer) handleMessage(from string, msg *MessageWrapper, stream p2p.Stream) error {
 	switch v := msg.Type; v {
 	case MessageTypeSave:
-		if storeMsg, ok := msg.Payload.(MessageSaveFile); ok {
-			return fs.handleMessageStoreFile(from, storeMsg)
+		if storeMsg, ok := msg.Payload.(MessageSaveFile); ok && stream != nil {
+			return fs.handleMessageStoreFile(from, msg.RequestID, storeMsg, stream)
 		}
 
-		return fmt.Errorf("message type store but payload is not of type MessageStoreFile")
+		return fmt.Errorf("message type store but payload is not of type MessageStoreFile or came without stream")
 	case MessageTypeLoad:
-		if getMsg, ok := msg.Payload.(MessageLoadFile); ok {
-			return fs.handleMessageLoadFile(from, getMsg)
+		if getMsg, ok := msg.Payload.(MessageLoadFile); ok && stream != nil {
+			return fs.handleMessageLoadFile(from, msg.RequestID, getMsg, stream)
 		}
 
-		return fmt.Errorf("message type get but payload is not of type MessageGetFile")
+		return fmt.Errorf("message type get but payload is not of type MessageGetFile or came without stream")
 	case MessageTypeDelete:
 		if deleteMsg, ok := msg.Payload.(MessageDeleteFile); ok {
-			return fs.handleMessageDeleteFile(from, deleteMsg)
+			return fs.handleMessageDeleteFile(from, msg.RequestID, deleteMsg)
+		}
+
+		return fmt.Errorf("message type delete but payload is not of type MessageDeleteFile")
+	case MessageTypePeerExchange:
+		if pexMsg, ok := msg.Payload.(MessagePeerExchange); ok {
+			return fs.handleMessagePeerExchange(from, pexMsg)
+		}
+
+		return fmt.Errorf("message type peer exchange but payload is not of type MessagePeerExchange")
+	case MessageTypeMembership:
+		if membershipMsg, ok := msg.Payload.(MessageMembership); ok {
+			return fs.members.HandleMessage(from, membershipMsg.Data)
+		}
+
+		return fmt.Errorf("message type membership but payload is not of type MessageMembership")
+	case MessageTypeStat:
+		if statMsg, ok := msg.Payload.(MessageStatFile); ok {
+			return fs.handleMessageStatFile(from, msg.RequestID, statMsg)
+		}
+
+		return fmt.Errorf("message type stat but payload is not of type MessageStatFile")
+	case MessageTypeSyncTree:
+		if syncMsg, ok := msg.Payload.(MessageSyncTree); ok {
+			return fs.handleMessageSyncTree(from, msg.RequestID, syncMsg)
 		}
+
+		return fmt.Errorf("message type sync tree but payload is not of type MessageSyncTree")
+	case MessageTypeSiblings:
+		if siblingsMsg, ok := msg.Payload.(MessageSiblings); ok {
+			return fs.handleMessageSiblings(from, msg.RequestID, siblingsMsg)
+		}
+
+		return fmt.Errorf("message type siblings but payload is not of type MessageSiblings")
+	case MessageTypeList:
+		if listMsg, ok := msg.Payload.(MessageListFiles); ok {
+			return fs.handleMessageListFiles(from, msg.RequestID, listMsg)
+		}
+
+		return fmt.Errorf("message type list but payload is not of type MessageListFiles")
+	case MessageTypeFindNode:
+		if findMsg, ok := msg.Payload.(MessageFindNode); ok {
+			return fs.handleMessageFindNode(from, msg.RequestID, findMsg)
+		}
+
+		return fmt.Errorf("message type find node but payload is not of type MessageFindNode")
+	case MessageTypeFindValue:
+		if findMsg, ok := msg.Payload.(MessageFindValue); ok {
+			return fs.handleMessageFindValue(from, msg.RequestID, findMsg)
+		}
+
+		return fmt.Errorf("message type find value but payload is not of type MessageFindValue")
+	case MessageTypeProvide:
+		if provideMsg, ok := msg.Payload.(MessageProvide); ok {
+			return fs.handleMessageProvide(from, msg.RequestID, provideMsg)
+		}
+
+		return fmt.Errorf("message type provide but payload is not of type MessageProvide")
+	case MessageTypeResponse:
+		if resp, ok := msg.Payload.(MessageResponse); ok {
+			return fs.handleMessageResponse(from, msg.RequestID, resp)
+		}
+
+		return fmt.Errorf("message type response but payload is not of type MessageResponse")
 	default:
 		return fmt.Errorf("unknown message type: %d", v)
 	}
-
-	return nil
 }
 
-func (fs *FileServer) handleMessageStoreFile(from string, msg MessageSaveFile) error {
-	peer, ok := fs.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+func (fs *FileServer) handleMessageStoreFile(from string, requestID uint64, msg MessageSaveFile, stream p2p.Stream) error {
+	defer stream.Close()
+
+	var r io.Reader = stream
+	if msg.Compressed {
+		r = flate.NewReader(stream)
 	}
+	r = io.LimitReader(r, msg.Size)
 
-	n, err := fs.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	n, sibling, err := fs.writeReplica(msg, r)
 	if err != nil {
-		return err
+		stream.Reset()
+		return fs.replyError(from, requestID, err)
+	}
+
+	if sibling {
+		return fs.reply(from, requestID, MessageResponse{Status: StatusAck, Size: n})
 	}
 
 	fmt.Printf("[%s] written %d bytes to disk\n", fs.Transport.Addr(), n)
 
-	peer.CloseStream()
+	if !msg.Meta.Deleted {
+		go fs.provide(msg.ID, msg.Key)
+	}
 
-	return nil
+	if len(msg.Hint.ID) > 0 {
+		if err := fs.keepHint(msg.Hint, msg.ID, msg.Key, hintSave); err != nil {
+			fs.dropHintedFile(msg.ID, msg.Key)
+			return fs.replyError(from, requestID, err)
+		}
+	}
+
+	return fs.reply(from, requestID, MessageResponse{Status: StatusAck, Size: n})
 }
 
-func (fs *FileServer) handleMessageLoadFile(from string, msg MessageLoadFile) error {
-	if !fs.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve but file (%s) doesn't exist on disk", fs.Transport.Addr(), msg.Key)
+// writeReplica stores the replica unless the stored version is newer, it
+// tells whether the replica was kept as a sibling instead. The file stays
+// locked from the version check to the metadata write, so the replica can't
+// be replaced by another peer in between
+func (fs *FileServer) writeReplica(msg MessageSaveFile, r io.Reader) (int64, bool, error) {
+	unlock := fs.writes.acquire(msg.ID, msg.Key)
+	defer unlock()
+
+	// a late write, like a repair racing a save, must not replace a newer
+	// version of the file. One written concurrently with the stored version
+	// is up to the conflict resolver, the losing version may be kept
+	if current, err := fs.store.ReadMetadata(msg.ID, msg.Key); err == nil && msg.Meta.Version > 0 {
+		stale := current.Newer(msg.Meta)
+
+		if current.Concurrent(msg.Meta) {
+			replace, keep := fs.ConflictResolver(current, msg.Meta)
+			stale = !replace
+
+			switch {
+			case keep && !replace:
+				n, err := fs.storeSibling(msg, r)
+				return n, true, err
+			case keep && !current.Deleted:
+				if err := fs.keepCurrentSibling(msg.ID, msg.Key, current); err != nil {
+					return 0, false, err
+				}
+			}
+		}
+
+		if stale {
+			return 0, false, fmt.Errorf("[%s] file (%s) version (%d) is older than the stored (%d): %w", fs.Transport.Addr(), msg.Key, msg.Meta.Version, current.Version, ErrStaleVersion)
+		}
+	}
+
+	n, err := fs.store.Write(msg.ID, msg.Key, r)
+	if err != nil {
+		return n, false, err
+	}
+
+	if err := fs.store.WriteMetadata(msg.ID, msg.Key, msg.Meta); err != nil {
+		return n, false, err
 	}
 
-	fmt.Printf("[%s] got file (%s) that serving over the network\n", fs.Transport.Addr(), msg.Key)
+	fs.dropSiblings(msg.ID, msg.Key, msg.Meta)
+
+	return n, false, nil
+}
+
+func (fs *FileServer) handleMessageLoadFile(from string, requestID uint64, msg MessageLoadFile, stream p2p.Stream) error {
+	defer stream.Close()
+
+	store, key := fs.store, msg.Key
+	if msg.Sibling > 0 {
+		store, key = fs.siblings, siblingKey(msg.Key, msg.Sibling)
+	}
+
+	if !store.Has(msg.ID, key) {
+		return fs.replyError(from, requestID, fmt.Errorf("[%s] need to serve but file (%s) doesn't exist on disk: %w", fs.Transport.Addr(), key, ErrNotFound))
+	}
+
+	fmt.Printf("[%s] got file (%s) that serving over the network\n", fs.Transport.Addr(), key)
+
+	var (
+		meta     storage.Metadata
+		fileSize int64
+		r        io.Reader
+		err      error
+	)
+	if msg.Sibling > 0 {
+		// a sibling is never written over, only dropped
+		if meta, err = store.ReadMetadata(msg.ID, key); err == nil {
+			fileSize, r, err = store.Read(msg.ID, key)
+		}
+	} else {
+		meta, fileSize, r, err = fs.snapshot(msg.ID, key)
+	}
 
-	fileSize, r, err := fs.store.Read(msg.ID, msg.Key)
 	if err != nil {
-		return err
+		return fs.replyError(from, requestID, err)
 	}
 
 	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("closing read closer")
 		defer rc.Close()
 	}
 
-	peer, ok := fs.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+	// First announce the file size, then the file follows on the stream
+	if err := fs.reply(from, requestID, MessageResponse{Status: StatusFound, Size: fileSize, Meta: meta}); err != nil {
+		return err
 	}
 
-	// First send the "incomingStream" byte to the peer
-	// Then we can send the file size (int64)
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
+	var w io.Writer = stream
+	if msg.Compressed {
+		compressor, _ := flate.NewWriter(stream, flate.DefaultCompression)
+		defer compressor.Close()
+		w = compressor
+	}
 
-	n, err := io.Copy(peer, r)
+	n, err := io.Copy(w, r)
 	if err != nil {
+		stream.Reset()
 		return err
 	}
 
@@ -150,23 +392,62 @@ func (fs *FileServer) handleMessageLoadFile(from string, msg MessageLoadFile) er
 	return nil
 }
 
-func (fs *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
-	fmt.Printf("here")
-	_, ok := fs.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+func (fs *FileServer) handleMessageStatFile(from string, requestID uint64, msg MessageStatFile) error {
+	meta, err := fs.store.ReadMetadata(msg.ID, msg.Key)
+	if err != nil {
+		return fs.replyError(from, requestID, err)
+	}
+
+	// a tombstone is found too, the delete is the newest version of the file
+	if !meta.Deleted && !fs.store.Has(msg.ID, msg.Key) {
+		return fs.replyError(from, requestID, fmt.Errorf("[%s] need to stat but file (%s) doesn't exist on disk: %w", fs.Transport.Addr(), msg.Key, ErrNotFound))
+	}
+
+	return fs.reply(from, requestID, MessageResponse{Status: StatusFound, Meta: meta})
+}
+
+func (fs *FileServer) handleMessageDeleteFile(from string, requestID uint64, msg MessageDeleteFile) error {
+	tombstone := msg.Meta.Version > 0
+
+	unlock := fs.writes.acquire(msg.ID, msg.Key)
+	defer unlock()
+
+	if tombstone {
+		// like a late write, a late delete must not replace a newer version
+		if current, err := fs.store.ReadMetadata(msg.ID, msg.Key); err == nil && current.Newer(msg.Meta) {
+			return fs.replyError(from, requestID, fmt.Errorf("[%s] file (%s) tombstone (%d) is older than the stored (%d): %w", fs.Transport.Addr(), msg.Key, msg.Meta.Version, current.Version, ErrStaleVersion))
+		}
+
+		if err := fs.store.WriteTombstone(msg.ID, msg.Key, msg.Meta); err != nil {
+			return fs.replyError(from, requestID, err)
+		}
+
+		fs.dropSiblings(msg.ID, msg.Key, msg.Meta)
+
+		fmt.Printf("[%s] deleted file (%s) version (%d) from disk\n", fs.Transport.Addr(), msg.Key, msg.Meta.Version)
+	}
+
+	if len(msg.Hint.ID) > 0 {
+		if err := fs.keepHint(msg.Hint, msg.ID, msg.Key, hintDelete); err != nil {
+			return fs.replyError(from, requestID, err)
+		}
+
+		return fs.reply(from, requestID, MessageResponse{Status: StatusAck})
+	}
+
+	if tombstone {
+		return fs.reply(from, requestID, MessageResponse{Status: StatusAck})
 	}
 
 	if !fs.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to delete but file (%s) doesn't exist on disk", fs.Transport.Addr(), msg.Key)
+		return fs.replyError(from, requestID, fmt.Errorf("[%s] need to delete but file (%s) doesn't exist on disk: %w", fs.Transport.Addr(), msg.Key, ErrNotFound))
 	}
 
 	if err := fs.store.Delete(msg.ID, msg.Key); err != nil {
-		return err
+		return fs.replyError(from, requestID, err)
 	}
 
 	fmt.Printf("[%s] deleted file (%s) from disk\n", fs.Transport.Addr(), msg.Key)
 
-	return nil
-
+	return fs.reply(from, requestID, MessageResponse{Status: StatusAck})
 }
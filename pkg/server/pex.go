@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+const defaultPeerExchangeInterval = 10 * time.Second
+
+// PeerAddr is a node and the address it can be dialed on
+type PeerAddr struct {
+	ID   string
+	Addr string
+}
+
+// MessagePeerExchange shares the peers a node is connected to
+type MessagePeerExchange struct {
+	Peers []PeerAddr
+}
+
+// peerExchange shares the peer list with every peer periodically. A new
+// peer gets the list right away and the other peers learn about it,
+// so nodes find each other from a single seed
+func (fs *FileServer) peerExchange(events <-chan PeerEvent, unsubscribe func()) {
+	defer unsubscribe()
+
+	ticker := time.NewTicker(fs.PeerExchangeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.Type == PeerConnected {
+				fs.sendPeers(event.PeerID, event.Peer)
+				fs.announcePeer(event.PeerID, event.Peer)
+			}
+		case <-ticker.C:
+			for peerID, peer := range fs.peerList() {
+				fs.sendPeers(peerID, peer)
+			}
+		case <-fs.quitChannel:
+			return
+		}
+	}
+}
+
+func (fs *FileServer) sendPeers(to string, peer p2p.Peer) {
+	peers := []PeerAddr{}
+	for peerID, p := range fs.peerList() {
+		if addr := peerAddr(p); peerID != to && len(addr) > 0 {
+			peers = append(peers, PeerAddr{ID: peerID, Addr: addr})
+		}
+	}
+
+	fs.sendPeerAddrs(to, peer, peers)
+}
+
+// announcePeer tells the other peers about a node that dialed in, the
+// peers this node dialed itself were learned from somebody who knows them
+func (fs *FileServer) announcePeer(peerID string, peer p2p.Peer) {
+	addr := peerAddr(peer)
+	if peer.Outbound() || len(addr) == 0 {
+		return
+	}
+
+	for to, p := range fs.peerList() {
+		if to != peerID {
+			fs.sendPeerAddrs(to, p, []PeerAddr{{ID: peerID, Addr: addr}})
+		}
+	}
+}
+
+func (fs *FileServer) sendPeerAddrs(to string, peer p2p.Peer, peers []PeerAddr) {
+	msg := MessageWrapper{
+		Type:    MessageTypePeerExchange,
+		Payload: MessagePeerExchange{Peers: peers},
+	}
+
+	payload, err := encodeFor(peer, &msg)
+	if errors.Is(err, ErrUnsupported) {
+		return
+	}
+
+	if err == nil {
+		err = peer.Send(payload)
+	}
+
+	if err != nil {
+		log.Printf("[%s] sending peers to (%s) failed: %s\n", fs.Transport.Addr(), to, err)
+	}
+}
+
+// handleMessagePeerExchange dials the shared peers the node isn't
+// connected to yet, as long as it has fewer than TargetPeers. Two nodes
+// often learn about each other at once, the one with the higher ID gives
+// the other a head start so they don't both dial and connect twice
+func (fs *FileServer) handleMessagePeerExchange(from string, msg MessagePeerExchange) error {
+	for _, p := range msg.Peers {
+		if p.ID == fs.ID || len(p.Addr) == 0 {
+			continue
+		}
+
+		if _, ok := fs.peer(p.ID); ok {
+			continue
+		}
+
+		if fs.TargetPeers > 0 && len(fs.peerList())+fs.conns.pending() >= fs.TargetPeers {
+			return nil
+		}
+
+		var wait time.Duration
+		if p.ID < fs.ID {
+			wait = fs.ReconnectBackoff
+		}
+
+		if fs.conns.add(p.ID, p.Addr, wait) {
+			log.Printf("[%s] learned about peer (%s) at %s from (%s)\n", fs.Transport.Addr(), p.ID, p.Addr, from)
+		}
+	}
+
+	return nil
+}
+
+// peerAddr is the address the peer can be dialed on, empty if unknown.
+// A peer listening on all interfaces, like ":3000", is reachable on the
+// host its connection came from
+func peerAddr(p p2p.Peer) string {
+	listenAddr := p.Info().ListenAddr
+	if len(listenAddr) == 0 {
+		// only the dialed side of a connection is listening
+		if p.Outbound() {
+			return p.RemoteAddr().String()
+		}
+		return ""
+	}
+
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+
+	if ip := net.ParseIP(host); len(host) > 0 && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr
+	}
+
+	remoteHost, _, err := net.SplitHostPort(p.RemoteAddr().String())
+	if err != nil {
+		return listenAddr
+	}
+
+	return net.JoinHostPort(remoteHost, port)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/Yaroslaw07/difis/pkg/membership"
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/Yaroslaw07/difis/pkg/ring"
+)
+
+// replicaOwners are the nodes that hold the replicas of a file, the
+// first ReplicationFactor nodes on the ring after its key. The node
+// owning the file keeps the local copy and is not one of them
+func (fs *FileServer) replicaOwners(owner, hash string) []ring.Node {
+	owners := []ring.Node{}
+	for _, node := range fs.ring.Owners(replicaKey(owner, hash), fs.ReplicationFactor+1) {
+		if node.ID != owner && len(owners) < fs.ReplicationFactor {
+			owners = append(owners, node)
+		}
+	}
+
+	return owners
+}
+
+// connectNodes connects to the nodes, returning the errors of those it can't reach
+func (fs *FileServer) connectNodes(nodes []ring.Node) (map[string]p2p.Peer, []error) {
+	var (
+		peers = make(map[string]p2p.Peer)
+		errs  = []error{}
+	)
+
+	for _, node := range nodes {
+		peer, err := fs.connect(node.ID, node.Addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("peer (%s): %w", node.ID, err))
+			continue
+		}
+
+		peers[node.ID] = peer
+	}
+
+	return peers, errs
+}
+
+// maintainRing keeps the ring in line with the membership view, members
+// join it once alive and leave it when declared dead. Suspected members
+// stay, a suspicion is often wrong and moving files around is costly
+func (fs *FileServer) maintainRing(events <-chan membership.Event, unsubscribe func()) {
+	defer unsubscribe()
+
+	for _, member := range fs.members.Members() {
+		fs.placeMember(member)
+	}
+
+	for {
+		select {
+		case event := <-events:
+			fs.placeMember(event.Member)
+		case <-fs.quitChannel:
+			return
+		}
+	}
+}
+
+func (fs *FileServer) placeMember(member membership.Member) {
+	if member.State == membership.StateDead {
+		fs.ring.Remove(member.ID)
+		fs.conns.forget(member.ID)
+		return
+	}
+
+	fs.ring.Add(ring.Node{ID: member.ID, Addr: member.Addr})
+}
+
+func nodeAddrs(nodes []ring.Node) []PeerAddr {
+	peers := make([]PeerAddr, len(nodes))
+	for i, node := range nodes {
+		peers[i] = PeerAddr{ID: node.ID, Addr: node.Addr}
+	}
+
+	return peers
+}
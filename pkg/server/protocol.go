@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+const (
+	// ProtocolVersion is the version of the messages this node speaks,
+	// it has to be bumped whenever a message changes incompatibly.
+	// MinProtocolVersion is the oldest version the node still understands
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+
+	// FeatureCompression compresses file transfers on the wire. There
+	// is no feature for the encryption mode, files are encrypted by the
+	// node that owns them and the others store them as they get them
+	FeatureCompression = "compression"
+)
+
+var ErrUnsupported = errors.New("message not supported by peer")
+
+// Protocol describes what this server speaks, it is what transports
+// have to announce in their handshake
+func Protocol() p2p.Protocol {
+	types := make([]int, len(messageTypes))
+	for i, typ := range messageTypes {
+		types[i] = int(typ)
+	}
+
+	return p2p.Protocol{
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		MessageTypes: types,
+		Features:     []string{FeatureCompression},
+	}
+}
+
+// encodeFor encodes msg in the protocol version agreed on with the peer,
+// failing if the peer doesn't handle that type of message at all
+func encodeFor(peer p2p.Peer, msg *MessageWrapper) ([]byte, error) {
+	info := peer.Info()
+
+	if !info.Supports(int(msg.Type)) {
+		return nil, fmt.Errorf("%w: message type %d", ErrUnsupported, msg.Type)
+	}
+
+	msg.Version = ProtocolVersion
+	if info.Version > 0 {
+		msg.Version = info.Version
+	}
+
+	return encodeMessage(msg)
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/ring"
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
+
+const defaultRebalanceDelay = 5 * time.Second
+
+// RebalanceProgress tells how the last or the running rebalance went
+type RebalanceProgress struct {
+	Running  bool
+	Started  time.Time
+	Finished time.Time
+	// Checked counts the replicas held for other nodes that were looked at,
+	// Sent the files and replicas sent to their new owners and Dropped the
+	// replicas deleted once all their owners confirmed holding them
+	Checked int
+	Sent    int
+	Dropped int
+	// Pending counts the replicas kept because an owner couldn't confirm
+	// it holds them, they are tried again by the next rebalance
+	Pending int
+	// Bytes is how much was sent
+	Bytes int64
+}
+
+// RebalanceProgress returns the progress of the last or the running rebalance
+func (fs *FileServer) RebalanceProgress() RebalanceProgress {
+	fs.rebalanceLock.Lock()
+	defer fs.rebalanceLock.Unlock()
+
+	return fs.rebalanced
+}
+
+// rebalancer moves files to their new owners when the ring changes. It
+// waits for the ring to stay the same for RebalanceDelay first, members
+// often join or leave together, and tries again while replicas are pending
+func (fs *FileServer) rebalancer() {
+	ticker := time.NewTicker(fs.RebalanceDelay)
+	defer ticker.Stop()
+
+	var seen, settled string
+	for {
+		select {
+		case <-ticker.C:
+			current := ringNodes(fs.ring.Nodes())
+			if current != seen {
+				seen = current
+				continue
+			}
+
+			if current == settled {
+				continue
+			}
+
+			if fs.rebalance() {
+				settled = current
+			}
+		case <-fs.quitChannel:
+			return
+		}
+	}
+}
+
+// rebalance sends the files of this node to the replica owners missing
+// them and hands the replicas it holds but no longer owns over to their
+// owners. It tells whether nothing was left pending
+func (fs *FileServer) rebalance() (settled bool) {
+	fs.rebalanceLock.Lock()
+	fs.rebalanced = RebalanceProgress{Running: true, Started: time.Now()}
+	fs.rebalanceLock.Unlock()
+
+	// a rebalance stopped with the server is finished too
+	defer func() {
+		p := fs.finishRebalance()
+		fmt.Printf("[%s] rebalanced: (%d) replicas checked, (%d) sent, (%d) dropped, (%d) pending, (%d) bytes sent in %s\n", fs.Transport.Addr(), p.Checked, p.Sent, p.Dropped, p.Pending, p.Bytes, p.Finished.Sub(p.Started))
+
+		settled = settled && p.Pending == 0
+	}()
+
+	fmt.Printf("[%s] rebalancing (%d) nodes\n", fs.Transport.Addr(), fs.ring.Len())
+
+	fs.syncReplicas(func(size int64) {
+		fs.progress(func(p *RebalanceProgress) {
+			p.Sent++
+			p.Bytes += size
+		})
+		fs.throttle(size)
+	})
+
+	ids, err := fs.store.IDs()
+	if err != nil {
+		log.Printf("[%s] listing replicas for rebalance failed: %s\n", fs.Transport.Addr(), err)
+	}
+
+	for _, owner := range ids {
+		if owner == fs.ID {
+			continue
+		}
+
+		entries, err := fs.store.List(owner)
+		if err != nil {
+			log.Printf("[%s] listing replicas of (%s) for rebalance failed: %s\n", fs.Transport.Addr(), owner, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			select {
+			case <-fs.quitChannel:
+				return false
+			default:
+			}
+
+			fs.rebalanceReplica(owner, entry)
+		}
+	}
+
+	return true
+}
+
+// finishRebalance marks the running rebalance finished
+// and returns how it went
+func (fs *FileServer) finishRebalance() RebalanceProgress {
+	fs.rebalanceLock.Lock()
+	defer fs.rebalanceLock.Unlock()
+
+	fs.rebalanced.Running = false
+	fs.rebalanced.Finished = time.Now()
+
+	return fs.rebalanced
+}
+
+// rebalanceReplica hands a replica held for the owner over to its replica
+// owners. A live owner keeps its own replicas in place, so only replicas
+// this node no longer owns or of owners gone from the ring are handed over.
+// A replica not owned anymore is deleted once every owner confirmed it
+// holds the same or a newer version
+func (fs *FileServer) rebalanceReplica(owner string, entry storage.Entry) {
+	owned := fs.ownsReplica(owner, entry.Key)
+	if owned && fs.ring.Has(owner) {
+		return
+	}
+
+	// the replicas kept for a node that is down are sent by the hints
+	if fs.hints.holds(owner, entry.Key) {
+		return
+	}
+
+	fs.progress(func(p *RebalanceProgress) { p.Checked++ })
+
+	// until every owner holds it the replica is found through the DHT
+	if !entry.Deleted {
+		fs.provide(owner, entry.Key)
+	}
+
+	owners := fs.replicaOwners(owner, entry.Key)
+
+	confirmed := 0
+	for _, node := range owners {
+		if node.ID == fs.ID {
+			confirmed++
+			continue
+		}
+
+		if err := fs.handOver(owner, entry, node); err != nil {
+			log.Printf("[%s] handing file (%s) over to (%s) failed: %s\n", fs.Transport.Addr(), entry.Key, node.ID, err)
+			continue
+		}
+
+		confirmed++
+	}
+
+	if owned || len(owners) == 0 {
+		return
+	}
+
+	if confirmed < len(owners) {
+		fs.progress(func(p *RebalanceProgress) { p.Pending++ })
+		return
+	}
+
+	if err := fs.dropEntry(owner, entry); err != nil {
+		log.Printf("[%s] deleting handed over file (%s) failed: %s\n", fs.Transport.Addr(), entry.Key, err)
+		fs.progress(func(p *RebalanceProgress) { p.Pending++ })
+		return
+	}
+
+	fs.progress(func(p *RebalanceProgress) { p.Dropped++ })
+}
+
+// handOver makes sure the node holds the replica, sending it unless the
+// node already has the same or a newer version
+func (fs *FileServer) handOver(owner string, entry storage.Entry, node ring.Node) error {
+	peer, err := fs.connect(node.ID, node.Addr)
+	if err != nil {
+		return err
+	}
+
+	msg := MessageWrapper{
+		Type:    MessageTypeStat,
+		Payload: MessageStatFile{Message: Message{ID: owner, Key: entry.Key}},
+	}
+
+	resp, err := fs.request(node.ID, peer, &msg)
+	if err == nil && !entry.Newer(resp.Meta) {
+		return nil
+	}
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	var size int64
+	if entry.Deleted {
+		err = fs.sendTombstone(node.ID, peer, owner, entry.Key, entry.Metadata)
+	} else {
+		size, _, err = fs.forward(node.ID, peer, owner, entry.Key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fs.progress(func(p *RebalanceProgress) {
+		p.Sent++
+		p.Bytes += size
+	})
+	fs.throttle(size)
+
+	return nil
+}
+
+func (fs *FileServer) progress(update func(p *RebalanceProgress)) {
+	fs.rebalanceLock.Lock()
+	defer fs.rebalanceLock.Unlock()
+
+	update(&fs.rebalanced)
+}
+
+// throttle waits long enough after sending size bytes to keep
+// the rebalance under RebalanceRate bytes a second
+func (fs *FileServer) throttle(size int64) {
+	if fs.RebalanceRate <= 0 || size <= 0 {
+		return
+	}
+
+	wait := time.NewTimer(throttleDelay(size, fs.RebalanceRate))
+	defer wait.Stop()
+
+	select {
+	case <-wait.C:
+	case <-fs.quitChannel:
+	}
+}
+
+// throttleDelay is how long sending size bytes takes at rate bytes a
+// second, in floating point as size times a second overflows for large files
+func throttleDelay(size, rate int64) time.Duration {
+	return time.Duration(float64(size) / float64(rate) * float64(time.Second))
+}
+
+// ringNodes tells two rings apart by their members
+func ringNodes(nodes []ring.Node) string {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID
+	}
+
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/Yaroslaw07/difis/pkg/ring"
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
+
+var (
+	ErrStaleVersion     = errors.New("stale version")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// replicaStat is the version of a file a replica owner holds
+type replicaStat struct {
+	node  ring.Node
+	found bool
+	meta  storage.Metadata
+	// unversioned is set for peers too old to tell their version,
+	// they can serve the file but are never repaired
+	unversioned bool
+}
+
+// statReplicas asks the owners for their version of a file and returns
+// as soon as required of them answered, whether they hold it or not
+func (fs *FileServer) statReplicas(hash string, owners []ring.Node, required int) ([]replicaStat, error) {
+	type result struct {
+		stat replicaStat
+		err  error
+	}
+
+	results := make(chan result, len(owners))
+	for _, node := range owners {
+		go func(node ring.Node) {
+			stat := replicaStat{node: node}
+
+			peer, err := fs.connect(node.ID, node.Addr)
+			if err != nil {
+				results <- result{stat, err}
+				return
+			}
+
+			msg := MessageWrapper{
+				Type:    MessageTypeStat,
+				Payload: MessageStatFile{Message: Message{ID: fs.ID, Key: hash}},
+			}
+
+			resp, err := fs.request(node.ID, peer, &msg)
+			switch {
+			case err == nil:
+				stat.found, stat.meta = true, resp.Meta
+			case errors.Is(err, ErrUnsupported):
+				stat.found, stat.unversioned = true, true
+				err = nil
+			case errors.Is(err, ErrNotFound):
+				err = nil
+			}
+
+			results <- result{stat, err}
+		}(node)
+	}
+
+	var (
+		stats = []replicaStat{}
+		errs  = []error{}
+	)
+	for range owners {
+		if len(stats) == required {
+			break
+		}
+
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, fmt.Errorf("peer (%s): %w", res.stat.node.ID, res.err))
+			continue
+		}
+
+		stats = append(stats, res.stat)
+	}
+
+	if len(stats) < required {
+		return nil, fmt.Errorf("%w: %d replicas answered, %d required: %w", ErrNotEnoughReplicas, len(stats), required, errors.Join(errs...))
+	}
+
+	return stats, nil
+}
+
+// loadQuorum loads the newest version of a file ReadConsistency of its
+// replica owners know about. The owners found holding an older version
+// or none at all are repaired in the background
+func (fs *FileServer) loadQuorum(key, hash string) (bool, error) {
+	owners := fs.replicaOwners(fs.ID, hash)
+
+	stats, err := fs.statReplicas(hash, owners, fs.ReadConsistency.required(len(owners)))
+	if err != nil {
+		return false, fmt.Errorf("[%s] file (%s): %w", fs.Transport.Addr(), key, err)
+	}
+
+	holders := slices.DeleteFunc(slices.Clone(stats), func(s replicaStat) bool { return !s.found })
+	if len(holders) == 0 {
+		return false, nil
+	}
+
+	// newest first, the peers that can't tell their version last
+	slices.SortStableFunc(holders, func(a, b replicaStat) int {
+		switch {
+		case a.unversioned != b.unversioned:
+			if a.unversioned {
+				return 1
+			}
+			return -1
+		case a.meta.Newer(b.meta):
+			return -1
+		case b.meta.Newer(a.meta):
+			return 1
+		}
+		return 0
+	})
+
+	newest := holders[0].meta
+
+	// the file was deleted, this node learns it like any newer version
+	if newest.Deleted {
+		if learned, err := fs.learnTombstone(key, newest); err != nil || !learned {
+			return fs.store.Has(fs.ID, key), err
+		}
+
+		return false, fmt.Errorf("[%s] file (%s) was deleted: %w", fs.Transport.Addr(), key, ErrNotFound)
+	}
+
+	loaded := false
+	for _, s := range holders {
+		if !s.unversioned && !s.meta.Equal(newest) {
+			break
+		}
+
+		peer, err := fs.connect(s.node.ID, s.node.Addr)
+		if err != nil {
+			log.Printf("[%s] loading file (%s) from (%s) failed: %s\n", fs.Transport.Addr(), key, s.node.ID, err)
+			continue
+		}
+
+		n, _, err := fs.loadFrom(s.node.ID, peer, key)
+		if err != nil {
+			log.Printf("[%s] loading file (%s) from (%s) failed: %s\n", fs.Transport.Addr(), key, s.node.ID, err)
+			continue
+		}
+
+		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", fs.Transport.Addr(), n, s.node.ID)
+		loaded = true
+		break
+	}
+
+	if !loaded {
+		return false, nil
+	}
+
+	stale := []ring.Node{}
+	for _, s := range stats {
+		if !s.unversioned && (!s.found || newest.Newer(s.meta)) {
+			stale = append(stale, s.node)
+		}
+	}
+
+	if len(stale) > 0 {
+		go fs.repair(key, stale)
+	}
+
+	return true, nil
+}
+
+// learnTombstone stores the tombstone of a file of this node the replica
+// owners know about, unless the file was saved again since. It tells
+// whether the tombstone was stored
+func (fs *FileServer) learnTombstone(key string, tombstone storage.Metadata) (bool, error) {
+	unlock := fs.writes.acquire(fs.ID, key)
+	defer unlock()
+
+	if current, err := fs.store.ReadMetadata(fs.ID, key); err == nil && !tombstone.Newer(current) {
+		return false, nil
+	}
+
+	return true, fs.store.WriteTombstone(fs.ID, key, tombstone)
+}
+
+// repair sends the local copy of a file to replica owners
+// that miss it or hold an older version
+func (fs *FileServer) repair(key string, nodes []ring.Node) {
+	peers, errs := fs.connectNodes(nodes)
+	if err := fs.replicate(key, peers, errs, len(nodes)); err != nil {
+		log.Printf("[%s] repairing file (%s) failed: %s\n", fs.Transport.Addr(), key, err)
+		return
+	}
+
+	fmt.Printf("[%s] repaired (%d) replicas of file (%s)\n", fs.Transport.Addr(), len(nodes), key)
+}
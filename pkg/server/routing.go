@@ -0,0 +1,252 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/dht"
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+const defaultReplicationFactor = 3
+
+// MessageFindNode asks for the contacts a node knows closest to Target
+type MessageFindNode struct {
+	Target dht.ID
+}
+
+// MessageFindValue asks a node for the nodes it knows hold the replica of
+// a file, if it knows none it answers with the contacts closest to the file
+type MessageFindValue struct {
+	Message
+}
+
+// MessageProvide asks a node to record the sender as a holder of the
+// replica of a file, it is the STORE of the DHT
+type MessageProvide struct {
+	Message
+}
+
+// replicaKey places the replicas of a file on the ring and in the
+// DHT, replicas are stored under the owner and the hashed key
+func replicaKey(owner, hash string) string {
+	return owner + "/" + hash
+}
+
+func splitReplicaKey(key string) (string, string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", key
+	}
+
+	return key[:i], key[i+1:]
+}
+
+// peerContact is how the DHT reaches a connected peer,
+// peers that can't be dialed back are left out of it
+func peerContact(peerID string, p p2p.Peer) (dht.Contact, bool) {
+	addr := peerAddr(p)
+	if len(addr) == 0 {
+		return dht.Contact{}, false
+	}
+
+	return dht.NewContact(peerID, addr), true
+}
+
+// connect returns the peer connected as nodeID,
+// dialing addr and waiting for the connection if there is none
+func (fs *FileServer) connect(nodeID, addr string) (p2p.Peer, error) {
+	if nodeID == fs.ID || addr == fs.Transport.Addr() {
+		return nil, fmt.Errorf("[%s] refusing connection to itself", fs.Transport.Addr())
+	}
+
+	events, unsubscribe := fs.Subscribe()
+	defer unsubscribe()
+
+	if peer, ok := fs.peer(nodeID); ok {
+		return peer, nil
+	}
+
+	if err := fs.Transport.Dial(addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(fs.RequestTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.Type == PeerConnected && event.PeerID == nodeID {
+				return event.Peer, nil
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("%w: connecting to (%s) at %s", ErrRequestTimeout, nodeID, addr)
+		case <-fs.quitChannel:
+			return nil, fmt.Errorf("server stopped while connecting to (%s)", nodeID)
+		}
+	}
+}
+
+func (fs *FileServer) handleMessageFindNode(from string, requestID uint64, msg MessageFindNode) error {
+	return fs.reply(from, requestID, MessageResponse{
+		Status: StatusAck,
+		Peers:  peerAddrs(fs.dht.Closest(msg.Target)),
+	})
+}
+
+// provide publishes in the DHT that this node holds a replica the ring
+// doesn't place on it, like a hinted replica or one not handed over yet
+// after the ring changed. The ring finds the replicas where it places
+// them, the DHT only routes to the ones it doesn't
+func (fs *FileServer) provide(owner, hash string) {
+	if fs.ownsReplica(owner, hash) {
+		return
+	}
+
+	fs.dht.Provide(replicaKey(owner, hash))
+}
+
+func (fs *FileServer) handleMessageFindValue(from string, requestID uint64, msg MessageFindValue) error {
+	key := replicaKey(msg.ID, msg.Key)
+
+	providers := fs.dht.Providers(key)
+	if fs.store.Has(msg.ID, msg.Key) && !slices.ContainsFunc(providers, func(c dht.Contact) bool { return c.ID == fs.dht.Self.ID }) {
+		providers = append(providers, fs.dht.Self)
+	}
+
+	if len(providers) > 0 {
+		return fs.reply(from, requestID, MessageResponse{Status: StatusFound, Peers: peerAddrs(providers)})
+	}
+
+	return fs.reply(from, requestID, MessageResponse{
+		Status: StatusNotFound,
+		Peers:  peerAddrs(fs.dht.Closest(dht.NewID(key))),
+	})
+}
+
+func (fs *FileServer) handleMessageProvide(from string, requestID uint64, msg MessageProvide) error {
+	peer, ok := fs.peer(from)
+	if !ok {
+		return fmt.Errorf("[%s] provider (%s) not connected", fs.Transport.Addr(), from)
+	}
+
+	// only the sender itself is recorded, a node can't publish others
+	c, ok := peerContact(from, peer)
+	if !ok {
+		return fs.replyError(from, requestID, fmt.Errorf("[%s] provider (%s) can't be dialed back: %w", fs.Transport.Addr(), from, ErrUnsupported))
+	}
+
+	fs.dht.AddProvider(replicaKey(msg.ID, msg.Key), c)
+
+	return fs.reply(from, requestID, MessageResponse{Status: StatusAck})
+}
+
+func peerAddrs(contacts []dht.Contact) []PeerAddr {
+	peers := make([]PeerAddr, len(contacts))
+	for i, c := range contacts {
+		peers[i] = PeerAddr{ID: c.NodeID, Addr: c.Addr}
+	}
+
+	return peers
+}
+
+func contacts(peers []PeerAddr) []dht.Contact {
+	contacts := make([]dht.Contact, len(peers))
+	for i, p := range peers {
+		contacts[i] = dht.NewContact(p.ID, p.Addr)
+	}
+
+	return contacts
+}
+
+// dhtNetwork carries the DHT requests as server messages. Peers on an
+// older protocol don't route, they answer lookups as if they knew
+// nobody and are asked for files directly. Peers that don't keep provider
+// records answer whether they hold the replica themselves
+type dhtNetwork struct {
+	fs *FileServer
+}
+
+func (n dhtNetwork) FindNode(to dht.Contact, target dht.ID) ([]dht.Contact, error) {
+	peer, err := n.fs.connect(to.NodeID, to.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := MessageWrapper{
+		Type:    MessageTypeFindNode,
+		Payload: MessageFindNode{Target: target},
+	}
+
+	resp, err := n.fs.request(to.NodeID, peer, &msg)
+	if errors.Is(err, ErrUnsupported) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return contacts(resp.Peers), nil
+}
+
+func (n dhtNetwork) FindValue(to dht.Contact, key string) ([]dht.Contact, []dht.Contact, error) {
+	peer, err := n.fs.connect(to.NodeID, to.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owner, hash := splitReplicaKey(key)
+
+	msg := MessageWrapper{
+		Type:    MessageTypeFindValue,
+		Payload: MessageFindValue{Message: Message{ID: owner, Key: hash}},
+	}
+
+	resp, err := n.fs.request(to.NodeID, peer, &msg)
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		return []dht.Contact{to}, nil, nil
+	case errors.Is(err, ErrNotFound):
+		return nil, contacts(resp.Peers), nil
+	case err != nil:
+		return nil, nil, err
+	}
+
+	if len(resp.Peers) == 0 {
+		return []dht.Contact{to}, nil, nil
+	}
+
+	return contacts(resp.Peers), nil, nil
+}
+
+func (n dhtNetwork) Store(to dht.Contact, key string) error {
+	peer, err := n.fs.connect(to.NodeID, to.Addr)
+	if err != nil {
+		return err
+	}
+
+	owner, hash := splitReplicaKey(key)
+
+	msg := MessageWrapper{
+		Type:    MessageTypeProvide,
+		Payload: MessageProvide{Message: Message{ID: owner, Key: hash}},
+	}
+
+	_, err = n.fs.request(to.NodeID, peer, &msg)
+	return err
+}
+
+func (n dhtNetwork) Ping(to dht.Contact) error {
+	peer, err := n.fs.connect(to.NodeID, to.Addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = peer.Ping(n.fs.RequestTimeout)
+	return err
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+)
+
+const defaultRequestTimeout = 5 * time.Second
+
+var (
+	ErrRequestTimeout = errors.New("request timed out")
+	ErrNotFound       = errors.New("file not found")
+	ErrPeerGone       = errors.New("peer disconnected")
+)
+
+// call is a request waiting for its response
+type call struct {
+	id   uint64
+	peer string
+	done chan MessageResponse
+	// gone is closed when the peer disconnects before answering
+	gone chan struct{}
+}
+
+// newCall registers a pending request to the given peer,
+// it has to be released with finishCall once answered
+func (fs *FileServer) newCall(peer string) *call {
+	c := &call{
+		id:   fs.nextRequestID.Add(1),
+		peer: peer,
+		done: make(chan MessageResponse, 1),
+		gone: make(chan struct{}),
+	}
+
+	fs.pendingLock.Lock()
+	fs.pending[c.id] = c
+	fs.pendingLock.Unlock()
+
+	return c
+}
+
+func (fs *FileServer) finishCall(c *call) {
+	fs.pendingLock.Lock()
+	delete(fs.pending, c.id)
+	fs.pendingLock.Unlock()
+}
+
+// failCalls releases the calls still waiting on a peer that disconnected
+func (fs *FileServer) failCalls(peer string) {
+	fs.pendingLock.Lock()
+	defer fs.pendingLock.Unlock()
+
+	for id, c := range fs.pending {
+		if c.peer == peer {
+			delete(fs.pending, id)
+			close(c.gone)
+		}
+	}
+}
+
+// await blocks until the response for the call arrives,
+// the peer disconnects or the request timeout runs out
+func (fs *FileServer) await(c *call) (MessageResponse, error) {
+	return fs.awaitTimeout(c, fs.RequestTimeout)
+}
+
+func (fs *FileServer) awaitTimeout(c *call, timeout time.Duration) (MessageResponse, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-c.done:
+		return resp, resp.Err()
+	case <-c.gone:
+		return MessageResponse{}, fmt.Errorf("%w: request (%d) to peer (%s)", ErrPeerGone, c.id, c.peer)
+	case <-timer.C:
+		return MessageResponse{}, fmt.Errorf("%w: request (%d) to peer (%s)", ErrRequestTimeout, c.id, c.peer)
+	case <-fs.quitChannel:
+		return MessageResponse{}, fmt.Errorf("server stopped while waiting on peer (%s)", c.peer)
+	}
+}
+
+// request sends msg to the peer as a control message and waits for the answer
+func (fs *FileServer) request(peerID string, peer p2p.Peer, msg *MessageWrapper) (MessageResponse, error) {
+	c := fs.newCall(peerID)
+	defer fs.finishCall(c)
+
+	msg.RequestID = c.id
+
+	payload, err := encodeFor(peer, msg)
+	if err != nil {
+		return MessageResponse{}, err
+	}
+
+	if err := peer.Send(payload); err != nil {
+		return MessageResponse{}, err
+	}
+
+	return fs.await(c)
+}
+
+// reply answers the request with the given id
+func (fs *FileServer) reply(to string, requestID uint64, resp MessageResponse) error {
+	peer, ok := fs.peer(to)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", to)
+	}
+
+	msg := MessageWrapper{
+		Type:      MessageTypeResponse,
+		RequestID: requestID,
+		Payload:   resp,
+	}
+
+	payload, err := encodeFor(peer, &msg)
+	if err != nil {
+		return err
+	}
+
+	return peer.Send(payload)
+}
+
+// replyError answers the request with err, returning it for the caller to log
+func (fs *FileServer) replyError(to string, requestID uint64, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		fs.reply(to, requestID, MessageResponse{Status: StatusNotFound})
+		return err
+	}
+
+	fs.reply(to, requestID, MessageResponse{Status: StatusError, Error: err.Error()})
+	return err
+}
+
+func (fs *FileServer) handleMessageResponse(from string, requestID uint64, resp MessageResponse) error {
+	fs.pendingLock.Lock()
+	c, ok := fs.pending[requestID]
+	fs.pendingLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("[%s] response to unknown or expired request (%d) from (%s)", fs.Transport.Addr(), requestID, from)
+	}
+
+	if c.peer != from {
+		return fmt.Errorf("[%s] response to request (%d) from (%s), but it was sent to (%s)", fs.Transport.Addr(), requestID, from, c.peer)
+	}
+
+	select {
+	case c.done <- resp:
+	default:
+		return fmt.Errorf("[%s] duplicate response to request (%d) from (%s)", fs.Transport.Addr(), requestID, from)
+	}
+
+	return nil
+}
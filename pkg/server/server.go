@@ -2,33 +2,113 @@ package server
 
 import (
 	"bytes"
-	"encoding/binary"
+	"compress/flate"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Yaroslaw07/difis/pkg/crypto"
+	"github.com/Yaroslaw07/difis/pkg/dht"
+	"github.com/Yaroslaw07/difis/pkg/membership"
 	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/Yaroslaw07/difis/pkg/ring"
 	"github.com/Yaroslaw07/difis/pkg/storage"
+	"github.com/Yaroslaw07/difis/pkg/vclock"
 )
 
 func init() {
 	gob.Register(MessageSaveFile{})
 	gob.Register(MessageLoadFile{})
 	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageResponse{})
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessageMembership{})
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageStatFile{})
+	gob.Register(MessageSyncTree{})
+	gob.Register(MessageSiblings{})
+	gob.Register(MessageListFiles{})
+	gob.Register(MessageProvide{})
 	gob.Register(MessageWrapper{})
 }
 
 type FileServerOpts struct {
+	// Identity is the keypair of the node, its ID becomes the node ID
+	Identity          *crypto.Identity
 	ID                string
 	EncKey            []byte
 	StorageRoot       string
 	PathTransformFunc storage.PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+	// RequestTimeout is how long to wait for a peer to answer a request
+	RequestTimeout time.Duration
+	// WriteConsistency is how many replicas have to acknowledge a file
+	// before Save succeeds, waiting for them up to WriteTimeout
+	WriteConsistency Consistency
+	WriteTimeout     time.Duration
+	// ReadConsistency is how many replicas have to tell their version of
+	// a file before Load picks the newest, when it has no local copy
+	ReadConsistency Consistency
+	// ReconnectBackoff is the first wait before dialing a lost peer again,
+	// it doubles with every failed dial up to MaxReconnectBackoff
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+	// HeartbeatInterval is how often peers are pinged, a peer nothing
+	// was received from for PeerTimeout is disconnected
+	HeartbeatInterval time.Duration
+	PeerTimeout       time.Duration
+	// PeerExchangeInterval is how often the peer list is shared with peers
+	PeerExchangeInterval time.Duration
+	// TargetPeers stops dialing peers learned from others once the node
+	// has that many, zero connects to every node of the cluster
+	TargetPeers int
+	// Membership tunes the failure detector, its ID, Addr
+	// and Send are filled in by the server
+	Membership membership.Opts
+	// AntiEntropyInterval is how often the replicas of the files of the
+	// node are compared with the files, to fix writes replicas missed
+	AntiEntropyInterval time.Duration
+	// HintTTL is how long a fallback node keeps the writes a replica
+	// owner missed while down, keeping up to MaxHints for every owner
+	// and trying to send them every HintReplayInterval
+	HintTTL            time.Duration
+	MaxHints           int
+	HintReplayInterval time.Duration
+	// RebalanceDelay is how long the ring has to stay the same before the
+	// files are moved to their new owners, sending up to RebalanceRate
+	// bytes a second, zero doesn't limit it
+	RebalanceDelay time.Duration
+	RebalanceRate  int64
+	// KeepVersions is how many prior versions of its files the node keeps
+	// and VersionRetention for how long after they were replaced, zero is
+	// no limit. Prior versions are only kept when either is set
+	KeepVersions     int
+	VersionRetention time.Duration
+	// ConflictResolver decides between versions of a file written
+	// concurrently, LastWriteWins when not set
+	ConflictResolver ConflictResolver
+	// TombstoneGracePeriod is how long the tombstone of a deleted file is
+	// kept. A replica owner down for longer than that and missing the
+	// delete can bring the file back
+	TombstoneGracePeriod time.Duration
+	// ReplicationFactor is how many nodes get a replica of a file, the
+	// ring picks them among the members, VirtualNodes is how many points
+	// every member has on the ring
+	ReplicationFactor int
+	VirtualNodes      int
+	// DHT tunes the routing of keys to nodes, its Self
+	// and Network are filled in by the server
+	DHT dht.Opts
 }
 
 type FileServer struct {
@@ -36,44 +116,180 @@ type FileServer struct {
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
+	stats    map[string]*peerStats
 
+	pendingLock   sync.Mutex
+	pending       map[uint64]*call
+	nextRequestID atomic.Uint64
+
+	subscribersLock sync.Mutex
+	subscribers     map[chan PeerEvent]struct{}
+
+	conns       *connManager
+	members     *membership.Membership
+	dht         *dht.DHT
+	ring        *ring.Ring
 	store       *storage.Store
+	hints       *hintStore
+	siblings    *storage.Store
 	quitChannel chan struct{}
+
+	writes keyLocks
+
+	rebalanceLock sync.Mutex
+	rebalanced    RebalanceProgress
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
 	storeOpts := storage.StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		KeepVersions:      opts.KeepVersions,
+		VersionRetention:  opts.VersionRetention,
+	}
+
+	if opts.Identity != nil {
+		opts.ID = opts.Identity.ID()
 	}
 
 	if len(opts.ID) == 0 {
 		opts.ID = crypto.GenerateID()
 	}
 
-	return &FileServer{
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = opts.RequestTimeout
+	}
+
+	if opts.ReconnectBackoff == 0 {
+		opts.ReconnectBackoff = defaultReconnectBackoff
+	}
+
+	if opts.MaxReconnectBackoff == 0 {
+		opts.MaxReconnectBackoff = max(defaultMaxReconnectBackoff, opts.ReconnectBackoff)
+	}
+
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+
+	if opts.PeerTimeout == 0 {
+		opts.PeerTimeout = 3 * opts.HeartbeatInterval
+	}
+
+	if opts.PeerExchangeInterval == 0 {
+		opts.PeerExchangeInterval = defaultPeerExchangeInterval
+	}
+
+	if opts.AntiEntropyInterval == 0 {
+		opts.AntiEntropyInterval = defaultAntiEntropyInterval
+	}
+
+	if opts.HintTTL == 0 {
+		opts.HintTTL = defaultHintTTL
+	}
+
+	if opts.MaxHints == 0 {
+		opts.MaxHints = defaultMaxHints
+	}
+
+	if opts.HintReplayInterval == 0 {
+		opts.HintReplayInterval = defaultHintReplayInterval
+	}
+
+	if opts.ConflictResolver == nil {
+		opts.ConflictResolver = LastWriteWins
+	}
+
+	if opts.TombstoneGracePeriod == 0 {
+		opts.TombstoneGracePeriod = defaultTombstoneGracePeriod
+	}
+
+	if opts.RebalanceDelay == 0 {
+		opts.RebalanceDelay = defaultRebalanceDelay
+	}
+
+	if opts.ReplicationFactor == 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+
+	fs := &FileServer{
 		FileServerOpts: opts,
 		store:          storage.NewStore(storeOpts),
 		quitChannel:    make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		stats:          make(map[string]*peerStats),
+		pending:        make(map[uint64]*call),
+		subscribers:    make(map[chan PeerEvent]struct{}),
 	}
+	fs.conns = newConnManager(fs)
+	fs.hints = newHintStore(filepath.Join(fs.store.Root, hintsFolderName))
+	fs.siblings = storage.NewStore(storage.StoreOpts{
+		Root:              filepath.Join(fs.store.Root, siblingsFolderName),
+		PathTransformFunc: fs.store.PathTransformFunc,
+	})
+
+	membershipOpts := opts.Membership
+	membershipOpts.ID = fs.ID
+	membershipOpts.Addr = opts.Transport.Addr()
+	membershipOpts.Send = fs.sendMembership
+	fs.members = membership.New(membershipOpts)
+
+	dhtOpts := opts.DHT
+	dhtOpts.Self = dht.NewContact(fs.ID, opts.Transport.Addr())
+	dhtOpts.Network = dhtNetwork{fs: fs}
+	fs.dht = dht.New(dhtOpts)
+
+	fs.ring = ring.New(opts.VirtualNodes)
+	fs.ring.Add(ring.Node{ID: fs.ID, Addr: opts.Transport.Addr()})
+
+	opts.Transport.SetOnPeer(fs.OnPeer)
+	opts.Transport.SetOnPeerDisconnect(fs.OnPeerDisconnect)
+
+	return fs
 }
 
 func (fs *FileServer) Start() error {
 	fmt.Printf("[%s] starting file server...", fs.Transport.Addr())
+
+	// the first peers may connect as soon as the node listens,
+	// the peer exchange and the ring must not miss them
+	events, unsubscribe := fs.Subscribe()
+	hintEvents, unsubscribeHints := fs.Subscribe()
+	memberEvents, unsubscribeMembers := fs.members.Subscribe()
+
 	if err := fs.Transport.ListenAndAccept(); err != nil {
+		unsubscribe()
+		unsubscribeHints()
+		unsubscribeMembers()
 		return err
 	}
 
 	fs.bootstrapNetwork()
 
+	go fs.heartbeat()
+	go fs.peerExchange(events, unsubscribe)
+	go fs.maintainRing(memberEvents, unsubscribeMembers)
+	go fs.antiEntropy()
+	go fs.replayHints(hintEvents, unsubscribeHints)
+	go fs.rebalancer()
+	fs.members.Start()
+	fs.dht.Start()
+
 	fs.loop()
 
 	return nil
 }
 
 func (fs *FileServer) Stop() {
-	close(fs.quitChannel)
+	select {
+	case <-fs.quitChannel:
+	default:
+		close(fs.quitChannel)
+	}
 }
 
 func (fs *FileServer) Load(key string) (io.Reader, error) {
@@ -84,124 +300,670 @@ func (fs *FileServer) Load(key string) (io.Reader, error) {
 		return r, err
 	}
 
-	fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", fs.Transport.Addr(), key)
+	// only this node writes its files, a file it deleted is gone
+	meta, err := fs.store.ReadMetadata(fs.ID, key)
+	if err != nil {
+		return nil, err
+	}
 
-	msg := MessageWrapper{
-		Type:    MessageTypeLoad,
-		Payload: newMessageLoadFile(fs.ID, crypto.HashKey(key)),
+	if meta.Deleted {
+		return nil, fmt.Errorf("[%s] file (%s) was deleted: %w", fs.Transport.Addr(), key, ErrNotFound)
 	}
 
-	if err := fs.broadcast(&msg); err != nil {
+	fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", fs.Transport.Addr(), key)
+
+	hash := crypto.HashKey(key)
+
+	found, err := fs.loadQuorum(key, hash)
+	if err != nil {
 		return nil, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	// the DHT finds the replicas that are not where the ring puts them anymore
+	if !found {
+		holders, _ := fs.dht.FindValue(replicaKey(fs.ID, hash))
+		found = fs.loadFromAny(key, peerAddrs(holders))
+	}
+
+	if !found {
+		return nil, fmt.Errorf("[%s] file (%s): %w", fs.Transport.Addr(), key, ErrNotFound)
+	}
 
-	for _, peer := range fs.peers {
-		// First read the file size to limit reader
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+	_, r, err := fs.store.Read(fs.ID, key)
 
-		n, err := fs.store.WriteDecrypt(fs.EncKey, fs.ID, key, io.LimitReader(peer, fileSize))
+	return r, err
+}
+
+// loadFromAny loads the file from the first of the nodes that has it
+func (fs *FileServer) loadFromAny(key string, nodes []PeerAddr) bool {
+	for _, node := range nodes {
+		peer, err := fs.connect(node.ID, node.Addr)
 		if err != nil {
-			return nil, err
+			log.Printf("[%s] loading file (%s) from (%s) failed: %s\n", fs.Transport.Addr(), key, node.ID, err)
+			continue
 		}
 
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s)", fs.Transport.Addr(), n, peer.RemoteAddr())
+		n, _, err := fs.loadFrom(node.ID, peer, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
 
-		peer.CloseStream()
+		if err != nil {
+			log.Printf("[%s] loading file (%s) from (%s) failed: %s\n", fs.Transport.Addr(), key, node.ID, err)
+			continue
+		}
+
+		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", fs.Transport.Addr(), n, node.ID)
+		return true
 	}
 
-	_, r, err := fs.store.Read(fs.ID, key)
+	return false
+}
 
-	return r, err
+// loadFrom asks the peer for the file and stores it locally if the peer
+// has it, a file that doesn't match the checksum it came with is dropped.
+// The file stays locked while it is loaded, a save of it in between
+// wins and a version older than the local metadata is not kept
+func (fs *FileServer) loadFrom(peerID string, peer p2p.Peer, key string) (int64, storage.Metadata, error) {
+	unlock := fs.writes.acquire(fs.ID, key)
+	defer unlock()
+
+	current, currentErr := fs.store.ReadMetadata(fs.ID, key)
+	if currentErr == nil && fs.store.Has(fs.ID, key) {
+		return 0, current, nil
+	}
+
+	n, meta, err := fs.fetch(peerID, peer, newMessageLoadFile(fs.ID, crypto.HashKey(key)), func(r io.Reader) (int64, error) {
+		return fs.store.WriteDecrypt(fs.EncKey, fs.ID, key, r)
+	})
+	if err != nil {
+		return n, meta, err
+	}
+
+	if currentErr == nil && current.Newer(meta) {
+		fs.store.Delete(fs.ID, key)
+		return n, meta, fmt.Errorf("peer (%s) file (%s) version (%d) is older than the local (%d): %w", peerID, key, meta.Version, current.Version, ErrStaleVersion)
+	}
+
+	if err := verify(fs.store, fs.ID, key, meta); err != nil {
+		fs.store.Delete(fs.ID, key)
+		return n, meta, fmt.Errorf("peer (%s): %w", peerID, err)
+	}
+
+	return n, meta, fs.store.WriteMetadata(fs.ID, key, meta)
 }
 
-func (fs *FileServer) Save(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
+// fetch asks the peer for a file and hands what it sends to write
+func (fs *FileServer) fetch(peerID string, peer p2p.Peer, loadMsg MessageLoadFile, write func(r io.Reader) (int64, error)) (int64, storage.Metadata, error) {
+	c := fs.newCall(peerID)
+	defer fs.finishCall(c)
 
-	size, err := fs.store.Write(fs.ID, key, tee)
+	compressed := peer.Info().HasFeature(FeatureCompression)
+	loadMsg.Compressed = compressed
 
+	msg := MessageWrapper{
+		Type:      MessageTypeLoad,
+		RequestID: c.id,
+		Payload:   loadMsg,
+	}
+
+	payload, err := encodeFor(peer, &msg)
+	if err != nil {
+		return 0, storage.Metadata{}, err
+	}
+
+	stream, err := peer.OpenStream(payload)
+	if err != nil {
+		return 0, storage.Metadata{}, err
+	}
+	defer stream.Close()
+
+	// the peer announces the file size before sending the file
+	resp, err := fs.await(c)
+	if err != nil {
+		stream.Reset()
+		return 0, storage.Metadata{}, err
+	}
+
+	var r io.Reader = stream
+	if compressed {
+		r = flate.NewReader(stream)
+	}
+
+	n, err := write(io.LimitReader(r, resp.Size))
+
+	return n, resp.Meta, err
+}
+
+// verify checks a stored file against its checksum,
+// files of nodes that don't keep checksums can't be checked
+func verify(store *storage.Store, id, key string, meta storage.Metadata) error {
+	if len(meta.Checksum) == 0 {
+		return nil
+	}
+
+	_, r, err := store.Read(id, key)
 	if err != nil {
 		return err
 	}
 
-	msg := MessageWrapper{
-		Type:    MessageTypeSave,
-		Payload: newMessageSaveFile(fs.ID, crypto.HashKey(key), size),
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
 	}
 
-	if err := fs.broadcast(&msg); err != nil {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
 		return err
 	}
 
-	time.Sleep(time.Millisecond * 100)
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != meta.Checksum {
+		return fmt.Errorf("%w: file (%s) has checksum %s, want %s", ErrChecksumMismatch, key, checksum, meta.Checksum)
+	}
 
-	peers := []io.Writer{}
-	for _, peer := range fs.peers {
-		peers = append(peers, peer)
+	return nil
+}
+
+func (fs *FileServer) Save(key string, r io.Reader) error {
+	return fs.SaveWithOptions(key, r, SaveOptions{})
+}
+
+// SaveWithOptions saves the file like Save, with the content type
+// and tags kept in its metadata
+func (fs *FileServer) SaveWithOptions(key string, r io.Reader, opts SaveOptions) error {
+	meta, file, err := fs.writeLocal(key, r, opts)
+	if err != nil {
+		return err
+	}
+
+	if rc, ok := file.(io.ReadCloser); ok {
+		defer rc.Close()
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := crypto.CopyEncrypt(fs.EncKey, fileBuffer, mw)
 
+	fmt.Printf("[%s] written (%d) bytes of file (%s) version (%d) to disk\n", fs.Transport.Addr(), meta.Size, key, meta.Version)
+
+	// the replicas go to the owners of the key on the ring
+	owners := fs.replicaOwners(fs.ID, crypto.HashKey(key))
+	peers, errs := fs.connectNodes(owners)
+
+	required := fs.WriteConsistency.required(len(owners))
+
+	replicas, errs, err := fs.sendReplicas(key, meta, file, peers, errs, nil)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] received and written (%v) bytes to disk\n", fs.Transport.Addr(), n)
+	// the owners that missed the file get it from a fallback node once back
+	return fs.awaitReplicas(key, replicas, errs, required, func(acked []string) {
+		fs.handOff(key, missedNodes(owners, acked))
+	})
+}
 
-	return nil
+// writeLocal stores the local copy of a file as its next version. It
+// returns the version written opened before the key is unlocked, a Save
+// racing this one can't change what the replicas are sent then
+func (fs *FileServer) writeLocal(key string, r io.Reader, opts SaveOptions) (storage.Metadata, io.Reader, error) {
+	unlock := fs.writes.acquire(fs.ID, key)
+	defer unlock()
+
+	prev, clock, err := fs.nextClock(key)
+	if err != nil {
+		return storage.Metadata{}, nil, err
+	}
+
+	if err := fs.store.Archive(fs.ID, key); err != nil {
+		return storage.Metadata{}, nil, err
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType, r = detectContentType(key, r)
+	}
+
+	h := sha256.New()
+	size, err := fs.store.Write(fs.ID, key, io.TeeReader(r, h))
+	if err != nil {
+		return storage.Metadata{}, nil, err
+	}
+
+	now := time.Now()
+	created := now
+	if prev.Version > 0 && !prev.Deleted && !prev.Created.IsZero() {
+		created = prev.Created
+	}
+
+	meta := storage.Metadata{
+		Version:     nextVersion(prev.Version),
+		Checksum:    hex.EncodeToString(h.Sum(nil)),
+		Size:        size,
+		Clock:       clock,
+		ContentType: contentType,
+		Created:     created,
+		Modified:    now,
+		Tags:        opts.Tags,
+		Name:        key,
+	}
+
+	if err := fs.store.WriteMetadata(fs.ID, key, meta); err != nil {
+		return storage.Metadata{}, nil, err
+	}
+
+	fs.dropSiblings(fs.ID, key, meta)
+
+	_, file, err := fs.store.Read(fs.ID, key)
+
+	return meta, file, err
 }
 
+// snapshot opens the file stored under the ID and key with its metadata.
+// The file is locked meanwhile so they match, and files are replaced by
+// renaming the new content over them, so the open file keeps its content
+func (fs *FileServer) snapshot(id, key string) (storage.Metadata, int64, io.Reader, error) {
+	unlock := fs.writes.acquire(id, key)
+	defer unlock()
+
+	meta, err := fs.store.ReadMetadata(id, key)
+	if err != nil {
+		return meta, 0, nil, err
+	}
+
+	size, file, err := fs.store.Read(id, key)
+
+	return meta, size, file, err
+}
+
+// nextClock returns the version of the local copy of a file and the clock
+// of the version written next. It is written after the local copy and
+// the siblings the node knows about, so it resolves them
+func (fs *FileServer) nextClock(key string) (storage.Metadata, vclock.Clock, error) {
+	prev, err := fs.store.ReadMetadata(fs.ID, key)
+	if err != nil {
+		return prev, nil, err
+	}
+
+	siblings, err := fs.listSiblings(fs.ID, key)
+	if err != nil {
+		return prev, nil, err
+	}
+
+	clock := prev.Clock
+	for _, sibling := range siblings {
+		clock = clock.Merge(sibling.Clock)
+	}
+
+	return prev, clock.Increment(fs.ID), nil
+}
+
+// nextVersion numbers versions by the time they are written,
+// a clock going back still moves the version forward
+func nextVersion(prev uint64) uint64 {
+	version := uint64(time.Now().UnixNano())
+	if version <= prev {
+		version = prev + 1
+	}
+
+	return version
+}
+
+// replicate sends the local copy of a file to the peers and succeeds once
+// required of them acknowledged, errs are the failures of the replicas
+// that couldn't even be reached
+func (fs *FileServer) replicate(key string, peers map[string]p2p.Peer, errs []error, required int) error {
+	meta, _, file, err := fs.snapshot(fs.ID, key)
+	if err != nil {
+		return err
+	}
+
+	if rc, ok := file.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	replicas, errs, err := fs.sendReplicas(key, meta, file, peers, errs, nil)
+	if err != nil {
+		return err
+	}
+
+	return fs.awaitReplicas(key, replicas, errs, required, nil)
+}
+
+// sendReplicas sends the version of the local copy of a file read from
+// file to the peers, every one gets its own stream, the message travels
+// with the stream so the data can be sent right away. Hints are the replica
+// owners the peers keep the file for, when they are only fallbacks for them
+func (fs *FileServer) sendReplicas(key string, meta storage.Metadata, file io.Reader, peers map[string]p2p.Peer, errs []error, hints map[string]PeerAddr) ([]*replicaWriter, []error, error) {
+	var (
+		replicas = []*replicaWriter{}
+		writers  = []io.Writer{}
+	)
+	for peerID, peer := range peers {
+		c := fs.newCall(peerID)
+
+		saveMsg := newMessageSaveFile(fs.ID, crypto.HashKey(key), meta.Size)
+		saveMsg.Compressed = peer.Info().HasFeature(FeatureCompression)
+		saveMsg.Meta = meta
+		saveMsg.Hint = hints[peerID]
+
+		msg := MessageWrapper{
+			Type:      MessageTypeSave,
+			RequestID: c.id,
+			Payload:   saveMsg,
+		}
+
+		payload, err := encodeFor(peer, &msg)
+		if err != nil {
+			fs.finishCall(c)
+			errs = append(errs, fmt.Errorf("peer (%s): %w", peerID, err))
+			continue
+		}
+
+		stream, err := peer.OpenStream(payload)
+		if err != nil {
+			fs.finishCall(c)
+			errs = append(errs, fmt.Errorf("peer (%s): %w", peerID, err))
+			continue
+		}
+
+		replica := newReplicaWriter(peerID, c, stream, saveMsg.Compressed)
+		replicas = append(replicas, replica)
+		writers = append(writers, replica)
+	}
+
+	mw := io.MultiWriter(writers...)
+	n, err := crypto.CopyEncrypt(fs.EncKey, file, mw)
+
+	for _, replica := range replicas {
+		replica.finish()
+	}
+
+	if err != nil {
+		for _, replica := range replicas {
+			fs.finishCall(replica.call)
+		}
+		return nil, errs, err
+	}
+
+	fmt.Printf("[%s] sent (%d) bytes of file (%s) to (%d) replicas\n", fs.Transport.Addr(), n, key, len(replicas))
+
+	return replicas, errs, nil
+}
+
+// awaitReplicas waits for the replicas to acknowledge the file, it
+// succeeds as soon as required of them did. Done is called with the
+// peers that acknowledged once all of them answered or timed out
+func (fs *FileServer) awaitReplicas(key string, replicas []*replicaWriter, errs []error, required int, done func(acked []string)) error {
+	type result struct {
+		peerID string
+		err    error
+	}
+
+	// every replica acknowledges once the file is on its disk
+	results := make(chan result, len(replicas))
+	for _, replica := range replicas {
+		go func(replica *replicaWriter) {
+			defer fs.finishCall(replica.call)
+
+			if replica.err != nil {
+				results <- result{replica.peerID, fmt.Errorf("peer (%s): %w", replica.peerID, replica.err)}
+				return
+			}
+
+			if _, err := fs.awaitTimeout(replica.call, fs.WriteTimeout); err != nil {
+				results <- result{replica.peerID, fmt.Errorf("peer (%s): %w", replica.peerID, err)}
+				return
+			}
+
+			results <- result{replica.peerID, nil}
+		}(replica)
+	}
+
+	// the write succeeds as soon as enough replicas acknowledged,
+	// and fails as soon as too many of them failed for that
+	acked, waiting := []string{}, len(replicas)
+	for len(acked) < required && len(acked)+waiting >= required && waiting > 0 {
+		waiting--
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		acked = append(acked, res.peerID)
+	}
+
+	var err error
+	if len(acked) < required {
+		err = fmt.Errorf("%w: %d replicas acknowledged file (%s), %d required: %w",
+			ErrNotEnoughReplicas, len(acked), key, required, errors.Join(errs...))
+	} else {
+		for _, err := range errs {
+			log.Printf("[%s] replicating file (%s) failed: %s\n", fs.Transport.Addr(), key, err)
+		}
+	}
+
+	go func() {
+		for i := 0; i < waiting; i++ {
+			res := <-results
+			if res.err != nil {
+				log.Printf("[%s] replicating file (%s) failed: %s\n", fs.Transport.Addr(), key, res.err)
+				continue
+			}
+			acked = append(acked, res.peerID)
+		}
+
+		if done != nil {
+			done(acked)
+		}
+	}()
+
+	return err
+}
+
+// Delete replaces the file with a tombstone on this node and the replica
+// owners. The tombstone outlives the file for TombstoneGracePeriod, so
+// the replicas that missed the delete can't bring the file back
 func (fs *FileServer) Delete(key string) error {
-	if fs.store.Has(fs.ID, key) {
-		fs.store.Delete(fs.ID, key)
-		fmt.Printf("[%s] deleted file (%s) from local disk\n", fs.Transport.Addr(), key)
+	tombstone, err := fs.deleteLocal(key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] deleted file (%s) from local disk\n", fs.Transport.Addr(), key)
+
+	hash := crypto.HashKey(key)
+	owners := fs.replicaOwners(fs.ID, hash)
+	peers, errs := fs.connectNodes(owners)
+
+	type result struct {
+		peerID string
+		err    error
 	}
 
+	results := make(chan result, len(peers))
+	for peerID, peer := range peers {
+		go func(peerID string, peer p2p.Peer) {
+			err := fs.sendTombstone(peerID, peer, fs.ID, hash, tombstone)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				results <- result{peerID, fmt.Errorf("peer (%s): %w", peerID, err)}
+				return
+			}
+
+			results <- result{peerID, nil}
+		}(peerID, peer)
+	}
+
+	acked := []string{}
+	for range peers {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		acked = append(acked, res.peerID)
+	}
+
+	fs.handOffDelete(hash, tombstone, missedNodes(owners, acked))
+
+	return errors.Join(errs...)
+}
+
+// deleteLocal replaces the local copy of a file with a tombstone
+func (fs *FileServer) deleteLocal(key string) (storage.Metadata, error) {
+	unlock := fs.writes.acquire(fs.ID, key)
+	defer unlock()
+
+	prev, clock, err := fs.nextClock(key)
+	if err != nil {
+		return storage.Metadata{}, err
+	}
+
+	// a deleted file can be restored from its prior versions
+	if err := fs.store.Archive(fs.ID, key); err != nil {
+		return storage.Metadata{}, err
+	}
+
+	tombstone := storage.Metadata{Version: nextVersion(prev.Version), Deleted: true, Clock: clock, Modified: time.Now(), Name: key}
+	if err := fs.store.WriteTombstone(fs.ID, key, tombstone); err != nil {
+		return storage.Metadata{}, err
+	}
+
+	fs.dropSiblings(fs.ID, key, tombstone)
+
+	return tombstone, nil
+}
+
+// sendTombstone deletes the replica the peer holds for the owner,
+// peers without tombstones answer ErrNotFound when they have none
+func (fs *FileServer) sendTombstone(peerID string, peer p2p.Peer, owner, hash string, tombstone storage.Metadata) error {
 	msg := MessageWrapper{
 		Type:    MessageTypeDelete,
-		Payload: newMessageDeleteFile(fs.ID, crypto.HashKey(key)),
+		Payload: newMessageDeleteFile(owner, hash, tombstone),
 	}
 
-	if err := fs.broadcast(&msg); err != nil {
-		return err
+	_, err := fs.request(peerID, peer, &msg)
+
+	return err
+}
+
+func (fs *FileServer) OnPeer(p p2p.Peer) error {
+	peerID := p2p.PeerID(p)
+	if peerID == fs.ID {
+		return fmt.Errorf("[%s] refusing connection to itself", fs.Transport.Addr())
+	}
+
+	fs.conns.observe(p)
+
+	fs.peerLock.Lock()
+	existing, ok := fs.peers[peerID]
+	if ok && !fs.prefer(p, existing) {
+		fs.peerLock.Unlock()
+		return fmt.Errorf("[%s] already connected to peer (%s)", fs.Transport.Addr(), peerID)
+	}
+
+	fs.peers[peerID] = p
+	fs.stats[peerID] = &peerStats{connectedAt: time.Now()}
+	fs.peerLock.Unlock()
+
+	// the replaced connection is not in the peer list anymore,
+	// so closing it doesn't report the peer as disconnected
+	if ok {
+		existing.Close()
+	}
+
+	fs.publish(PeerEvent{Type: PeerConnected, PeerID: peerID, Peer: p})
+
+	if c, ok := peerContact(peerID, p); ok {
+		fs.dht.Update(c)
+	}
+
+	// a new peer takes its place on the ring right away, the
+	// membership view removes it once it is declared dead
+	fs.ring.Add(ring.Node{ID: peerID, Addr: peerAddr(p)})
+
+	if p.Info().Supports(int(MessageTypeMembership)) {
+		fs.members.Join(peerID, peerAddr(p))
 	}
 
 	return nil
 }
 
-func (fs *FileServer) OnPeer(p p2p.Peer) error {
+// OnPeerDisconnect drops the peer from the peer list and fails the
+// requests still waiting on it. A connection that was already replaced
+// by a newer one to the same node is ignored
+func (fs *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	peerID := p2p.PeerID(p)
+
+	fs.peerLock.Lock()
+	current, ok := fs.peers[peerID]
+	if !ok || current != p {
+		fs.peerLock.Unlock()
+		return
+	}
+
+	delete(fs.peers, peerID)
+	delete(fs.stats, peerID)
+	fs.peerLock.Unlock()
+
+	fmt.Printf("[%s] peer (%s) disconnected\n", fs.Transport.Addr(), peerID)
+
+	fs.failCalls(peerID)
+	fs.publish(PeerEvent{Type: PeerDisconnected, PeerID: peerID, Peer: p})
+
+	// nothing else tells when a peer without a failure detector is gone
+	if !p.Info().Supports(int(MessageTypeMembership)) {
+		fs.ring.Remove(peerID)
+	}
+}
+
+// prefer decides which of two connections to the same node is kept.
+// When both nodes dial each other at once both sides must keep the same
+// one, so the connection dialed by the node with the lower ID wins.
+// Otherwise the newer connection replaces a probably dead one
+func (fs *FileServer) prefer(conn, existing p2p.Peer) bool {
+	dialer := func(p p2p.Peer) string {
+		if p.Outbound() {
+			return fs.ID
+		}
+		return p2p.PeerID(p)
+	}
+
+	if dialer(conn) == dialer(existing) {
+		return true
+	}
+
+	return dialer(conn) < dialer(existing)
+}
+
+func (fs *FileServer) peer(peerID string) (p2p.Peer, bool) {
 	fs.peerLock.Lock()
 	defer fs.peerLock.Unlock()
 
-	fs.peers[p.RemoteAddr().String()] = p
+	peer, ok := fs.peers[peerID]
+	return peer, ok
+}
 
-	return nil
+// peerList returns a snapshot of the connected peers
+func (fs *FileServer) peerList() map[string]p2p.Peer {
+	fs.peerLock.Lock()
+	defer fs.peerLock.Unlock()
+
+	peers := make(map[string]p2p.Peer, len(fs.peers))
+	for peerID, peer := range fs.peers {
+		peers[peerID] = peer
+	}
+
+	return peers
 }
 
 func (fs *FileServer) loop() {
 	defer func() {
 		log.Println("File server stopped due to stopped question")
+		fs.members.Stop()
+		fs.dht.Stop()
 		fs.Transport.Close()
 	}()
 
 	for {
 		select {
 		case rpc := <-fs.Transport.Consume():
-			var msg MessageWrapper
-
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Println("decoding error: ", err)
-			}
-
-			if err := fs.handleMessage(rpc.From, &msg); err != nil {
-				log.Println("handling message error: ", err)
-			}
+			fs.handleRPC(rpc)
 
 		case <-fs.quitChannel:
 			return
@@ -209,37 +971,117 @@ func (fs *FileServer) loop() {
 	}
 }
 
-func (fs *FileServer) broadcast(msg *MessageWrapper) error {
-	buf := new(bytes.Buffer)
+func (fs *FileServer) handleRPC(rpc p2p.RPC) {
+	var msg MessageWrapper
 
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
+	if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
+		log.Println("decoding error: ", err)
+
+		if rpc.Stream != nil {
+			rpc.Stream.Reset()
+		}
+		return
 	}
 
-	for _, peer := range fs.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+	if msg.Version > ProtocolVersion {
+		log.Printf("[%s] message from (%s) in unknown protocol version %d\n", fs.Transport.Addr(), rpc.From, msg.Version)
+
+		if rpc.Stream != nil {
+			rpc.Stream.Reset()
 		}
+		return
 	}
 
-	return nil
+	// streams are served on their own, the transport keeps feeding their
+	// data only while the loop is free. So are deletes, they wait for the
+	// lock of the file a replica stream may hold while it is received
+	if rpc.Stream != nil || msg.Type == MessageTypeDelete {
+		go fs.dispatch(rpc.From, &msg, rpc.Stream)
+		return
+	}
+
+	fs.dispatch(rpc.From, &msg, rpc.Stream)
 }
 
+func (fs *FileServer) dispatch(from string, msg *MessageWrapper, stream p2p.Stream) {
+	if err := fs.handleMessage(from, msg, stream); err != nil {
+		log.Println("handling message error: ", err)
+	}
+}
+
+func encodeMessage(msg *MessageWrapper) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bootstrapNetwork connects to the bootstrap nodes, the connection
+// manager keeps dialing the ones not up yet and redials lost peers
 func (fs *FileServer) bootstrapNetwork() error {
 	for _, addr := range fs.BootstrapNodes {
-
 		if len(addr) == 0 {
 			continue
 		}
 
-		go func(addr string) {
-			fmt.Printf("[%s] attempting to connect with remote %s\n", fs.Transport.Addr(), addr)
-			if err := fs.Transport.Dial(addr); err != nil {
-				log.Println("dial error ", err)
-			}
-		}(addr)
+		fmt.Printf("[%s] attempting to connect with remote %s\n", fs.Transport.Addr(), addr)
+		fs.conns.addBootstrap(addr)
 	}
 
+	go fs.conns.run()
+
 	return nil
 }
+
+// replicaWriter keeps a failing replica from aborting the
+// copy to the others, the error is reported once all is sent
+type replicaWriter struct {
+	peerID string
+	call   *call
+	stream p2p.Stream
+	// compressor is set when the data goes compressed over the wire
+	compressor *flate.Writer
+	err        error
+}
+
+func newReplicaWriter(peerID string, c *call, stream p2p.Stream, compressed bool) *replicaWriter {
+	w := &replicaWriter{peerID: peerID, call: c, stream: stream}
+
+	if compressed {
+		w.compressor, _ = flate.NewWriter(stream, flate.DefaultCompression)
+	}
+
+	return w
+}
+
+func (w *replicaWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return len(b), nil
+	}
+
+	if w.compressor != nil {
+		_, w.err = w.compressor.Write(b)
+	} else {
+		_, w.err = w.stream.Write(b)
+	}
+
+	return len(b), nil
+}
+
+// finish flushes what is left and closes the stream,
+// a replica that failed gets its stream reset instead
+func (w *replicaWriter) finish() {
+	if w.err == nil && w.compressor != nil {
+		w.err = w.compressor.Close()
+	}
+
+	if w.err != nil {
+		w.stream.Reset()
+		return
+	}
+
+	w.stream.Close()
+}
@@ -0,0 +1,1510 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/crypto"
+	"github.com/Yaroslaw07/difis/pkg/dht"
+	"github.com/Yaroslaw07/difis/pkg/membership"
+	"github.com/Yaroslaw07/difis/pkg/merkle"
+	"github.com/Yaroslaw07/difis/pkg/p2p"
+	"github.com/Yaroslaw07/difis/pkg/p2p/transports/fault"
+	"github.com/Yaroslaw07/difis/pkg/p2p/transports/mem"
+	"github.com/Yaroslaw07/difis/pkg/storage"
+	"github.com/Yaroslaw07/difis/pkg/vclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, network *mem.Network, addr string, nodes ...string) *FileServer {
+	return newTestServerWithProtocol(t, network, Protocol(), addr, nodes...)
+}
+
+func newTestServerWithProtocol(t *testing.T, network *mem.Network, protocol p2p.Protocol, addr string, nodes ...string) *FileServer {
+	return newTestServerWithOpts(t, network, protocol, addr, FileServerOpts{BootstrapNodes: nodes})
+}
+
+func newTestServerWithOpts(t *testing.T, network *mem.Network, protocol p2p.Protocol, addr string, opts FileServerOpts) *FileServer {
+	identity, err := crypto.NewIdentity()
+	require.Nil(t, err)
+
+	transport := mem.NewMemTransport(mem.MemTransportOpts{
+		ListenAddr: addr,
+		Network:    network,
+		HandshakeFunc: p2p.NewAuthHandshakeFunc(p2p.HandshakeOpts{
+			Identity:   identity,
+			Protocol:   protocol,
+			ListenAddr: addr,
+		}),
+		Decoder: p2p.DefaultDecoder{},
+	})
+
+	opts.Identity = identity
+	opts.EncKey = crypto.NewEncryptionKey()
+	opts.StorageRoot = t.TempDir()
+	opts.PathTransformFunc = storage.CASPathTransformFunc
+	opts.Transport = transport
+
+	fs := NewFileServer(opts)
+
+	go fs.Start()
+	t.Cleanup(fs.Stop)
+
+	require.Eventually(t, func() bool {
+		return slices.Contains(network.Addrs(), addr)
+	}, 5*time.Second, time.Millisecond)
+
+	return fs
+}
+
+func newFaultyServer(t *testing.T, network *mem.Network, controller *fault.Controller, addr string, opts FileServerOpts) *FileServer {
+	// without a handshake peers know the node by its address
+	opts.ID = addr
+	opts.EncKey = crypto.NewEncryptionKey()
+	opts.StorageRoot = t.TempDir()
+	opts.Transport = fault.NewFaultTransport(fault.FaultTransportOpts{
+		Transport:  mem.NewMemTransport(mem.MemTransportOpts{ListenAddr: addr, Network: network}),
+		Controller: controller,
+	})
+
+	fs := NewFileServer(opts)
+
+	go fs.Start()
+	t.Cleanup(fs.Stop)
+
+	require.Eventually(t, func() bool {
+		return slices.Contains(network.Addrs(), addr)
+	}, 5*time.Second, time.Millisecond)
+
+	return fs
+}
+
+func waitForPeers(t *testing.T, fs *FileServer, n int) {
+	require.Eventually(t, func() bool {
+		return len(fs.peerList()) == n
+	}, 5*time.Second, time.Millisecond)
+}
+
+// waitForMesh waits until every node is connected to every other one
+// and each pair agrees on its connection. Right after two nodes dialed
+// each other at once both connections exist, and requests on the one
+// about to be dropped fail
+func waitForMesh(t *testing.T, nodes []*FileServer) {
+	require.Eventually(t, func() bool {
+		for _, a := range nodes {
+			for _, b := range nodes {
+				if a == b {
+					continue
+				}
+
+				ab, ok := a.peer(b.ID)
+				if !ok {
+					return false
+				}
+
+				ba, ok := b.peer(a.ID)
+				if !ok || ab.Outbound() == ba.Outbound() {
+					return false
+				}
+			}
+		}
+
+		return true
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestFileServerCluster(t *testing.T) {
+	network := mem.NewNetwork()
+
+	seed := newTestServer(t, network, "seed")
+
+	nodes := []*FileServer{}
+	for i := 0; i < 24; i++ {
+		nodes = append(nodes, newTestServer(t, network, fmt.Sprintf("node-%d", i), "seed"))
+	}
+
+	// the nodes learn about each other from the seed and form a full mesh
+	waitForPeers(t, seed, len(nodes))
+	for _, fs := range nodes {
+		waitForPeers(t, fs, len(nodes))
+	}
+
+	for i, fs := range nodes {
+		key := fmt.Sprintf("picture_%d.jpg", i)
+		data := []byte(fmt.Sprintf("big data file of node %d", i))
+
+		require.NoError(t, fs.Save(key, bytes.NewReader(data)))
+		require.Nil(t, fs.DeleteLocally(key))
+
+		r, err := fs.Load(key)
+		require.Nil(t, err)
+
+		loaded, err := io.ReadAll(r)
+		require.Nil(t, err)
+		assert.Equal(t, data, loaded)
+
+		require.Nil(t, fs.Delete(key))
+		assert.False(t, seed.store.Has(fs.ID, crypto.HashKey(key)))
+
+		_, err = fs.Load(key)
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+}
+
+func TestFileServerPeersByNodeID(t *testing.T) {
+	network := mem.NewNetwork()
+
+	a := newTestServer(t, network, "a")
+	b := newTestServer(t, network, "b")
+
+	// both nodes dial each other at once, only one connection may survive
+	go a.Transport.Dial("b")
+	go b.Transport.Dial("a")
+
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	_, ok := a.peer(b.ID)
+	assert.True(t, ok, "peer not keyed by its node ID")
+
+	require.Eventually(t, func() bool {
+		pa, _ := a.peer(b.ID)
+		pb, _ := b.peer(a.ID)
+		return pa != nil && pb != nil && pa.Outbound() != pb.Outbound()
+	}, time.Second, time.Millisecond)
+
+	require.Nil(t, a.Save("key", bytes.NewReader([]byte("data"))))
+	assert.True(t, b.store.Has(a.ID, crypto.HashKey("key")))
+}
+
+func TestFileServerPeerDisconnect(t *testing.T) {
+	network := mem.NewNetwork()
+
+	a := newTestServer(t, network, "a")
+	b := newTestServer(t, network, "b", "a")
+
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	events, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	// a request a never answers is released by the disconnect
+	c := b.newCall(a.ID)
+	defer b.finishCall(c)
+
+	peer, ok := a.peer(b.ID)
+	require.True(t, ok)
+	require.Nil(t, peer.Close())
+
+	select {
+	case event := <-events:
+		assert.Equal(t, PeerDisconnected, event.Type)
+		assert.Equal(t, a.ID, event.PeerID)
+	case <-time.After(time.Second):
+		t.Fatal("no disconnect event")
+	}
+
+	_, err := b.await(c)
+	assert.ErrorIs(t, err, ErrPeerGone)
+
+	waitForPeers(t, a, 0)
+	waitForPeers(t, b, 0)
+
+	// nobody is left to replicate to, saving must not fail on the dead peer
+	require.Nil(t, b.Save("key", bytes.NewReader([]byte("data"))))
+}
+
+func TestFileServerReconnect(t *testing.T) {
+	network := mem.NewNetwork()
+
+	opts := FileServerOpts{
+		BootstrapNodes:      []string{"a"},
+		ReconnectBackoff:    10 * time.Millisecond,
+		MaxReconnectBackoff: 50 * time.Millisecond,
+	}
+
+	// b comes up before its bootstrap node and keeps trying
+	b := newTestServerWithOpts(t, network, Protocol(), "b", opts)
+	time.Sleep(100 * time.Millisecond)
+
+	a := newTestServer(t, network, "a")
+	waitForPeers(t, b, 1)
+
+	lost, ok := b.peer(a.ID)
+	require.True(t, ok)
+	require.Nil(t, lost.Close())
+
+	require.Eventually(t, func() bool {
+		peer, ok := b.peer(a.ID)
+		return ok && peer != lost
+	}, time.Second, time.Millisecond)
+
+	waitForPeers(t, a, 1)
+}
+
+func TestFileServerRedialTargets(t *testing.T) {
+	network := mem.NewNetwork()
+
+	opts := FileServerOpts{
+		ReconnectBackoff:    10 * time.Millisecond,
+		MaxReconnectBackoff: 50 * time.Millisecond,
+	}
+
+	a := newTestServerWithOpts(t, network, Protocol(), "a", opts)
+	b := newTestServerWithOpts(t, network, Protocol(), "b", opts)
+	c := newTestServerWithOpts(t, network, Protocol(), "c", opts)
+
+	// a node dialed for a request is not dialed again once lost
+	peer, err := a.connect(b.ID, "b")
+	require.Nil(t, err)
+	require.Nil(t, peer.Close())
+
+	waitForPeers(t, a, 0)
+	time.Sleep(100 * time.Millisecond)
+	waitForPeers(t, a, 0)
+
+	// a node learned from peer exchange is, until declared dead
+	require.True(t, a.conns.add(c.ID, "c", 0))
+	waitForPeers(t, a, 1)
+
+	a.placeMember(membership.Member{ID: c.ID, Addr: "c", State: membership.StateDead})
+
+	a.conns.lock.Lock()
+	assert.Empty(t, a.conns.targets)
+	a.conns.lock.Unlock()
+}
+
+func TestFileServerMixedProtocols(t *testing.T) {
+	network := mem.NewNetwork()
+
+	// an older node, without compression and without deletes
+	old := Protocol()
+	old.MessageTypes = []int{int(MessageTypeSave), int(MessageTypeLoad), int(MessageTypeResponse)}
+	old.Features = nil
+
+	a := newTestServerWithProtocol(t, network, old, "a")
+	b := newTestServer(t, network, "b", "a")
+	waitForPeers(t, b, 1)
+
+	peer, _ := b.peer(a.ID)
+	assert.False(t, peer.Info().HasFeature(FeatureCompression))
+
+	require.Nil(t, b.Save("key", bytes.NewReader([]byte("uncompressed data"))))
+	require.Nil(t, b.DeleteLocally("key"))
+
+	r, err := b.Load("key")
+	require.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "uncompressed data", string(data))
+
+	assert.ErrorIs(t, b.Delete("key"), ErrUnsupported)
+}
+
+func TestFileServerPartition(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{RequestTimeout: 100 * time.Millisecond}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+	b := newFaultyServer(t, network, controller, "b", opts)
+
+	opts.BootstrapNodes = []string{"a", "b"}
+	c := newFaultyServer(t, network, controller, "c", opts)
+	waitForPeers(t, c, 2)
+
+	controller.Partition("lost-b", []string{"a", "c"}, []string{"b"})
+
+	// a quorum of two replicas needs both
+	err := c.Save("key", bytes.NewReader([]byte("data")))
+	assert.ErrorIs(t, err, ErrNotEnoughReplicas)
+	assert.ErrorIs(t, err, fault.ErrPartitioned)
+	require.Eventually(t, func() bool {
+		return a.store.Has(c.ID, crypto.HashKey("key"))
+	}, time.Second, time.Millisecond)
+	assert.False(t, b.store.Has(c.ID, crypto.HashKey("key")))
+
+	// requests into the partition time out instead of hanging
+	err = c.Delete("key")
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+	assert.False(t, a.store.Has(c.ID, crypto.HashKey("key")))
+
+	controller.Heal("lost-b")
+}
+
+func TestFileServerWriteConsistency(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{RequestTimeout: 100 * time.Millisecond}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+	b := newFaultyServer(t, network, controller, "b", opts)
+	c := newFaultyServer(t, network, controller, "c", opts)
+
+	opts.BootstrapNodes = []string{"a", "b", "c"}
+	d := newFaultyServer(t, network, controller, "d", opts)
+	waitForPeers(t, d, 3)
+
+	// one of the three replicas can't be written
+	controller.Partition("lost-b", []string{"a", "c", "d"}, []string{"b"})
+	defer controller.Heal("lost-b")
+
+	for _, tc := range []struct {
+		consistency Consistency
+		fails       bool
+	}{
+		{ConsistencyOne, false},
+		{ConsistencyQuorum, false},
+		{ConsistencyAll, true},
+	} {
+		d.WriteConsistency = tc.consistency
+
+		err := d.Save("key", bytes.NewReader([]byte("data")))
+		if tc.fails {
+			assert.ErrorIs(t, err, ErrNotEnoughReplicas, "consistency %s", tc.consistency)
+		} else {
+			assert.NoError(t, err, "consistency %s", tc.consistency)
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return a.store.Has(d.ID, crypto.HashKey("key")) && c.store.Has(d.ID, crypto.HashKey("key"))
+	}, time.Second, time.Millisecond)
+	assert.False(t, b.store.Has(d.ID, crypto.HashKey("key")))
+}
+
+func TestFileServerReadRepair(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{RequestTimeout: 100 * time.Millisecond}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+	b := newFaultyServer(t, network, controller, "b", opts)
+
+	opts.BootstrapNodes = []string{"a", "b"}
+	c := newFaultyServer(t, network, controller, "c", opts)
+	waitForPeers(t, c, 2)
+
+	hash := crypto.HashKey("key")
+	require.Nil(t, c.Save("key", bytes.NewReader([]byte("version 1"))))
+
+	// a misses the second version
+	controller.Partition("lost-a", []string{"b", "c"}, []string{"a"})
+	c.WriteConsistency = ConsistencyOne
+	require.Nil(t, c.Save("key", bytes.NewReader([]byte("version 2"))))
+	controller.Heal("lost-a")
+
+	stale, _ := a.store.ReadMetadata(c.ID, hash)
+	newest, _ := b.store.ReadMetadata(c.ID, hash)
+	require.True(t, newest.Newer(stale))
+
+	// reading all replicas finds the newest and repairs the stale one
+	c.ReadConsistency = ConsistencyAll
+	require.Nil(t, c.DeleteLocally("key"))
+
+	r, err := c.Load("key")
+	require.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "version 2", string(data))
+
+	require.Eventually(t, func() bool {
+		meta, _ := a.store.ReadMetadata(c.ID, hash)
+		return meta.Equal(newest)
+	}, time.Second, time.Millisecond)
+
+	// without enough replicas answering the read fails
+	controller.Partition("lost-ab", []string{"c"}, []string{"a", "b"})
+	defer controller.Heal("lost-ab")
+
+	require.Nil(t, c.DeleteLocally("key"))
+	_, err = c.Load("key")
+	assert.ErrorIs(t, err, ErrNotEnoughReplicas)
+}
+
+func TestFileServerConcurrentSaves(t *testing.T) {
+	network := mem.NewNetwork()
+	a := newTestServer(t, network, "a")
+
+	opts := FileServerOpts{BootstrapNodes: []string{"a"}}
+	b := newTestServerWithOpts(t, network, Protocol(), "b", opts)
+	waitForPeers(t, b, 1)
+
+	hash := crypto.HashKey("key")
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// a save losing to a newer one on the replica fails
+				b.Save("key", bytes.NewReader([]byte(fmt.Sprintf("round %d save %d", round, i))))
+			}(i)
+		}
+		wg.Wait()
+
+		newest, err := b.store.ReadMetadata(b.ID, "key")
+		require.Nil(t, err)
+
+		// the replica ends up on the newest version, with its content
+		require.Eventually(t, func() bool {
+			meta, _ := a.store.ReadMetadata(b.ID, hash)
+			return meta.Equal(newest)
+		}, time.Second, time.Millisecond, "round %d", round)
+
+		_, r, err := a.store.Read(b.ID, hash)
+		require.Nil(t, err)
+		h := sha256.New()
+		_, err = crypto.CopyDecrypt(b.EncKey, r, h)
+		r.(io.Closer).Close()
+		require.Nil(t, err)
+		assert.Equal(t, newest.Checksum, hex.EncodeToString(h.Sum(nil)), "round %d", round)
+	}
+}
+
+func TestFileServerDeleteWhileLocked(t *testing.T) {
+	network := mem.NewNetwork()
+	a := newTestServer(t, network, "a")
+	b := newTestServer(t, network, "b", "a")
+	waitForPeers(t, b, 1)
+
+	require.Nil(t, b.Save("key", bytes.NewReader([]byte("data"))))
+
+	hash := crypto.HashKey("key")
+	peer, ok := b.peer(a.ID)
+	require.True(t, ok)
+
+	// a replica being received holds the lock of the file
+	unlock := a.writes.acquire(b.ID, hash)
+
+	tombstone, err := b.store.ReadMetadata(b.ID, "key")
+	require.Nil(t, err)
+	tombstone.Version++
+	tombstone.Deleted = true
+
+	deleted := make(chan error, 1)
+	go func() {
+		deleted <- b.sendTombstone(a.ID, peer, b.ID, hash, tombstone)
+	}()
+
+	require.Eventually(t, func() bool {
+		a.writes.lock.Lock()
+		defer a.writes.lock.Unlock()
+
+		return a.writes.locks[b.ID+"/"+hash].waiting == 2
+	}, time.Second, time.Millisecond)
+
+	// the delete waiting for it doesn't stop a from answering
+	msg := MessageWrapper{
+		Type:    MessageTypeStat,
+		Payload: MessageStatFile{Message: Message{ID: b.ID, Key: hash}},
+	}
+	_, err = b.request(a.ID, peer, &msg)
+	require.Nil(t, err)
+
+	unlock()
+	require.Nil(t, <-deleted)
+
+	meta, err := a.store.ReadMetadata(b.ID, hash)
+	require.Nil(t, err)
+	assert.True(t, meta.Deleted)
+}
+
+func TestFileServerLoadDuringSave(t *testing.T) {
+	network := mem.NewNetwork()
+	newTestServer(t, network, "a")
+	b := newTestServer(t, network, "b", "a")
+	waitForPeers(t, b, 1)
+
+	require.Nil(t, b.Save("key", bytes.NewReader([]byte("version 1"))))
+	require.Nil(t, b.DeleteLocally("key"))
+
+	// a save of the file holds its lock while the load fetches it
+	unlock := b.writes.acquire(b.ID, "key")
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	loaded := make(chan result, 1)
+	go func() {
+		r, err := b.Load("key")
+		if err != nil {
+			loaded <- result{err: err}
+			return
+		}
+
+		data, err := io.ReadAll(r)
+		r.(io.Closer).Close()
+		loaded <- result{data, err}
+	}()
+
+	require.Eventually(t, func() bool {
+		b.writes.lock.Lock()
+		defer b.writes.lock.Unlock()
+
+		return b.writes.locks[b.ID+"/key"].waiting == 2
+	}, time.Second, time.Millisecond)
+
+	prev, err := b.store.ReadMetadata(b.ID, "key")
+	require.Nil(t, err)
+
+	_, err = b.store.Write(b.ID, "key", bytes.NewReader([]byte("version 2")))
+	require.Nil(t, err)
+	newest := storage.Metadata{Version: prev.Version + 1, Size: 9, Name: "key"}
+	require.Nil(t, b.store.WriteMetadata(b.ID, "key", newest))
+	unlock()
+
+	// the load serves the saved version and leaves it in place
+	res := <-loaded
+	require.Nil(t, res.err)
+	assert.Equal(t, "version 2", string(res.data))
+
+	meta, err := b.store.ReadMetadata(b.ID, "key")
+	require.Nil(t, err)
+	assert.True(t, meta.Equal(newest))
+}
+
+func TestFileServerAntiEntropy(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{
+		RequestTimeout:      100 * time.Millisecond,
+		WriteConsistency:    ConsistencyOne,
+		AntiEntropyInterval: 50 * time.Millisecond,
+	}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+	b := newFaultyServer(t, network, controller, "b", opts)
+
+	opts.BootstrapNodes = []string{"a", "b"}
+	c := newFaultyServer(t, network, controller, "c", opts)
+	waitForPeers(t, c, 2)
+
+	require.Nil(t, c.Save("updated", bytes.NewReader([]byte("version 1"))))
+
+	// a misses a new file and a new version while it is away
+	controller.Partition("lost-a", []string{"b", "c"}, []string{"a"})
+	require.Nil(t, c.Save("updated", bytes.NewReader([]byte("version 2"))))
+	require.Nil(t, c.Save("missed", bytes.NewReader([]byte("missed"))))
+	controller.Heal("lost-a")
+
+	// nobody reads the files, the replicas catch up on their own
+	for _, key := range []string{"updated", "missed"} {
+		hash := crypto.HashKey(key)
+		newest, _ := c.store.ReadMetadata(c.ID, key)
+
+		require.Eventually(t, func() bool {
+			meta, _ := a.store.ReadMetadata(c.ID, hash)
+			return meta.Equal(newest)
+		}, 2*time.Second, 10*time.Millisecond, key)
+
+		meta, _ := b.store.ReadMetadata(c.ID, hash)
+		assert.Equal(t, newest, meta, key)
+	}
+}
+
+func TestFileServerSyncTreeDepth(t *testing.T) {
+	network := mem.NewNetwork()
+
+	a := newTestServer(t, network, "a")
+	b := newTestServer(t, network, "b", "a")
+	waitForPeers(t, b, 1)
+
+	peer, ok := b.peer(a.ID)
+	require.True(t, ok)
+
+	// trees a peer sends with a depth a doesn't compare with are refused
+	for _, depth := range []int{0, -1, merkle.DefaultDepth + 1} {
+		msg := MessageWrapper{
+			Type:    MessageTypeSyncTree,
+			Payload: MessageSyncTree{Owner: b.ID, Depth: depth, Leaves: []merkle.Hash{{}}},
+		}
+
+		_, err := b.request(a.ID, peer, &msg)
+		assert.NotNil(t, err, "depth %d", depth)
+	}
+
+	// and a keeps serving
+	require.Nil(t, b.Save("key", bytes.NewReader([]byte("data"))))
+}
+
+func TestFileServerTombstones(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{
+		RequestTimeout:       100 * time.Millisecond,
+		ReplicationFactor:    2,
+		WriteConsistency:     ConsistencyOne,
+		AntiEntropyInterval:  50 * time.Millisecond,
+		TombstoneGracePeriod: time.Second,
+	}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+	opts.BootstrapNodes = []string{"a"}
+	b := newFaultyServer(t, network, controller, "b", opts)
+	opts.BootstrapNodes = []string{"a", "b"}
+	c := newFaultyServer(t, network, controller, "c", opts)
+	waitForMesh(t, []*FileServer{a, b, c})
+
+	hash := crypto.HashKey("key")
+	require.Nil(t, c.Save("key", bytes.NewReader([]byte("data"))))
+	require.Eventually(t, func() bool {
+		return a.store.Has(c.ID, hash) && b.store.Has(c.ID, hash)
+	}, time.Second, time.Millisecond)
+
+	// b misses the delete, so it still holds the file
+	controller.Partition("lost-b", []string{"b"}, []string{"a", "c"})
+	assert.NotNil(t, c.Delete("key"))
+
+	tombstone, _ := c.store.ReadMetadata(c.ID, "key")
+	require.True(t, tombstone.Deleted)
+
+	meta, _ := a.store.ReadMetadata(c.ID, hash)
+	assert.True(t, tombstone.Equal(meta))
+	assert.False(t, a.store.Has(c.ID, hash))
+	assert.True(t, b.store.Has(c.ID, hash))
+
+	_, err := c.Load("key")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// anti-entropy deletes it instead of bringing it back
+	controller.Heal("lost-b")
+
+	require.Eventually(t, func() bool {
+		meta, _ := b.store.ReadMetadata(c.ID, hash)
+		return meta.Equal(tombstone) && !b.store.Has(c.ID, hash)
+	}, time.Second, 10*time.Millisecond)
+
+	// replicas report the tombstone as the newest version
+	msg := MessageWrapper{
+		Type:    MessageTypeStat,
+		Payload: MessageStatFile{Message: Message{ID: c.ID, Key: hash}},
+	}
+	peer, ok := c.peer(a.ID)
+	require.True(t, ok)
+	resp, err := c.request(a.ID, peer, &msg)
+	require.Nil(t, err)
+	assert.True(t, resp.Meta.Deleted)
+
+	// the tombstones are gone once past the grace period
+	require.Eventually(t, func() bool {
+		for _, fs := range []*FileServer{a, b, c} {
+			owner, key := c.ID, hash
+			if fs == c {
+				key = "key"
+			}
+
+			if meta, _ := fs.store.ReadMetadata(owner, key); !meta.Equal(storage.Metadata{}) {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 10*time.Millisecond)
+
+	require.Nil(t, c.Save("key", bytes.NewReader([]byte("new data"))))
+	r, err := c.Load("key")
+	require.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "new data", string(data))
+}
+
+func TestFileServerSiblings(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{
+		ReplicationFactor: 2,
+		WriteConsistency:  ConsistencyAll,
+		ConflictResolver:  KeepSiblings,
+	}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+	opts.BootstrapNodes = []string{"a"}
+	b := newFaultyServer(t, network, controller, "b", opts)
+	opts.BootstrapNodes = []string{"a", "b"}
+	c := newFaultyServer(t, network, controller, "c", opts)
+	waitForMesh(t, []*FileServer{a, b, c})
+
+	require.Nil(t, c.Save("key", bytes.NewReader([]byte("first"))))
+	first, _ := c.store.ReadMetadata(c.ID, "key")
+
+	siblings, err := c.Siblings("key")
+	require.Nil(t, err)
+	assert.Empty(t, siblings)
+
+	// a node that lost its files writes without knowing the first version
+	require.Nil(t, c.store.Delete(c.ID, "key"))
+	require.Nil(t, c.Save("key", bytes.NewReader([]byte("second"))))
+
+	second, _ := c.store.ReadMetadata(c.ID, "key")
+	require.True(t, second.Concurrent(first))
+
+	for _, fs := range []*FileServer{a, b} {
+		meta, _ := fs.store.ReadMetadata(c.ID, crypto.HashKey("key"))
+		assert.True(t, meta.Equal(second))
+	}
+
+	siblings, err = c.Siblings("key")
+	require.Nil(t, err)
+	require.Len(t, siblings, 1)
+	assert.True(t, siblings[0].Equal(first))
+
+	r, err := c.LoadSibling("key", first.Version)
+	require.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "first", string(data))
+
+	// the next version is written after both, so it resolves them
+	require.Nil(t, c.Save("key", bytes.NewReader([]byte("merged"))))
+
+	merged, _ := c.store.ReadMetadata(c.ID, "key")
+	assert.True(t, merged.Newer(first) && merged.Newer(second))
+
+	siblings, err = c.Siblings("key")
+	require.Nil(t, err)
+	assert.Empty(t, siblings)
+}
+
+func TestFileServerSiblingsAcrossNodes(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{
+		ReplicationFactor: 1,
+		WriteConsistency:  ConsistencyAll,
+		ConflictResolver:  KeepSiblings,
+	}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+	opts.BootstrapNodes = []string{"a"}
+	b := newFaultyServer(t, network, controller, "b", opts)
+	waitForMesh(t, []*FileServer{a, b})
+
+	// two nodes save the same key without knowing about each other
+	require.Nil(t, a.Save("key", bytes.NewReader([]byte("from a"))))
+	require.Nil(t, b.Save("key", bytes.NewReader([]byte("from b"))))
+
+	fromA, _ := a.store.ReadMetadata(a.ID, "key")
+	fromB, _ := b.store.ReadMetadata(b.ID, "key")
+	require.True(t, fromA.Concurrent(fromB))
+
+	siblings, err := a.Siblings("key")
+	require.Nil(t, err)
+	require.Len(t, siblings, 1)
+	assert.True(t, siblings[0].Equal(fromB))
+
+	siblings, err = b.Siblings("key")
+	require.Nil(t, err)
+	require.Len(t, siblings, 1)
+	assert.True(t, siblings[0].Equal(fromA))
+
+	r, err := a.LoadSibling("key", fromB.Version)
+	require.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "from b", string(data))
+
+	// the next save on either node is written after both
+	require.Nil(t, a.Save("key", bytes.NewReader([]byte("merged"))))
+
+	merged, _ := a.store.ReadMetadata(a.ID, "key")
+	assert.True(t, merged.Newer(fromA) && merged.Newer(fromB))
+	assert.Equal(t, vclock.Clock{a.ID: 2, b.ID: 1}, merged.Clock)
+
+	for _, fs := range []*FileServer{a, b} {
+		siblings, err = fs.Siblings("key")
+		require.Nil(t, err)
+		assert.Empty(t, siblings)
+	}
+}
+
+func TestFileServerVersions(t *testing.T) {
+	network := mem.NewNetwork()
+	fs := newTestServerWithOpts(t, network, Protocol(), "a", FileServerOpts{KeepVersions: 2})
+
+	load := func(r io.Reader, err error) string {
+		require.Nil(t, err)
+		data, _ := io.ReadAll(r)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		return string(data)
+	}
+
+	for _, data := range []string{"one", "two", "three", "four"} {
+		require.Nil(t, fs.Save("key", bytes.NewReader([]byte(data))))
+	}
+
+	// the current version and the two prior ones
+	versions, err := fs.Versions("key")
+	require.Nil(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, "four", load(fs.LoadVersion("key", versions[0].Version)))
+	assert.Equal(t, "two", load(fs.LoadVersion("key", versions[2].Version)))
+
+	_, err = fs.LoadVersion("key", versions[2].Version-1)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// a restored version is the next one
+	two := versions[2]
+	require.Nil(t, fs.Restore("key", two.Version))
+	assert.Equal(t, "two", load(fs.Load("key")))
+
+	restored, err := fs.Versions("key")
+	require.Nil(t, err)
+	require.Len(t, restored, 3)
+	assert.Equal(t, two.Checksum, restored[0].Checksum)
+	assert.True(t, restored[0].Newer(versions[0]))
+
+	// so is a deleted one
+	assert.Nil(t, fs.Delete("key"))
+	_, err = fs.Load("key")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	deleted, err := fs.Versions("key")
+	require.Nil(t, err)
+	require.Len(t, deleted, 2)
+
+	require.Nil(t, fs.Restore("key", deleted[0].Version))
+	assert.Equal(t, "two", load(fs.Load("key")))
+}
+
+func TestFileServerStat(t *testing.T) {
+	network := mem.NewNetwork()
+	a := newTestServer(t, network, "a")
+
+	opts := FileServerOpts{BootstrapNodes: []string{"a"}}
+	b := newTestServerWithOpts(t, network, Protocol(), "b", opts)
+	waitForPeers(t, b, 1)
+
+	tags := map[string]string{"owner": "b"}
+	require.Nil(t, b.SaveWithOptions("notes.txt", bytes.NewReader([]byte("some notes")), SaveOptions{Tags: tags}))
+
+	entry, err := b.Stat("notes.txt")
+	require.Nil(t, err)
+	assert.Equal(t, "notes.txt", entry.Key)
+	assert.Equal(t, int64(10), entry.Size)
+	assert.Equal(t, "text/plain; charset=utf-8", entry.ContentType)
+	assert.Equal(t, tags, entry.Tags)
+	assert.False(t, entry.Created.IsZero())
+
+	// the metadata goes with the replicas
+	replica, _ := a.store.ReadMetadata(b.ID, crypto.HashKey("notes.txt"))
+	assert.True(t, replica.Equal(entry.Metadata))
+
+	require.Nil(t, b.DeleteLocally("notes.txt"))
+	fetched, err := b.Stat("notes.txt")
+	require.Nil(t, err)
+	assert.Equal(t, "notes.txt", fetched.Key)
+	assert.True(t, fetched.Equal(entry.Metadata))
+
+	// without an extension the content tells the type
+	require.Nil(t, b.Save("page", bytes.NewReader([]byte("<html><body>hi</body></html>"))))
+	page, err := b.Stat("page")
+	require.Nil(t, err)
+	assert.Equal(t, "text/html; charset=utf-8", page.ContentType)
+
+	r, err := b.Load("page")
+	require.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "<html><body>hi</body></html>", string(data))
+
+	// a new version keeps when the file was created
+	require.Nil(t, b.SaveWithOptions("page", bytes.NewReader([]byte("{}")), SaveOptions{ContentType: "application/json"}))
+	updated, err := b.Stat("page")
+	require.Nil(t, err)
+	assert.Equal(t, "application/json", updated.ContentType)
+	assert.True(t, updated.Created.Equal(page.Created))
+	assert.True(t, updated.Modified.After(page.Modified))
+
+	require.Nil(t, b.Delete("page"))
+	_, err = b.Stat("page")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = b.Stat("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFileServerList(t *testing.T) {
+	network := mem.NewNetwork()
+	a := newTestServer(t, network, "a")
+
+	opts := FileServerOpts{BootstrapNodes: []string{"a"}}
+	b := newTestServerWithOpts(t, network, Protocol(), "b", opts)
+	waitForPeers(t, b, 1)
+
+	for _, key := range []string{"docs/3", "docs/1", "img/1", "docs/2", "docs/4"} {
+		require.Nil(t, b.Save(key, bytes.NewReader([]byte(key))))
+	}
+	require.Nil(t, b.Delete("docs/2"))
+
+	keys := func(entries []storage.Entry) []string {
+		keys := []string{}
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		return keys
+	}
+
+	list := func(fs *FileServer) []string {
+		all := []string{}
+		cursor := ""
+		for {
+			page, next, err := fs.List("docs/", cursor, 2)
+			require.Nil(t, err)
+			require.LessOrEqual(t, len(page), 2)
+			all = append(all, keys(page)...)
+			if next == "" {
+				return all
+			}
+			cursor = next
+		}
+	}
+
+	assert.Equal(t, []string{"docs/1", "docs/3", "docs/4"}, list(b))
+
+	local, next, err := b.ListLocally("", "", 0)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"docs/1", "docs/3", "docs/4", "img/1"}, keys(local))
+	assert.Empty(t, next)
+
+	// the replicas are stored by the hash of the key and listed by the key
+	replicas, next, err := a.store.Keys(b.ID, "docs/", "", 0)
+	require.Nil(t, err)
+	assert.Empty(t, next)
+	require.Len(t, replicas, 3)
+	assert.Equal(t, crypto.HashKey("docs/1"), replicas[0].Key)
+	assert.Equal(t, "docs/1", replicas[0].Name)
+
+	// files lost locally are listed from their replicas, deleted ones are not
+	for _, key := range []string{"docs/1", "docs/2", "docs/3", "docs/4", "img/1"} {
+		require.Nil(t, b.DeleteLocally(key))
+	}
+
+	local, _, err = b.ListLocally("", "", 0)
+	require.Nil(t, err)
+	assert.Empty(t, local)
+
+	assert.Equal(t, []string{"docs/1", "docs/3", "docs/4"}, list(b))
+}
+
+func TestFileServerHintedHandoff(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{
+		RequestTimeout:     100 * time.Millisecond,
+		ReplicationFactor:  2,
+		WriteConsistency:   ConsistencyOne,
+		HintReplayInterval: 20 * time.Millisecond,
+	}
+
+	servers := map[string]*FileServer{}
+	for _, addr := range []string{"a", "b", "c"} {
+		servers[addr] = newFaultyServer(t, network, controller, addr, opts)
+	}
+
+	opts.BootstrapNodes = []string{"a", "b", "c"}
+	d := newFaultyServer(t, network, controller, "d", opts)
+	waitForPeers(t, d, 3)
+
+	hash := crypto.HashKey("key")
+	owners := d.replicaOwners(d.ID, hash)
+	require.Len(t, owners, 2)
+
+	// the one node that is no replica owner keeps the writes the down owner misses
+	target := servers[owners[0].ID]
+	var fallback *FileServer
+	for addr, fs := range servers {
+		if addr != owners[0].ID && addr != owners[1].ID {
+			fallback = fs
+		}
+	}
+
+	others := []string{"d"}
+	for addr := range servers {
+		if addr != target.ID {
+			others = append(others, addr)
+		}
+	}
+
+	controller.Partition("lost-target", []string{target.ID}, others)
+	require.Nil(t, d.Save("key", bytes.NewReader([]byte("data"))))
+
+	require.Eventually(t, func() bool {
+		hints, _ := fallback.hints.list(target.ID)
+		return len(hints) == 1 && fallback.store.Has(d.ID, hash)
+	}, time.Second, time.Millisecond)
+	assert.False(t, target.store.Has(d.ID, hash))
+
+	// the owner gets the file once back, the fallback forgets it
+	controller.Heal("lost-target")
+
+	newest, _ := d.store.ReadMetadata(d.ID, "key")
+	require.Eventually(t, func() bool {
+		meta, _ := target.store.ReadMetadata(d.ID, hash)
+		return meta.Equal(newest)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		hints, _ := fallback.hints.list(target.ID)
+		return len(hints) == 0 && !fallback.store.Has(d.ID, hash)
+	}, time.Second, time.Millisecond)
+
+	// so does a delete it misses
+	controller.Partition("lost-target", []string{target.ID}, others)
+	assert.NotNil(t, d.Delete("key"))
+
+	hints, _ := fallback.hints.list(target.ID)
+	require.Len(t, hints, 1)
+	assert.Equal(t, hintDelete, hints[0].Op)
+	assert.True(t, target.store.Has(d.ID, hash))
+
+	controller.Heal("lost-target")
+
+	require.Eventually(t, func() bool {
+		return !target.store.Has(d.ID, hash)
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFileServerHintLimits(t *testing.T) {
+	opts := FileServerOpts{MaxHints: 1, HintTTL: time.Nanosecond}
+	fs := newTestServerWithOpts(t, mem.NewNetwork(), Protocol(), "a", opts)
+
+	var (
+		target = PeerAddr{ID: crypto.GenerateID(), Addr: "b"}
+		owner  = crypto.GenerateID()
+		first  = crypto.HashKey("key-1")
+		second = crypto.HashKey("key-2")
+	)
+
+	require.Nil(t, fs.keepHint(target, owner, first, hintSave))
+	// a newer write of the same file replaces its hint
+	require.Nil(t, fs.keepHint(target, owner, first, hintDelete))
+	assert.ErrorIs(t, fs.keepHint(target, owner, second, hintSave), ErrTooManyHints)
+
+	// the hints of other targets have a queue of their own
+	require.Nil(t, fs.keepHint(PeerAddr{ID: crypto.GenerateID(), Addr: "c"}, owner, second, hintSave))
+
+	// what peers send can't lead the hints out of their folder
+	assert.ErrorIs(t, fs.keepHint(target, owner, "../key", hintSave), ErrInvalidHint)
+
+	escaping := PeerAddr{ID: "../../..", Addr: "d"}
+	require.Nil(t, fs.keepHint(escaping, "../owner", second, hintSave))
+
+	targets, err := fs.hints.targets()
+	require.Nil(t, err)
+	assert.Contains(t, targets, escaping.ID)
+
+	hints, err := fs.hints.list(escaping.ID)
+	require.Nil(t, err)
+	require.Len(t, hints, 1)
+	assert.Equal(t, "../owner", hints[0].Owner)
+
+	path, err := fs.hints.path(escaping.ID, "../owner", second)
+	require.Nil(t, err)
+	assert.FileExists(t, path)
+	assert.Equal(t, fs.hints.root, filepath.Dir(filepath.Dir(filepath.Dir(path))))
+
+	// expired hints are dropped instead of replayed
+	fs.replayHintsTo(target.ID)
+
+	hints, err = fs.hints.list(target.ID)
+	require.Nil(t, err)
+	assert.Empty(t, hints)
+}
+
+func TestFileServerRebalance(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{
+		ReplicationFactor: 1,
+		RebalanceDelay:    20 * time.Millisecond,
+		// long enough for the probes to be answered under -race,
+		// a member falsely declared dead leaves the ring
+		Membership: membership.Opts{
+			ProbeInterval:    50 * time.Millisecond,
+			ProbeTimeout:     40 * time.Millisecond,
+			SuspicionTimeout: 500 * time.Millisecond,
+		},
+	}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+	opts.BootstrapNodes = []string{"a"}
+	b := newFaultyServer(t, network, controller, "b", opts)
+	opts.BootstrapNodes = []string{"a", "b"}
+	c := newFaultyServer(t, network, controller, "c", opts)
+	waitForMesh(t, []*FileServer{a, b, c})
+
+	keys := []string{}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		require.Nil(t, c.Save(key, bytes.NewReader([]byte(key))))
+		keys = append(keys, key)
+	}
+
+	// placed tells whether only the replica owner of every file holds it
+	placed := func(nodes ...*FileServer) bool {
+		for _, key := range keys {
+			hash := crypto.HashKey(key)
+
+			// a ring without the other nodes places nothing
+			owners := c.replicaOwners(c.ID, hash)
+			if len(owners) == 0 {
+				return false
+			}
+
+			for _, fs := range nodes {
+				if fs.store.Has(c.ID, hash) != (fs.ID == owners[0].ID) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	// a joining node gets the files it owns now, the nodes
+	// that held them before drop their copies
+	opts.BootstrapNodes = []string{"a", "b", "c"}
+	d := newFaultyServer(t, network, controller, "d", opts)
+	waitForMesh(t, []*FileServer{a, b, c, d})
+
+	moved := 0
+	for _, key := range keys {
+		if owners := c.replicaOwners(c.ID, crypto.HashKey(key)); len(owners) > 0 && owners[0].ID == d.ID {
+			moved++
+		}
+	}
+	require.NotZero(t, moved)
+
+	require.Eventually(t, func() bool {
+		return placed(a, b, d)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		for _, fs := range []*FileServer{a, b, c, d} {
+			p := fs.RebalanceProgress()
+			if p.Running || p.Finished.IsZero() || p.Pending > 0 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	// a leaving node takes no file with it, the owner sends
+	// the files to the nodes that own them after it
+	d.Stop()
+
+	require.Eventually(t, func() bool {
+		return !c.ring.Has(d.ID) && placed(a, b)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFileServerRebalanceThrottle(t *testing.T) {
+	fs := NewFileServer(FileServerOpts{
+		Transport:     mem.NewMemTransport(mem.MemTransportOpts{ListenAddr: "a", Network: mem.NewNetwork()}),
+		StorageRoot:   t.TempDir(),
+		RebalanceRate: 1000,
+	})
+
+	start := time.Now()
+	fs.throttle(50)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	fs.Stop()
+
+	start = time.Now()
+	fs.throttle(1000)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// files past what size times a second holds in an int64
+	assert.Equal(t, 20*time.Second, throttleDelay(20<<30, 1<<30))
+}
+
+func TestFileServerRebalanceStopped(t *testing.T) {
+	fs := NewFileServer(FileServerOpts{
+		Transport:   mem.NewMemTransport(mem.MemTransportOpts{ListenAddr: "a", Network: mem.NewNetwork()}),
+		StorageRoot: t.TempDir(),
+	})
+
+	owner, hash := crypto.GenerateID(), crypto.HashKey("key")
+	_, err := fs.store.Write(owner, hash, bytes.NewReader([]byte("data")))
+	require.Nil(t, err)
+	require.Nil(t, fs.store.WriteMetadata(owner, hash, storage.Metadata{Version: 1, Size: 4}))
+
+	fs.Stop()
+
+	// a rebalance cut short by the server stopping is not running anymore
+	assert.False(t, fs.rebalance())
+
+	p := fs.RebalanceProgress()
+	assert.False(t, p.Running)
+	assert.False(t, p.Finished.IsZero())
+}
+
+func TestFileServerHeartbeat(t *testing.T) {
+	var (
+		network    = mem.NewNetwork()
+		controller = fault.NewController(1)
+	)
+
+	opts := FileServerOpts{
+		HeartbeatInterval:   20 * time.Millisecond,
+		PeerTimeout:         100 * time.Millisecond,
+		ReconnectBackoff:    10 * time.Millisecond,
+		MaxReconnectBackoff: 50 * time.Millisecond,
+	}
+
+	a := newFaultyServer(t, network, controller, "a", opts)
+
+	opts.BootstrapNodes = []string{"a"}
+	b := newFaultyServer(t, network, controller, "b", opts)
+
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	controller.SetLink("a", "b", fault.LinkFaults{Latency: 5 * time.Millisecond})
+
+	require.Eventually(t, func() bool {
+		stats := b.PeerStats()
+		return len(stats) == 1 && stats[0].LastRTT >= 5*time.Millisecond
+	}, time.Second, time.Millisecond)
+
+	stats := b.PeerStats()[0]
+	assert.Equal(t, "a", stats.PeerID)
+	assert.True(t, stats.Outbound)
+	assert.WithinDuration(t, time.Now(), stats.LastSeen, 100*time.Millisecond)
+
+	// the links go silent without the connections breaking,
+	// only the heartbeats notice the peers are gone
+	controller.Partition("split", []string{"a"}, []string{"b"})
+
+	waitForPeers(t, a, 0)
+	waitForPeers(t, b, 0)
+
+	controller.Heal("split")
+
+	waitForPeers(t, b, 1)
+	assert.Zero(t, b.PeerStats()[0].MissedPings)
+}
+
+func TestFileServerPeerExchange(t *testing.T) {
+	network := mem.NewNetwork()
+
+	opts := FileServerOpts{PeerExchangeInterval: 20 * time.Millisecond}
+
+	seed := newTestServerWithOpts(t, network, Protocol(), "seed", opts)
+
+	// every node only knows the seed, they find each other through it
+	opts.BootstrapNodes = []string{"seed"}
+
+	nodes := []*FileServer{seed}
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, newTestServerWithOpts(t, network, Protocol(), fmt.Sprintf("node-%d", i), opts))
+	}
+
+	for _, fs := range nodes {
+		require.Eventually(t, func() bool {
+			return len(fs.peerList()) == len(nodes)-1
+		}, 2*time.Second, time.Millisecond, "node %s didn't connect to the full cluster", fs.Transport.Addr())
+	}
+}
+
+func TestFileServerPeerExchangeTargetPeers(t *testing.T) {
+	network := mem.NewNetwork()
+
+	opts := FileServerOpts{PeerExchangeInterval: 10 * time.Millisecond}
+	seed := newTestServerWithOpts(t, network, Protocol(), "seed", opts)
+
+	opts.BootstrapNodes = []string{"seed"}
+	opts.TargetPeers = 1
+
+	a := newTestServerWithOpts(t, network, Protocol(), "a", opts)
+	b := newTestServerWithOpts(t, network, Protocol(), "b", opts)
+
+	waitForPeers(t, seed, 2)
+
+	// a few rounds of exchange, the seed is all a and b need
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Len(t, a.peerList(), 1)
+	assert.Len(t, b.peerList(), 1)
+}
+
+func TestFileServerMembership(t *testing.T) {
+	network := mem.NewNetwork()
+
+	opts := FileServerOpts{
+		Membership: membership.Opts{
+			ProbeInterval:    20 * time.Millisecond,
+			SuspicionTimeout: 60 * time.Millisecond,
+		},
+	}
+
+	a := newTestServerWithOpts(t, network, Protocol(), "a", opts)
+
+	opts.BootstrapNodes = []string{"a"}
+	b := newTestServerWithOpts(t, network, Protocol(), "b", opts)
+	c := newTestServerWithOpts(t, network, Protocol(), "c", opts)
+
+	require.Eventually(t, func() bool {
+		members := a.Members()
+		for _, member := range members {
+			if member.State != membership.StateAlive {
+				return false
+			}
+		}
+		return len(members) == 3
+	}, time.Second, time.Millisecond)
+
+	events, unsubscribe := a.SubscribeMembers()
+	defer unsubscribe()
+
+	c.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.Member.ID == c.ID && event.Member.State == membership.StateDead {
+				// the news spreads to the other node as well
+				require.Eventually(t, func() bool {
+					member, ok := b.members.Member(c.ID)
+					return ok && member.State == membership.StateDead
+				}, time.Second, time.Millisecond)
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("node c was not declared dead")
+		}
+	}
+}
+
+func TestFileServerRingPlacement(t *testing.T) {
+	network := mem.NewNetwork()
+
+	opts := FileServerOpts{ReplicationFactor: 2}
+	seed := newTestServerWithOpts(t, network, Protocol(), "seed", opts)
+
+	opts.BootstrapNodes = []string{"seed"}
+
+	nodes := []*FileServer{seed}
+	for i := 0; i < 7; i++ {
+		nodes = append(nodes, newTestServerWithOpts(t, network, Protocol(), fmt.Sprintf("node-%d", i), opts))
+	}
+
+	waitForMesh(t, nodes)
+
+	owner := nodes[3]
+	hash := crypto.HashKey("key")
+	require.Nil(t, owner.Save("key", bytes.NewReader([]byte("placed data"))))
+
+	// only the owners on the ring hold a replica
+	replicaOwners := []string{}
+	for _, node := range owner.replicaOwners(owner.ID, hash) {
+		replicaOwners = append(replicaOwners, node.ID)
+	}
+	require.Len(t, replicaOwners, 2)
+
+	for _, fs := range nodes {
+		assert.Equal(t, slices.Contains(replicaOwners, fs.ID), fs.store.Has(owner.ID, hash))
+	}
+
+	// every node agrees on the owners
+	for _, fs := range nodes {
+		for i, node := range fs.replicaOwners(owner.ID, hash) {
+			assert.Equal(t, replicaOwners[i], node.ID)
+		}
+	}
+
+	require.Nil(t, owner.DeleteLocally("key"))
+
+	r, err := owner.Load("key")
+	require.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "placed data", string(data))
+
+	require.Nil(t, owner.Delete("key"))
+	for _, fs := range nodes {
+		assert.False(t, fs.store.Has(owner.ID, hash))
+	}
+}
+
+func TestFileServerLoadThroughDHT(t *testing.T) {
+	network := mem.NewNetwork()
+
+	// lookups reach only the few nodes closest to a key,
+	// in a cluster bigger than K not every node is asked
+	opts := FileServerOpts{ReplicationFactor: 1, DHT: dht.Opts{K: 2, Alpha: 1}}
+	seed := newTestServerWithOpts(t, network, Protocol(), "seed", opts)
+
+	opts.BootstrapNodes = []string{"seed"}
+
+	nodes := []*FileServer{seed}
+	for i := 0; i < 7; i++ {
+		nodes = append(nodes, newTestServerWithOpts(t, network, Protocol(), fmt.Sprintf("node-%d", i), opts))
+	}
+
+	waitForMesh(t, nodes)
+
+	owner := nodes[1]
+	hash := crypto.HashKey("key")
+	target := dht.NewID(replicaKey(owner.ID, hash))
+
+	// the only replica sits on the node farthest from the key
+	// that the ring doesn't pick
+	var holder *FileServer
+	for _, fs := range nodes {
+		if fs == owner || fs.ID == owner.replicaOwners(owner.ID, hash)[0].ID {
+			continue
+		}
+
+		if holder == nil || fs.dht.Self.ID.Xor(target).Compare(holder.dht.Self.ID.Xor(target)) > 0 {
+			holder = fs
+		}
+	}
+
+	encrypted := new(bytes.Buffer)
+	_, err := crypto.CopyEncrypt(owner.EncKey, bytes.NewReader([]byte("misplaced data")), encrypted)
+	require.Nil(t, err)
+	_, err = holder.store.Write(owner.ID, hash, encrypted)
+	require.Nil(t, err)
+
+	holder.provide(owner.ID, hash)
+
+	r, err := owner.Load("key")
+	require.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "misplaced data", string(data))
+}
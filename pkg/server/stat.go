@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+
+	"github.com/Yaroslaw07/difis/pkg/crypto"
+	"github.com/Yaroslaw07/difis/pkg/storage"
+)
+
+// SaveOptions is what SaveWithOptions keeps in the metadata of a file
+type SaveOptions struct {
+	// ContentType is detected from the key and the content when empty
+	ContentType string
+	Tags        map[string]string
+}
+
+// detectContentType guesses the media type of a file by the extension of
+// its key and then by its first bytes, it returns the reader to write
+// the file from as the bytes looked at are read already
+func detectContentType(key string, r io.Reader) (string, io.Reader) {
+	if contentType := mime.TypeByExtension(filepath.Ext(key)); contentType != "" {
+		return contentType, r
+	}
+
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+
+	return http.DetectContentType(head), br
+}
+
+// Stat returns the metadata of a file, the original key, its size,
+// checksum, content type, timestamps and tags. The local copy answers
+// when this node has it, the newest version ReadConsistency of the
+// replica owners know about otherwise. Replicas know the file only by
+// the hash of its key, the key returned is the one asked for
+func (fs *FileServer) Stat(key string) (storage.Entry, error) {
+	meta, err := fs.store.ReadMetadata(fs.ID, key)
+	if err != nil {
+		return storage.Entry{}, err
+	}
+
+	// only this node writes its files, a file it deleted is gone
+	if meta.Deleted {
+		return storage.Entry{}, fmt.Errorf("[%s] file (%s) was deleted: %w", fs.Transport.Addr(), key, ErrNotFound)
+	}
+
+	if fs.store.Has(fs.ID, key) {
+		return storage.Entry{Key: key, Metadata: meta}, nil
+	}
+
+	hash := crypto.HashKey(key)
+	owners := fs.replicaOwners(fs.ID, hash)
+
+	stats, err := fs.statReplicas(hash, owners, fs.ReadConsistency.required(len(owners)))
+	if err != nil {
+		return storage.Entry{}, fmt.Errorf("[%s] file (%s): %w", fs.Transport.Addr(), key, err)
+	}
+
+	stats = slices.DeleteFunc(stats, func(s replicaStat) bool { return !s.found || s.unversioned })
+	if len(stats) == 0 {
+		return storage.Entry{}, fmt.Errorf("[%s] file (%s): %w", fs.Transport.Addr(), key, ErrNotFound)
+	}
+
+	newest := stats[0].meta
+	for _, s := range stats[1:] {
+		if s.meta.Newer(newest) {
+			newest = s.meta
+		}
+	}
+
+	if newest.Deleted {
+		return storage.Entry{}, fmt.Errorf("[%s] file (%s) was deleted: %w", fs.Transport.Addr(), key, ErrNotFound)
+	}
+
+	return storage.Entry{Key: key, Metadata: newest}, nil
+}
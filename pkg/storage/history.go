@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionsFolderName is where the prior versions of files are kept in
+// the root, no ID starts with a dot
+const versionsFolderName = ".versions"
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// versionsPath is the folder the prior versions of a file are kept in,
+// each one named by its version
+func (s *Store) versionsPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return filepath.Join(s.Root, versionsFolderName, id, pathKey.FullPath())
+}
+
+func (s *Store) keepsVersions() bool {
+	return s.KeepVersions > 0 || s.VersionRetention > 0
+}
+
+// Archive keeps the stored version of a file as a prior version, to be
+// called before the file is replaced. The file stays in place until the
+// write replacing it renames the new one over it, so it is never missing
+// in between. The prior versions past KeepVersions or VersionRetention are
+// dropped. Files without metadata or content, like tombstones, have no
+// version to keep
+func (s *Store) Archive(id string, key string) error {
+	if !s.keepsVersions() || !s.Has(id, key) {
+		return nil
+	}
+
+	meta, err := s.ReadMetadata(id, key)
+	if err != nil || meta.Version == 0 {
+		return err
+	}
+
+	dir := s.versionsPath(id, key)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(Entry{Key: key, Metadata: meta})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, strconv.FormatUint(meta.Version, 10))
+
+	pathKey := s.PathTransformFunc(key)
+	if err := linkOrCopy(fmt.Sprintf(pathFormat, s.Root, id, pathKey.FullPath()), path); err != nil {
+		return err
+	}
+
+	// the retention counts from when the version was replaced
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+metadataSuffix, data, 0o644); err != nil {
+		return err
+	}
+
+	return s.pruneVersions(id, key)
+}
+
+// linkOrCopy makes dst a hard link of src, replacing what dst held. The
+// file is copied on file systems without hard links
+func linkOrCopy(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	return out.Close()
+}
+
+// Versions returns the prior versions of a file, the newest first. The
+// versions past VersionRetention are left out, they are only dropped from
+// disk when the file is replaced again
+func (s *Store) Versions(id string, key string) ([]Metadata, error) {
+	versions, err := s.versions(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := s.versionsPath(id, key)
+
+	return slices.DeleteFunc(versions, func(version Metadata) bool {
+		return s.expired(filepath.Join(dir, strconv.FormatUint(version.Version, 10)))
+	}), nil
+}
+
+// versions returns all the prior versions kept on disk, the newest first
+func (s *Store) versions(id string, key string) ([]Metadata, error) {
+	entries, err := os.ReadDir(s.versionsPath(id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Metadata{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []Metadata{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), metadataSuffix)
+		if !ok {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.versionsPath(id, key), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var version Entry
+		if err := json.Unmarshal(data, &version); err != nil {
+			return nil, fmt.Errorf("reading metadata of version %s: %w", name, err)
+		}
+
+		versions = append(versions, version.Metadata)
+	}
+
+	slices.SortFunc(versions, func(a, b Metadata) int {
+		switch {
+		case a.Version > b.Version:
+			return -1
+		case a.Version < b.Version:
+			return 1
+		}
+		return 0
+	})
+
+	return versions, nil
+}
+
+// ReadVersion reads a prior version of a file, one past
+// VersionRetention is not found
+func (s *Store) ReadVersion(id string, key string, version uint64) (int64, io.Reader, error) {
+	path := filepath.Join(s.versionsPath(id, key), strconv.FormatUint(version, 10))
+	if s.expired(path) {
+		return 0, nil, fmt.Errorf("file %s version %d expired: %w", key, version, ErrVersionNotFound)
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil, fmt.Errorf("file %s version %d: %w", key, version, ErrVersionNotFound)
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+
+	return fi.Size(), file, nil
+}
+
+// pruneVersions drops the prior versions of a file past KeepVersions
+// and those replaced longer than VersionRetention ago
+func (s *Store) pruneVersions(id string, key string) error {
+	versions, err := s.versions(id, key)
+	if err != nil {
+		return err
+	}
+
+	dir := s.versionsPath(id, key)
+	for i, version := range versions {
+		path := filepath.Join(dir, strconv.FormatUint(version.Version, 10))
+
+		if !s.expired(path) && (s.KeepVersions == 0 || i < s.KeepVersions) {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if err := os.Remove(path + metadataSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expired tells whether the prior version at path was replaced longer
+// than VersionRetention ago, the time it was archived is its mod time
+func (s *Store) expired(path string) bool {
+	if s.VersionRetention <= 0 {
+		return false
+	}
+
+	fi, err := os.Stat(path)
+
+	return err == nil && time.Since(fi.ModTime()) > s.VersionRetention
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// keyIndex keeps the files stored under every ID ordered by name, so a
+// page of them is found without reading the metadata of every file. The
+// files of an ID are read from disk the first time they are listed, the
+// index follows the writes and deletes of the store after that
+type keyIndex struct {
+	lock sync.Mutex
+	ids  map[string]*idIndex
+}
+
+// idIndex are the files stored under one ID, ordered by name and then key
+type idIndex struct {
+	entries []indexEntry
+	names   map[string]string
+}
+
+type indexEntry struct {
+	name string
+	Entry
+	// described is set once the file has metadata, the files without
+	// any are not listed, their entry doesn't tell what they are
+	described bool
+}
+
+// IndexName is what the file is ordered by when listed, the key it was
+// saved under when its metadata tells, the key it is stored under if not
+func (e Entry) IndexName() string {
+	if e.Name != "" {
+		return e.Name
+	}
+
+	return e.Key
+}
+
+// cursorSeparator parts the name and the key of the last file of a page in
+// its cursor, files sharing a name are paged by their key too
+const cursorSeparator = "\x00"
+
+// pageCursor is where the page after the entry starts
+func pageCursor(e Entry) string {
+	return e.IndexName() + cursorSeparator + e.Key
+}
+
+func compareIndexEntries(a, b indexEntry) int {
+	if c := strings.Compare(a.name, b.name); c != 0 {
+		return c
+	}
+
+	return strings.Compare(a.Key, b.Key)
+}
+
+// load returns the index of the ID, reading it from disk the first time
+func (x *keyIndex) load(s *Store, id string) (*idIndex, error) {
+	if index, ok := x.ids[id]; ok {
+		return index, nil
+	}
+
+	entries, err := s.List(id)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &idIndex{names: make(map[string]string, len(entries))}
+	for _, entry := range entries {
+		index.put(entry, true)
+	}
+
+	if x.ids == nil {
+		x.ids = make(map[string]*idIndex)
+	}
+	x.ids[id] = index
+
+	return index, nil
+}
+
+// update changes the index of the ID if it was read from disk already,
+// the files written before that are read with it
+func (x *keyIndex) update(id string, change func(index *idIndex)) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if index, ok := x.ids[id]; ok {
+		change(index)
+	}
+}
+
+func (x *keyIndex) clear() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.ids = nil
+}
+
+func (index *idIndex) find(key string) (int, bool) {
+	name, ok := index.names[key]
+	if !ok {
+		return 0, false
+	}
+
+	return slices.BinarySearchFunc(index.entries, indexEntry{name: name, Entry: Entry{Key: key}}, compareIndexEntries)
+}
+
+func (index *idIndex) put(entry Entry, described bool) {
+	index.remove(entry.Key)
+
+	e := indexEntry{name: entry.IndexName(), Entry: entry, described: described}
+	i, _ := slices.BinarySearchFunc(index.entries, e, compareIndexEntries)
+
+	index.entries = slices.Insert(index.entries, i, e)
+	index.names[entry.Key] = e.name
+}
+
+func (index *idIndex) remove(key string) {
+	if i, ok := index.find(key); ok {
+		index.entries = slices.Delete(index.entries, i, i+1)
+	}
+
+	delete(index.names, key)
+}
+
+// Keys returns a page of the files stored under the ID named with the
+// prefix, ordered by name and key and starting after the cursor, tombstones
+// left out. At most limit files are returned when it is positive, the cursor
+// to pass for the next page is empty once there are no more. A cursor that
+// is only a name starts after every file with that name
+func (s *Store) Keys(id string, prefix, cursor string, limit int) ([]Entry, string, error) {
+	return s.page(id, prefix, cursor, limit, false)
+}
+
+// Scan returns a page of the files stored under the ID like Keys, with
+// the tombstones among them
+func (s *Store) Scan(id string, prefix, cursor string, limit int) ([]Entry, string, error) {
+	return s.page(id, prefix, cursor, limit, true)
+}
+
+func (s *Store) page(id string, prefix, cursor string, limit int, tombstones bool) ([]Entry, string, error) {
+	s.index.lock.Lock()
+	defer s.index.lock.Unlock()
+
+	index, err := s.index.load(s, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	name, key, keyed := strings.Cut(cursor, cursorSeparator)
+
+	// the first file named with the prefix after the cursor
+	i, _ := slices.BinarySearchFunc(index.entries, max(prefix, name), func(e indexEntry, name string) int {
+		return strings.Compare(e.name, name)
+	})
+
+	page := []Entry{}
+	for ; i < len(index.entries); i++ {
+		e := index.entries[i]
+		if e.name < name || e.name == name && (!keyed || e.Key <= key) {
+			continue
+		}
+
+		if !strings.HasPrefix(e.name, prefix) {
+			break
+		}
+
+		if !e.described || (e.Deleted && !tombstones) {
+			continue
+		}
+
+		if limit > 0 && len(page) == limit {
+			return page, pageCursor(page[len(page)-1]), nil
+		}
+
+		page = append(page, e.Entry)
+	}
+
+	return page, "", nil
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Yaroslaw07/difis/pkg/vclock"
+)
+
+// metadataSuffix names the sidecar file next to the file it describes
+const metadataSuffix = ".meta"
+
+// Metadata describes a version of a stored file
+type Metadata struct {
+	// Version orders the versions of a file, the newest is the highest
+	Version uint64
+	// Checksum is the hex encoded SHA-256 of the file content,
+	// before it is encrypted for the replicas
+	Checksum string
+	// Size is the size of the file content
+	Size int64
+	// Deleted marks a tombstone, the record that the file was deleted
+	// at Version. It stays after the content is gone, so the delete
+	// wins over the older versions still out there
+	Deleted bool
+	// Clock tells which versions this one was written after, files
+	// written without one are only ordered by their Version
+	Clock vclock.Clock
+	// ContentType is the media type of the file content
+	ContentType string
+	// Created is when the first version of the file was written,
+	// Modified when this one was
+	Created  time.Time
+	Modified time.Time
+	// Tags are the key value pairs the user keeps with the file
+	Tags map[string]string
+	// Name is the key the owner saved the file under, replicas keep the
+	// file by the hash of it
+	Name string
+}
+
+// Newer tells whether m is a more recent version than other. A version
+// written after the other one is newer, two versions written without
+// knowing about each other are ordered by their number and then by their
+// checksum, so every node settles on the same one
+func (m Metadata) Newer(other Metadata) bool {
+	if len(m.Clock) > 0 && len(other.Clock) > 0 {
+		switch m.Clock.Compare(other.Clock) {
+		case vclock.After:
+			return true
+		case vclock.Before:
+			return false
+		}
+	}
+
+	if m.Version != other.Version {
+		return m.Version > other.Version
+	}
+
+	return m.Checksum > other.Checksum
+}
+
+// Concurrent tells whether m and other were written without knowing
+// about each other, or with the same clock but different content
+func (m Metadata) Concurrent(other Metadata) bool {
+	if len(m.Clock) == 0 || len(other.Clock) == 0 {
+		return false
+	}
+
+	switch m.Clock.Compare(other.Clock) {
+	case vclock.Concurrent:
+		return true
+	case vclock.Equal:
+		return m.Checksum != other.Checksum || m.Deleted != other.Deleted
+	}
+
+	return false
+}
+
+// Equal tells whether m and other describe the same version
+func (m Metadata) Equal(other Metadata) bool {
+	return m.Version == other.Version &&
+		m.Checksum == other.Checksum &&
+		m.Size == other.Size &&
+		m.Deleted == other.Deleted &&
+		m.Clock.Compare(other.Clock) == vclock.Equal &&
+		m.ContentType == other.ContentType &&
+		m.Created.Equal(other.Created) &&
+		m.Modified.Equal(other.Modified) &&
+		maps.Equal(m.Tags, other.Tags) &&
+		m.Name == other.Name
+}
+
+// Entry is a stored file, as its metadata records it
+type Entry struct {
+	// Key is the key the file is stored under, it can't
+	// be told from the path the file is stored at
+	Key string
+	Metadata
+}
+
+func (s *Store) metadataPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf(pathFormat, s.Root, id, pathKey.FullPath()) + metadataSuffix
+}
+
+// WriteMetadata stores the metadata of a file that was written already
+func (s *Store) WriteMetadata(id string, key string, meta Metadata) error {
+	data, err := json.Marshal(Entry{Key: key, Metadata: meta})
+	if err != nil {
+		return err
+	}
+
+	path := s.metadataPath(id, key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+
+	s.index.update(id, func(index *idIndex) { index.put(Entry{Key: key, Metadata: meta}, true) })
+
+	return nil
+}
+
+// WriteTombstone deletes the content of a file, if it is stored,
+// keeping only the metadata that records the delete
+func (s *Store) WriteTombstone(id string, key string, meta Metadata) error {
+	pathKey := s.PathTransformFunc(key)
+
+	if err := os.Remove(fmt.Sprintf(pathFormat, s.Root, id, pathKey.FullPath())); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	meta.Deleted = true
+
+	return s.WriteMetadata(id, key, meta)
+}
+
+// ReadMetadata returns the metadata of a file, files written
+// without any have zero metadata
+func (s *Store) ReadMetadata(id string, key string) (Metadata, error) {
+	var entry Entry
+
+	data, err := os.ReadFile(s.metadataPath(id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return entry.Metadata, nil
+	}
+
+	if err != nil {
+		return entry.Metadata, err
+	}
+
+	err = json.Unmarshal(data, &entry)
+
+	return entry.Metadata, err
+}
+
+// List returns the files stored under the ID ordered by key, tombstones
+// included. Only files with metadata are listed, their keys are not
+// known otherwise
+func (s *Store) List(id string) ([]Entry, error) {
+	entries := []Entry{}
+
+	err := filepath.WalkDir(filepath.Join(s.Root, id), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return fs.SkipAll
+		}
+
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, metadataSuffix) {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("reading metadata %s: %w", path, err)
+		}
+
+		entries = append(entries, entry)
+
+		return nil
+	})
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return entries, err
+}
+
+// IDs returns the IDs files are stored under, ordered. Hidden folders
+// in the root are not IDs, others may keep their data there
+func (s *Store) IDs() ([]string, error) {
+	dirs, err := os.ReadDir(s.Root)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, dir := range dirs {
+		if dir.IsDir() && !strings.HasPrefix(dir.Name(), ".") {
+			ids = append(ids, dir.Name())
+		}
+	}
+
+	return ids, nil
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/Yaroslaw07/difis/pkg/crypto"
 )
@@ -70,10 +71,17 @@ type StoreOpts struct {
 	//Root is name the of the directory, where all the files of the system will be stored
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// KeepVersions is how many prior versions of a file Archive keeps and
+	// VersionRetention for how long after they were replaced, zero is no
+	// limit. Prior versions are only kept when either is set
+	KeepVersions     int
+	VersionRetention time.Duration
 }
 
 type Store struct {
 	StoreOpts
+
+	index keyIndex
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -91,17 +99,16 @@ func NewStore(opts StoreOpts) *Store {
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
+	return s.writeStream(id, key, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
 }
 
 func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	file, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-
-	numbOfBytes, err := crypto.CopyEncrypt(encKey, r, file)
-	return int64(numbOfBytes), err
+	return s.writeStream(id, key, func(w io.Writer) (int64, error) {
+		numbOfBytes, err := crypto.CopyDecrypt(encKey, r, w)
+		return int64(numbOfBytes), err
+	})
 }
 
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
@@ -117,11 +124,24 @@ func (s *Store) Delete(id string, key string) error {
 
 	fullPathWithRoot := fmt.Sprintf(pathFormat, s.Root, id, pathKey.FullPath())
 
-	// Remove the specific file
-	if err := os.Remove(fullPathWithRoot); err != nil {
-		return fmt.Errorf("failed to delete file: %w", err)
+	// Remove the specific file, a tombstone has no content left
+	fileErr := os.Remove(fullPathWithRoot)
+	if fileErr != nil && !errors.Is(fileErr, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", fileErr)
 	}
 
+	// and its metadata, if it has any
+	metaErr := os.Remove(s.metadataPath(id, key))
+	if metaErr != nil && !errors.Is(metaErr, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete metadata: %w", metaErr)
+	}
+
+	if fileErr != nil && metaErr != nil {
+		return fmt.Errorf("failed to delete file: %w", fileErr)
+	}
+
+	s.index.update(id, func(index *idIndex) { index.remove(key) })
+
 	// We then can clean up empty directories
 	subFolders := strings.Split(fullPathWithRoot, "/")
 	for i := len(subFolders) - 2; i > 0; i-- {
@@ -150,6 +170,8 @@ func (s *Store) Has(id string, key string) bool {
 }
 
 func (s *Store) Clear() error {
+	defer s.index.clear()
+
 	return os.RemoveAll(s.Root)
 }
 
@@ -161,17 +183,40 @@ func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
 		return nil, err
 	}
 
-	fullPathWithRoot := fmt.Sprintf(pathFormat, s.Root, id, PathKey.FullPath())
-	return os.Create(fullPathWithRoot)
+	return os.CreateTemp(PathNameWithRoot, PathKey.Filename+".*.tmp")
 }
 
-func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
+// writeStream writes the file to a temporary one renamed over it once
+// complete, so a file is never seen half written and a reader that
+// opened it keeps reading the content it opened
+func (s *Store) writeStream(id string, key string, write func(w io.Writer) (int64, error)) (int64, error) {
 	file, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
 
-	return io.Copy(file, r)
+	n, err := write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		pathKey := s.PathTransformFunc(key)
+		err = os.Rename(file.Name(), fmt.Sprintf(pathFormat, s.Root, id, pathKey.FullPath()))
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return n, err
+	}
+
+	s.index.update(id, func(index *idIndex) {
+		if _, ok := index.names[key]; !ok {
+			index.put(Entry{Key: key}, false)
+		}
+	})
+
+	return n, nil
 }
 
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
@@ -2,11 +2,17 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/Yaroslaw07/difis/pkg/crypto"
+	"github.com/Yaroslaw07/difis/pkg/vclock"
 )
 
 func TestPathTransformFunc(t *testing.T) {
@@ -62,6 +68,351 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreRewrite(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	s.Write(id, "key", bytes.NewReader([]byte("first")))
+
+	_, r, err := s.Read(id, "key")
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	defer r.(io.Closer).Close()
+
+	// a failed write leaves the file as it was
+	if _, err := s.Write(id, "key", iotest.ErrReader(errors.New("broken"))); err == nil {
+		t.Errorf("want the write to fail")
+	}
+
+	s.Write(id, "key", bytes.NewReader([]byte("second")))
+
+	// a file opened before it was written over keeps its content
+	if b, _ := io.ReadAll(r); string(b) != "first" {
+		t.Errorf("want first, have %s", b)
+	}
+
+	if _, r, _ := s.Read(id, "key"); r != nil {
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if string(b) != "second" {
+			t.Errorf("want second, have %s", b)
+		}
+	}
+
+	dir := filepath.Dir(fmt.Sprintf(pathFormat, s.Root, id, s.PathTransformFunc("key").FullPath()))
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("want only the file, have %d files", len(files))
+	}
+}
+
+func TestStoreMetadata(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	if _, err := s.Write(id, "key", bytes.NewReader([]byte("some data"))); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	meta, err := s.ReadMetadata(id, "key")
+	if err != nil || !meta.Equal(Metadata{}) {
+		t.Errorf("want no metadata, have %+v, %v", meta, err)
+	}
+
+	now := time.Now()
+	want := Metadata{
+		Version:     2,
+		Checksum:    "abc",
+		Size:        9,
+		ContentType: "text/plain",
+		Created:     now.Add(-time.Hour),
+		Modified:    now,
+		Tags:        map[string]string{"owner": "me"},
+	}
+	if err := s.WriteMetadata(id, "key", want); err != nil {
+		t.Fatalf("WriteMetadata failed: %v", err)
+	}
+
+	if meta, _ := s.ReadMetadata(id, "key"); !meta.Equal(want) {
+		t.Errorf("want %+v, have %+v", want, meta)
+	}
+
+	if !want.Newer(Metadata{Version: 1, Checksum: "abd"}) || want.Newer(Metadata{Version: 2, Checksum: "abd"}) {
+		t.Errorf("versions are misordered")
+	}
+
+	if err := s.Delete(id, "key"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if meta, _ := s.ReadMetadata(id, "key"); !meta.Equal(Metadata{}) {
+		t.Errorf("metadata outlived the file: %+v", meta)
+	}
+}
+
+func TestMetadataClock(t *testing.T) {
+	first := Metadata{Version: 5, Checksum: "a", Clock: vclock.Clock{"a": 1}}
+
+	// a version written after another is newer whatever its number
+	after := Metadata{Version: 1, Checksum: "b", Clock: first.Clock.Increment("b")}
+	if !after.Newer(first) || first.Newer(after) || after.Concurrent(first) {
+		t.Errorf("a version written after %+v is not newer: %+v", first, after)
+	}
+
+	// concurrent versions go by their number
+	concurrent := Metadata{Version: 7, Checksum: "c", Clock: vclock.Clock{"c": 1}}
+	if !concurrent.Concurrent(first) || !concurrent.Newer(first) || first.Newer(concurrent) {
+		t.Errorf("concurrent versions are misordered")
+	}
+
+	if !first.Equal(Metadata{Version: 5, Checksum: "a", Clock: vclock.Clock{"a": 1}}) || first.Equal(after) {
+		t.Errorf("versions are told apart wrongly")
+	}
+}
+
+func TestStoreTombstone(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	s.Write(id, "key", bytes.NewReader([]byte("some data")))
+
+	// a tombstone needs no file to replace
+	for _, key := range []string{"key", "missing"} {
+		if err := s.WriteTombstone(id, key, Metadata{Version: 3}); err != nil {
+			t.Fatalf("WriteTombstone failed: %v", err)
+		}
+
+		if s.Has(id, key) {
+			t.Errorf("content of %s outlived its tombstone", key)
+		}
+
+		if meta, _ := s.ReadMetadata(id, key); !meta.Equal(Metadata{Version: 3, Deleted: true}) {
+			t.Errorf("want a tombstone for %s, have %+v", key, meta)
+		}
+
+		if err := s.Delete(id, key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+
+		if meta, _ := s.ReadMetadata(id, key); !meta.Equal(Metadata{}) {
+			t.Errorf("tombstone of %s outlived Delete: %+v", key, meta)
+		}
+	}
+
+	if err := s.Delete(id, "missing"); err == nil {
+		t.Errorf("deleting nothing succeeded")
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	if entries, err := s.List(id); err != nil || len(entries) != 0 {
+		t.Errorf("want no entries, have %v, %v", entries, err)
+	}
+
+	for _, key := range []string{"b", "a", "c"} {
+		s.Write(id, key, bytes.NewReader([]byte(key)))
+		s.WriteMetadata(id, key, Metadata{Version: 1, Size: 1})
+	}
+
+	// files without metadata can't be listed
+	s.Write(id, "d", bytes.NewReader([]byte("d")))
+
+	entries, err := s.List(id)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+
+	if fmt.Sprint(keys) != "[a b c]" {
+		t.Errorf("want keys [a b c], have %v", keys)
+	}
+}
+
+func TestStoreKeys(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	for _, key := range []string{"a/3", "b/1", "a/1", "a/2"} {
+		s.Write(id, key, bytes.NewReader([]byte(key)))
+		s.WriteMetadata(id, key, Metadata{Version: 1, Size: 3})
+	}
+	s.WriteTombstone(id, "a/0", Metadata{Version: 2})
+
+	keys := func(entries []Entry) string {
+		keys := []string{}
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		return fmt.Sprint(keys)
+	}
+
+	page, next, err := s.Keys(id, "a/", "", 2)
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+
+	if keys(page) != "[a/1 a/2]" || next != "a/2\x00a/2" {
+		t.Errorf("want keys [a/1 a/2] and cursor after a/2, have %v and %q", keys(page), next)
+	}
+
+	page, next, _ = s.Keys(id, "a/", next, 2)
+	if keys(page) != "[a/3]" || next != "" {
+		t.Errorf("want keys [a/3] and no cursor, have %v and %q", keys(page), next)
+	}
+
+	if page, next, _ := s.Keys(id, "", "", 0); keys(page) != "[a/1 a/2 a/3 b/1]" || next != "" {
+		t.Errorf("want all the keys, have %v and %q", keys(page), next)
+	}
+
+	if page, _, _ := s.Scan(id, "a/", "", 0); keys(page) != "[a/0 a/1 a/2 a/3]" {
+		t.Errorf("want the tombstone scanned, have %v", keys(page))
+	}
+
+	// the index follows the files written and deleted after it was read,
+	// files without metadata are not listed
+	s.Delete(id, "a/2")
+	s.Write(id, "a/4", bytes.NewReader([]byte("a/4")))
+	s.Write(id, "a/5", bytes.NewReader([]byte("a/5")))
+	s.WriteMetadata(id, "a/5", Metadata{Version: 1, Size: 3})
+
+	// replicas are stored by hash and listed by the key they were saved under
+	s.Write(id, "f00d", bytes.NewReader([]byte("a/6")))
+	s.WriteMetadata(id, "f00d", Metadata{Version: 1, Size: 3, Name: "a/6"})
+
+	if page, _, _ := s.Keys(id, "a/", "", 0); keys(page) != "[a/1 a/3 a/5 f00d]" {
+		t.Errorf("want keys [a/1 a/3 a/5 f00d], have %v", keys(page))
+	}
+
+	// and are read back from disk the same way
+	reopened := NewStore(s.StoreOpts)
+	if page, _, _ := reopened.Keys(id, "a/", "a/3", 0); keys(page) != "[a/5 f00d]" {
+		t.Errorf("want keys [a/5 f00d], have %v", keys(page))
+	}
+
+	// files sharing a name past the end of a page are on the next one
+	for _, key := range []string{"c1", "c2", "c3"} {
+		s.Write(id, key, bytes.NewReader([]byte(key)))
+		s.WriteMetadata(id, key, Metadata{Version: 1, Size: 2, Name: "c"})
+	}
+
+	page, next, _ = s.Keys(id, "c", "", 2)
+	if keys(page) != "[c1 c2]" || next == "" {
+		t.Errorf("want keys [c1 c2] and a cursor, have %v and %q", keys(page), next)
+	}
+
+	if page, next, _ := s.Keys(id, "c", next, 2); keys(page) != "[c3]" || next != "" {
+		t.Errorf("want keys [c3] and no cursor, have %v and %q", keys(page), next)
+	}
+}
+
+func TestStoreIDs(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	if ids, err := s.IDs(); err != nil || len(ids) != 0 {
+		t.Errorf("want no IDs, have %v, %v", ids, err)
+	}
+
+	for _, id := range []string{"b", "a", ".hidden"} {
+		s.Write(id, "key", bytes.NewReader([]byte(id)))
+	}
+
+	ids, err := s.IDs()
+	if err != nil {
+		t.Fatalf("IDs failed: %v", err)
+	}
+
+	if fmt.Sprint(ids) != "[a b]" {
+		t.Errorf("want IDs [a b], have %v", ids)
+	}
+}
+
+func TestStoreArchive(t *testing.T) {
+	s := newStore()
+	s.KeepVersions = 2
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+
+	for version := uint64(1); version <= 4; version++ {
+		if err := s.Archive(id, "key"); err != nil {
+			t.Fatalf("Archive failed: %v", err)
+		}
+
+		// the archived version stays in place until it is replaced
+		if version > 1 && !s.Has(id, "key") {
+			t.Fatalf("file missing after archiving version %d", version-1)
+		}
+
+		s.Write(id, "key", bytes.NewReader([]byte(fmt.Sprint(version))))
+		s.WriteMetadata(id, "key", Metadata{Version: version, Size: 1})
+	}
+
+	// version 1 is past the two prior versions kept
+	versions, err := s.Versions(id, "key")
+	if err != nil || len(versions) != 2 || versions[0].Version != 3 || versions[1].Version != 2 {
+		t.Fatalf("want versions 3 and 2, have %+v, %v", versions, err)
+	}
+
+	if _, _, err := s.ReadVersion(id, "key", 1); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("want ErrVersionNotFound, have %v", err)
+	}
+
+	_, r, err := s.ReadVersion(id, "key", 2)
+	if err != nil {
+		t.Fatalf("ReadVersion failed: %v", err)
+	}
+	defer r.(io.Closer).Close()
+
+	if b, _ := io.ReadAll(r); string(b) != "2" {
+		t.Errorf("want version 2 to read 2, have %s", b)
+	}
+
+	// versions are dropped once replaced for longer than the retention
+	s.KeepVersions = 0
+	s.VersionRetention = 50 * time.Millisecond
+	time.Sleep(60 * time.Millisecond)
+
+	if err := s.Archive(id, "key"); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+
+	if versions, _ := s.Versions(id, "key"); len(versions) != 1 || versions[0].Version != 4 {
+		t.Errorf("want only version 4, have %+v", versions)
+	}
+
+	// and not served once expired, before the file is replaced again
+	time.Sleep(60 * time.Millisecond)
+
+	if versions, _ := s.Versions(id, "key"); len(versions) != 0 {
+		t.Errorf("want no versions, have %+v", versions)
+	}
+
+	if _, _, err := s.ReadVersion(id, "key", 4); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("want ErrVersionNotFound, have %v", err)
+	}
+
+	// and not kept at all without limits
+	s.VersionRetention = 0
+	s.Write(id, "other", bytes.NewReader([]byte("other")))
+	s.WriteMetadata(id, "other", Metadata{Version: 1})
+
+	if err := s.Archive(id, "other"); err != nil || !s.Has(id, "other") {
+		t.Errorf("file archived without versions being kept: %v", err)
+	}
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
@@ -0,0 +1,97 @@
+package vclock
+
+import "maps"
+
+// Order is how two clocks relate
+type Order int
+
+const (
+	Equal Order = iota
+	// Before is a clock the other one descends from
+	Before
+	// After is a clock that descends from the other one
+	After
+	// Concurrent clocks don't descend from each other, the events
+	// they stand for happened without knowing about each other
+	Concurrent
+)
+
+func (o Order) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	case Concurrent:
+		return "concurrent"
+	default:
+		return "unknown"
+	}
+}
+
+// Clock is a vector clock, the number of events every actor saw. Actors
+// missing from the clock saw none, so the zero clock is empty
+type Clock map[string]uint64
+
+// Increment returns a copy of the clock with one more event of the actor
+func (c Clock) Increment(actor string) Clock {
+	next := maps.Clone(c)
+	if next == nil {
+		next = Clock{}
+	}
+
+	next[actor]++
+
+	return next
+}
+
+// Merge returns the clock that descends from both clocks, it saw
+// every event either of them saw
+func (c Clock) Merge(other Clock) Clock {
+	merged := maps.Clone(c)
+	if merged == nil {
+		merged = Clock{}
+	}
+
+	for actor, n := range other {
+		merged[actor] = max(merged[actor], n)
+	}
+
+	return merged
+}
+
+// Compare tells how the clock relates to the other one
+func (c Clock) Compare(other Clock) Order {
+	var before, after bool
+
+	for actor, n := range c {
+		if n > other[actor] {
+			after = true
+		}
+	}
+
+	for actor, n := range other {
+		if n > c[actor] {
+			before = true
+		}
+	}
+
+	switch {
+	case before && after:
+		return Concurrent
+	case before:
+		return Before
+	case after:
+		return After
+	default:
+		return Equal
+	}
+}
+
+// Descends tells whether the clock saw every event the other one saw
+func (c Clock) Descends(other Clock) bool {
+	order := c.Compare(other)
+	return order == After || order == Equal
+}
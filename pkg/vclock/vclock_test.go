@@ -0,0 +1,43 @@
+package vclock
+
+import "testing"
+
+func TestClockCompare(t *testing.T) {
+	a := Clock{}.Increment("a")
+	ab := a.Increment("b")
+	ac := a.Increment("c")
+
+	tests := []struct {
+		c, other Clock
+		want     Order
+	}{
+		{nil, Clock{}, Equal},
+		{a, a.Merge(nil), Equal},
+		{a, ab, Before},
+		{ab, a, After},
+		{nil, a, Before},
+		{ab, ac, Concurrent},
+		{ab.Merge(ac), ac, After},
+	}
+
+	for _, tt := range tests {
+		if have := tt.c.Compare(tt.other); have != tt.want {
+			t.Errorf("%v compared to %v: want %s, have %s", tt.c, tt.other, tt.want, have)
+		}
+	}
+}
+
+func TestClockCopies(t *testing.T) {
+	a := Clock{"a": 1}
+
+	a.Increment("a")
+	a.Merge(Clock{"b": 2})
+
+	if len(a) != 1 || a["a"] != 1 {
+		t.Errorf("clock changed in place: %v", a)
+	}
+
+	if !a.Increment("b").Descends(a) || a.Descends(a.Increment("b")) {
+		t.Errorf("an incremented clock doesn't descend from the clock")
+	}
+}